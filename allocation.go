@@ -0,0 +1,215 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/shopspring/decimal"
+)
+
+const (
+	AssetClassEquity    = "equity"
+	AssetClassBond      = "bond"
+	AssetClassProperty  = "property"
+	AssetClassCommodity = "commodity"
+	AssetClassCash      = "cash"
+
+	AllocationByStock      = "stock"
+	AllocationByAssetClass = "assetclass"
+	AllocationBySector     = "sector"
+	AllocationByRegion     = "region"
+	AllocationByCurrency   = "currency"
+	AllocationByAccount    = "account"
+
+	AllocationUnknown = "unknown"
+)
+
+// targets must add up to 100% within this
+var AllocationTargetTolerance = NewFromFloat(0.01)
+
+// TargetAllocation is the percent wanted for each key of the dimension e.g. {"equity": 80, "bond": 20}
+type TargetAllocation map[string]Decimal
+
+type AllocationSlice struct {
+	Key           string
+	Value         Money
+	Percent       Decimal
+	TargetPercent Decimal
+	HasTarget     bool
+}
+
+// GetDriftPercent is how far over (positive) or under the target the slice is, zero without a target
+func (slice AllocationSlice) GetDriftPercent() Decimal {
+	if !slice.HasTarget {
+		return NewFromInt(0)
+	}
+	return slice.Percent.Sub(slice.TargetPercent)
+}
+
+type AllocationReport struct {
+	Dimension string
+	Value     Money
+	Slices    []AllocationSlice
+}
+
+func (report AllocationReport) GetSlice(key string) (AllocationSlice, bool) {
+	for _, slice := range report.Slices {
+		if slice.Key == key {
+			return slice, true
+		}
+	}
+	return AllocationSlice{}, false
+}
+
+// GetExposureCurrency defaults to the quote currency, with pence counted as pounds
+func (stock *Stock) GetExposureCurrency() string {
+	if len(stock.ExposureCurrency) > 0 {
+		return stock.ExposureCurrency
+	}
+	if currency := stock.GetQuoteCurrency(); currency != CURRENCY_GBX {
+		return currency
+	}
+	return CURRENCY_GBP
+}
+
+func (stock *Stock) GetAllocationKey(dimension string) string {
+	var key string
+	switch dimension {
+	case AllocationByStock:
+		key = stock.StockId
+	case AllocationByAssetClass:
+		key = stock.AssetClass
+	case AllocationBySector:
+		key = stock.Sector
+	case AllocationByRegion:
+		key = stock.Region
+	case AllocationByCurrency:
+		key = stock.GetExposureCurrency()
+	}
+
+	if len(key) == 0 {
+		return AllocationUnknown
+	}
+	return key
+}
+
+func isAllocationDimension(dimension string) bool {
+	switch dimension {
+	case AllocationByStock, AllocationByAssetClass, AllocationBySector, AllocationByRegion, AllocationByCurrency, AllocationByAccount:
+		return true
+	}
+	return false
+}
+
+func getPositionAllocationKey(position PositionValue, account AccountValuation, stocks map[string]*Stock, dimension string) string {
+	if dimension == AllocationByAccount {
+		return account.Name
+	}
+
+	if position.IsCash {
+		switch dimension {
+		case AllocationByCurrency:
+			return CURRENCY_GBP
+		case AllocationByStock:
+			return CashStockId
+		default:
+			return AssetClassCash
+		}
+	}
+
+	stock, ok := stocks[position.StockId]
+	if !ok || stock == nil {
+		if dimension == AllocationByStock {
+			return position.StockId
+		}
+		return AllocationUnknown
+	}
+
+	key := stock.GetAllocationKey(dimension)
+	if dimension == AllocationByStock && key == AllocationUnknown {
+		return position.StockId
+	}
+	return key
+}
+
+func (target TargetAllocation) Validate() error {
+	if len(target) == 0 {
+		return nil
+	}
+
+	total := NewFromInt(0)
+	for _, percent := range target {
+		if percent.IsNegative() {
+			return fmt.Errorf("negative target allocation %v", percent)
+		}
+		total = total.Add(percent)
+	}
+
+	if total.Sub(NewFromInt(100)).Abs().GreaterThan(AllocationTargetTolerance) {
+		return fmt.Errorf("target allocation adds up to %v%% not 100%%", total)
+	}
+	return nil
+}
+
+// BuildAllocation groups the valuation's positions, cash included, by dimension and compares them to target if set.
+// Slices are largest first, with targeted keys that aren't held at zero
+func BuildAllocation(valuation PortfolioValuation, stocks map[string]*Stock, dimension string, target TargetAllocation) (AllocationReport, error) {
+	if !isAllocationDimension(dimension) {
+		return AllocationReport{}, fmt.Errorf("unknown allocation dimension %v", dimension)
+	}
+	if err := target.Validate(); err != nil {
+		return AllocationReport{}, err
+	}
+
+	values := map[string]*MoneyBag{}
+	for _, account := range valuation.Accounts {
+		for _, position := range account.Positions {
+			key := getPositionAllocationKey(position, account, stocks, dimension)
+			bag, ok := values[key]
+			if !ok {
+				newBag := NewMoneyBag()
+				bag = &newBag
+				values[key] = bag
+			}
+			bag.Add(position.Value)
+		}
+	}
+	for key := range target {
+		if _, ok := values[key]; !ok {
+			bag := NewMoneyBag()
+			values[key] = &bag
+		}
+	}
+
+	report := AllocationReport{
+		Dimension: dimension,
+		Value:     valuation.Value,
+	}
+	for key, bag := range values {
+		value, err := bag.Total(CURRENCY_GBP)
+		if err != nil {
+			return AllocationReport{}, err
+		}
+		percent := NewFromInt(0)
+		if !valuation.Value.Value.IsZero() {
+			percent = value.Value.Div(valuation.Value.Value.Decimal).Mul(NewFromInt(100))
+		}
+
+		targetPercent, hasTarget := target[key]
+		report.Slices = append(report.Slices, AllocationSlice{
+			Key:           key,
+			Value:         value,
+			Percent:       percent,
+			TargetPercent: targetPercent,
+			HasTarget:     hasTarget,
+		})
+	}
+
+	sort.Slice(report.Slices, func(i, j int) bool {
+		if !report.Slices[i].Value.Value.Equal(report.Slices[j].Value.Value.Decimal) {
+			return report.Slices[i].Value.Value.GreaterThan(report.Slices[j].Value.Value.Decimal)
+		}
+		return report.Slices[i].Key < report.Slices[j].Key
+	})
+	return report, nil
+}
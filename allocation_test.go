@@ -0,0 +1,85 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func getAllocationTestData() (PortfolioValuation, map[string]*Stock) {
+	stocks := map[string]*Stock{
+		"vusa": {StockId: "vusa", AssetClass: AssetClassEquity, Region: "US", Exchange: ExchangeLondon, ExposureCurrency: CURRENCY_USD, PriceSell: FromPounds("60")},
+		"igls": {StockId: "igls", AssetClass: AssetClassBond, Region: "UK", Exchange: ExchangeLondon, PriceSell: FromPounds("100")},
+	}
+
+	lot := func(stockId string, units int64, accountId int) Lot {
+		return Lot{StockId: stockId, Units: NewFromInt(units), Transaction: Transaction{AccountId: accountId}}
+	}
+	holdings := []Holding{
+		{StockId: "vusa", Lots: []Lot{lot("vusa", 10, AccountIdIsa), lot("vusa", 5, AccountIdShare)}},
+		{StockId: "igls", Lots: []Lot{lot("igls", 3, AccountIdShare)}},
+	}
+	cash := map[int]*CashLedger{
+		AccountIdIsa: {AccountId: AccountIdIsa, Entries: []CashEntry{{Balance: FromPounds("300")}}},
+	}
+
+	valuation, err := ValuePortfolio(time.Now(), holdings, stocks, cash)
+	CheckError(err)
+	return valuation, stocks
+}
+
+func TestBuildAllocation(t *testing.T) {
+	valuation, stocks := getAllocationTestData()
+
+	target := TargetAllocation{
+		AssetClassEquity:   NewFromInt(70),
+		AssetClassBond:     NewFromInt(20),
+		AssetClassProperty: NewFromInt(10),
+	}
+	report, err := BuildAllocation(valuation, stocks, AllocationByAssetClass, target)
+	if err != nil {
+		t.Fatalf("Allocation expected no error actual %v", err)
+	}
+
+	equity, _ := report.GetSlice(AssetClassEquity)
+	if !equity.Percent.Equal(NewFromInt(60)) || !equity.GetDriftPercent().Equal(NewFromInt(-10)) {
+		t.Errorf("Equity expected 60%% drift -10 actual %v drift %v", equity.Percent, equity.GetDriftPercent())
+	}
+
+	property, ok := report.GetSlice(AssetClassProperty)
+	if !ok || !property.Value.Value.IsZero() || !property.GetDriftPercent().Equal(NewFromInt(-10)) {
+		t.Errorf("Property expected empty slice drift -10 actual %v", property)
+	}
+
+	cash, _ := report.GetSlice(AssetClassCash)
+	if !cash.Percent.Equal(NewFromInt(20)) || cash.HasTarget {
+		t.Errorf("Cash expected 20%% without target actual %v", cash)
+	}
+
+	if report.Slices[0].Key != AssetClassEquity {
+		t.Errorf("Largest slice expected equity actual %v", report.Slices[0].Key)
+	}
+}
+
+func TestBuildAllocationDimensions(t *testing.T) {
+	valuation, stocks := getAllocationTestData()
+
+	byCurrency, _ := BuildAllocation(valuation, stocks, AllocationByCurrency, nil)
+	usd, _ := byCurrency.GetSlice(CURRENCY_USD)
+	if !usd.Value.Value.Equal(NewFromInt(900)) {
+		t.Errorf("USD exposure expected %v actual %v", 900, usd.Value.GetDesc())
+	}
+
+	byAccount, _ := BuildAllocation(valuation, stocks, AllocationByAccount, nil)
+	isa, _ := byAccount.GetSlice(GetAccountName(AccountIdIsa))
+	if !isa.Value.Value.Equal(NewFromInt(900)) {
+		t.Errorf("ISA expected %v actual %v", 900, isa.Value.GetDesc())
+	}
+
+	if _, err := BuildAllocation(valuation, stocks, "colour", nil); err == nil {
+		t.Errorf("Unknown dimension expected error")
+	}
+	if _, err := BuildAllocation(valuation, stocks, AllocationByRegion, TargetAllocation{"US": NewFromInt(90)}); err == nil {
+		t.Errorf("Target not adding to 100 expected error")
+	}
+}
@@ -0,0 +1,623 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ApiPathPrefix       = "/api/"
+	ApiDefaultPageLimit = 100
+	ApiMaxPageLimit     = 1000
+)
+
+var errApiBadRequest = errors.New("bad request")
+
+// ApiPage is the envelope of every list, shaped like the MarketStack responses
+type ApiPage struct {
+	Pagination Pagination  `json:"pagination"`
+	Data       interface{} `json:"data"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// ApiServer is the REST API over a Repository. Money is {"Currency":"GBP","Value":"1.23"} and decimals are strings
+// so nothing is rounded through a float, numbers are accepted too when decoding. Every request needs an API key,
+// with write scope for anything but GET, see Authenticator
+//
+//	GET              /api/stocks, /api/stocks/{id}, /api/stocks/{id}/history
+//	POST             /api/stocks
+//	PUT              /api/stocks/{id}
+//	GET, POST        /api/watches
+//	GET, PUT, DELETE /api/watches/{id}
+//	GET, POST        /api/transactions (?accountId=&stockId=)
+//	GET              /api/holdings (?accountId=), /api/valuations (?cash=true), /api/alerts
+//
+// Lists take limit and offset
+type ApiServer struct {
+	Repository    Repository
+	Config        *Config
+	Authenticator *Authenticator
+	Now           func() time.Time
+	mux           *http.ServeMux
+}
+
+func NewApiServer(repository Repository, cfg *Config) *ApiServer {
+	server := &ApiServer{
+		Repository:    repository,
+		Config:        cfg,
+		Authenticator: NewAuthenticator(cfg),
+		Now:           time.Now,
+		mux:           http.NewServeMux(),
+	}
+
+	server.mux.HandleFunc(ApiPathPrefix+"stocks", server.handleStocks)
+	server.mux.HandleFunc(ApiPathPrefix+"stocks/", server.handleStock)
+	server.mux.HandleFunc(ApiPathPrefix+"watches", server.handleWatches)
+	server.mux.HandleFunc(ApiPathPrefix+"watches/", server.handleWatch)
+	server.mux.HandleFunc(ApiPathPrefix+"transactions", server.handleTransactions)
+	server.mux.HandleFunc(ApiPathPrefix+"holdings", server.handleHoldings)
+	server.mux.HandleFunc(ApiPathPrefix+"valuations", server.handleValuations)
+	server.mux.HandleFunc(ApiPathPrefix+"alerts", server.handleAlerts)
+	return server
+}
+
+// RunApiLocal serves the API from a MemorySnapshot file until the server fails
+func RunApiLocal(address string, snapshotFilename string) error {
+	repository, err := LoadMemoryRepository(snapshotFilename)
+	if err != nil {
+		return err
+	}
+
+	GetLogger().Info("Serving API from memory", "snapshot", snapshotFilename)
+	return ServeApi(address, repository, GetConfig())
+}
+
+// ServeApi serves the API over any Repository until the server fails
+func ServeApi(address string, repository Repository, cfg *Config) error {
+	GetLogger().Info("Serving API", "address", address)
+	return http.ListenAndServe(address, NewApiServer(repository, cfg))
+}
+
+func (server *ApiServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server.Authenticator.Middleware(server.mux).ServeHTTP(writer, request)
+}
+
+func writeApiJson(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		GetLogger().Warning("Could not write API response", "error", err)
+	}
+}
+
+// writeApiError hides the detail of unexpected errors from the caller and logs it instead
+func writeApiError(writer http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		GetLogger().Error("API request failed", "error", err)
+		err = errors.New(http.StatusText(status))
+	}
+	writeApiJson(writer, status, apiError{Error: err.Error()})
+}
+
+func getApiErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errApiBadRequest):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeApiResult(writer http.ResponseWriter, status int, value interface{}, err error) {
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+	writeApiJson(writer, status, value)
+}
+
+func writeApiMethodNotAllowed(writer http.ResponseWriter, allowed ...string) {
+	writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeApiError(writer, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func readApiJson(request *http.Request, target interface{}) error {
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return fmt.Errorf("%w: %v", errApiBadRequest, err)
+	}
+	return nil
+}
+
+// getApiPage is the pagination of count items and the range of them to return
+func getApiPage(request *http.Request, count int) (Pagination, int, int, error) {
+	pagination := Pagination{Limit: ApiDefaultPageLimit, Total: count}
+
+	query := request.URL.Query()
+	if limit := query.Get("limit"); len(limit) > 0 {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > ApiMaxPageLimit {
+			return pagination, 0, 0, fmt.Errorf("%w: limit has to be 1 to %v", errApiBadRequest, ApiMaxPageLimit)
+		}
+		pagination.Limit = value
+	}
+	if offset := query.Get("offset"); len(offset) > 0 {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return pagination, 0, 0, fmt.Errorf("%w: offset has to be 0 or more", errApiBadRequest)
+		}
+		pagination.Offset = value
+	}
+
+	start := pagination.Offset
+	if start > count {
+		start = count
+	}
+	end := start + pagination.Limit
+	if end > count {
+		end = count
+	}
+	pagination.Count = end - start
+	return pagination, start, end, nil
+}
+
+// writeApiPage writes the page of items, a slice cut by the range from getApiPage
+func writeApiPage(writer http.ResponseWriter, request *http.Request, count int, getItems func(start int, end int) interface{}) {
+	pagination, start, end, err := getApiPage(request, count)
+	if err != nil {
+		writeApiError(writer, http.StatusBadRequest, err)
+		return
+	}
+	writeApiJson(writer, http.StatusOK, ApiPage{Pagination: pagination, Data: getItems(start, end)})
+}
+
+// getApiId is the id after prefix and any sub resource after that, e.g. "12", "history" for /api/stocks/12/history
+func getApiId(request *http.Request, prefix string) (string, string) {
+	rest := strings.Trim(strings.TrimPrefix(request.URL.Path, prefix), "/")
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func getApiIntParam(request *http.Request, name string) (int, error) {
+	value := request.URL.Query().Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v has to be a number", errApiBadRequest, name)
+	}
+	return parsed, nil
+}
+
+// stocks
+
+func (server *ApiServer) getSortedStocks(request *http.Request) ([]*Stock, error) {
+	stocks, err := server.Repository.GetStocks(request.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*Stock, 0, len(stocks))
+	for _, stock := range stocks {
+		sorted = append(sorted, stock)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StockId < sorted[j].StockId
+	})
+	return sorted, nil
+}
+
+func (server *ApiServer) handleStocks(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		stocks, err := server.getSortedStocks(request)
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		writeApiPage(writer, request, len(stocks), func(start int, end int) interface{} {
+			return stocks[start:end]
+		})
+
+	case http.MethodPost:
+		var stock Stock
+		err := readApiJson(request, &stock)
+		if err == nil {
+			err = server.Repository.SaveStock(request.Context(), &stock)
+		}
+		writeApiResult(writer, http.StatusCreated, stock, err)
+
+	default:
+		writeApiMethodNotAllowed(writer, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (server *ApiServer) handleStock(writer http.ResponseWriter, request *http.Request) {
+	stockId, sub := getApiId(request, ApiPathPrefix+"stocks/")
+	ctx := request.Context()
+
+	if sub == "history" {
+		if request.Method != http.MethodGet {
+			writeApiMethodNotAllowed(writer, http.MethodGet)
+			return
+		}
+		actions, err := server.Repository.GetCorporateActions(ctx)
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		history, err := server.getUsableHistory(request, stockId, actions)
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		writeApiPage(writer, request, len(history.Eods), func(start int, end int) interface{} {
+			return history.Eods[start:end]
+		})
+		return
+	}
+	if len(sub) > 0 {
+		writeApiError(writer, http.StatusNotFound, fmt.Errorf("stock %v %v: %w", stockId, sub, ErrNotFound))
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		stock, err := server.Repository.GetStock(ctx, stockId)
+		writeApiResult(writer, http.StatusOK, stock, err)
+
+	case http.MethodPut:
+		var stock Stock
+		err := readApiJson(request, &stock)
+		if err == nil {
+			stock.StockId = stockId
+			err = server.Repository.SaveStock(ctx, &stock)
+		}
+		writeApiResult(writer, http.StatusOK, stock, err)
+
+	default:
+		writeApiMethodNotAllowed(writer, http.MethodGet, http.MethodPut)
+	}
+}
+
+// getUsableHistory is the stock's history adjusted for its splits and consolidations, with the close in pounds
+// populated where it wasn't stored
+func (server *ApiServer) getUsableHistory(request *http.Request, stockId string, actions []CorporateAction) (PriceHistory, error) {
+	stock, err := server.Repository.GetStock(request.Context(), stockId)
+	if err != nil {
+		return PriceHistory{}, err
+	}
+	history, err := server.Repository.GetPriceHistory(request.Context(), stockId)
+	if err != nil {
+		return PriceHistory{}, err
+	}
+
+	for ix := range history.Eods {
+		eod := &history.Eods[ix]
+		if !eod.PriceClosePounds.isUnset() {
+			continue
+		}
+		if err = eod.populateUsablePrice(stock); err != nil {
+			return PriceHistory{}, fmt.Errorf("stock %v: %w", stockId, err)
+		}
+	}
+	history.ApplyCorporateActions(stockId, actions)
+	return history, nil
+}
+
+// watches
+
+// validateWatch rejects watches that could never be evaluated
+func validateWatch(watch Watch) error {
+	if len(watch.StockId) == 0 {
+		return fmt.Errorf("%w: watch needs a StockId", errApiBadRequest)
+	}
+	if watch.WatchType == WatchTypeExpression {
+		if _, err := ParseExpression(watch.Expression); err != nil {
+			return fmt.Errorf("%w: %v", errApiBadRequest, err)
+		}
+	}
+	return nil
+}
+
+func (server *ApiServer) saveWatch(request *http.Request, watchId string) (Watch, error) {
+	var watch Watch
+	if err := readApiJson(request, &watch); err != nil {
+		return watch, err
+	}
+	if len(watchId) > 0 {
+		watch.WatchId = watchId
+	}
+	if err := validateWatch(watch); err != nil {
+		return watch, err
+	}
+	err := server.Repository.SaveWatch(request.Context(), &watch)
+	return watch, err
+}
+
+func (server *ApiServer) handleWatches(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		watches, err := server.Repository.GetWatches(request.Context())
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		writeApiPage(writer, request, len(watches), func(start int, end int) interface{} {
+			return watches[start:end]
+		})
+
+	case http.MethodPost:
+		watch, err := server.saveWatch(request, "")
+		writeApiResult(writer, http.StatusCreated, watch, err)
+
+	default:
+		writeApiMethodNotAllowed(writer, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (server *ApiServer) handleWatch(writer http.ResponseWriter, request *http.Request) {
+	watchId, sub := getApiId(request, ApiPathPrefix+"watches/")
+	if len(sub) > 0 {
+		writeApiError(writer, http.StatusNotFound, fmt.Errorf("watch %v %v: %w", watchId, sub, ErrNotFound))
+		return
+	}
+	ctx := request.Context()
+
+	switch request.Method {
+	case http.MethodGet:
+		watch, err := server.Repository.GetWatch(ctx, watchId)
+		writeApiResult(writer, http.StatusOK, watch, err)
+
+	case http.MethodPut:
+		if _, err := server.Repository.GetWatch(ctx, watchId); err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		watch, err := server.saveWatch(request, watchId)
+		writeApiResult(writer, http.StatusOK, watch, err)
+
+	case http.MethodDelete:
+		if err := server.Repository.DeleteWatch(ctx, watchId); err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeApiMethodNotAllowed(writer, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// transactions
+
+func (server *ApiServer) handleTransactions(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		accountId, err := getApiIntParam(request, "accountId")
+		if err != nil {
+			writeApiError(writer, http.StatusBadRequest, err)
+			return
+		}
+		stockId := request.URL.Query().Get("stockId")
+
+		all, err := server.Repository.GetTransactions(request.Context())
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+
+		transactions := []Transaction{}
+		for _, transaction := range all {
+			if (accountId != 0 && transaction.AccountId != accountId) || (len(stockId) > 0 && transaction.StockId != stockId) {
+				continue
+			}
+			transactions = append(transactions, transaction)
+		}
+		writeApiPage(writer, request, len(transactions), func(start int, end int) interface{} {
+			return transactions[start:end]
+		})
+
+	case http.MethodPost:
+		var transaction Transaction
+		err := readApiJson(request, &transaction)
+		if err == nil {
+			if _, errDt := ParseDt(transaction.DtTrade); errDt != nil {
+				err = fmt.Errorf("%w: DtTrade %v", errApiBadRequest, errDt)
+			}
+		}
+		if err == nil {
+			err = server.Repository.SaveTransaction(request.Context(), &transaction)
+		}
+		writeApiResult(writer, http.StatusCreated, transaction, err)
+
+	default:
+		writeApiMethodNotAllowed(writer, http.MethodGet, http.MethodPost)
+	}
+}
+
+// holdings, valuations and alerts
+
+// getHoldings replays the transactions, of one account if accountId isn't 0, into the holdings still held
+func (server *ApiServer) getHoldings(request *http.Request, accountId int) ([]Holding, []Transaction, error) {
+	ctx := request.Context()
+	transactions, err := server.Repository.GetTransactions(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions, err := server.Repository.GetCorporateActions(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if accountId != 0 {
+		var filtered []Transaction
+		for _, transaction := range transactions {
+			if transaction.AccountId == accountId {
+				filtered = append(filtered, transaction)
+			}
+		}
+		transactions = filtered
+	}
+
+	replayed, err := ReplayHoldings(transactions, actions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	holdings := []Holding{}
+	for _, holding := range replayed {
+		if holding.GetUnitsTotal().IsPositive() {
+			holdings = append(holdings, *holding)
+		}
+	}
+	sort.Slice(holdings, func(i, j int) bool {
+		return holdings[i].StockId < holdings[j].StockId
+	})
+	return holdings, transactions, nil
+}
+
+func (server *ApiServer) handleHoldings(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeApiMethodNotAllowed(writer, http.MethodGet)
+		return
+	}
+
+	accountId, err := getApiIntParam(request, "accountId")
+	if err != nil {
+		writeApiError(writer, http.StatusBadRequest, err)
+		return
+	}
+	holdings, _, err := server.getHoldings(request, accountId)
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+	writeApiPage(writer, request, len(holdings), func(start int, end int) interface{} {
+		return holdings[start:end]
+	})
+}
+
+// handleValuations values the holdings at each stock's last stored close
+func (server *ApiServer) handleValuations(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeApiMethodNotAllowed(writer, http.MethodGet)
+		return
+	}
+
+	holdings, transactions, err := server.getHoldings(request, 0)
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+	actions, err := server.Repository.GetCorporateActions(request.Context())
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+
+	stocks := map[string]*Stock{}
+	for _, holding := range holdings {
+		stock, err := server.Repository.GetStock(request.Context(), holding.StockId)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		history, err := server.getUsableHistory(request, holding.StockId, actions)
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		if len(history.Eods) > 0 {
+			stock.PriceSell = history.Eods[0].PriceClosePounds
+			stock.PriceBuy = history.Eods[0].PriceClosePounds
+		}
+		stocks[holding.StockId] = stock
+	}
+
+	var cashLedgers map[int]*CashLedger
+	if request.URL.Query().Get("cash") == "true" {
+		if cashLedgers, err = BuildCashLedgersWithActions(transactions, actions); err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+	}
+
+	valuation, err := ValuePortfolio(server.Now(), holdings, stocks, cashLedgers)
+	writeApiResult(writer, http.StatusOK, valuation, err)
+}
+
+// handleAlerts evaluates every running watch against its stock's stored history
+func (server *ApiServer) handleAlerts(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeApiMethodNotAllowed(writer, http.MethodGet)
+		return
+	}
+
+	watches, err := server.Repository.GetWatches(request.Context())
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+	actions, err := server.Repository.GetCorporateActions(request.Context())
+	if err != nil {
+		writeApiError(writer, getApiErrorStatus(err), err)
+		return
+	}
+
+	alerts := []Alert{}
+	for _, watch := range watches {
+		if isWatchStopped(watch, server.Now()) {
+			continue
+		}
+
+		stock, err := server.Repository.GetStock(request.Context(), watch.StockId)
+		if errors.Is(err, ErrNotFound) {
+			GetLogger().Warning("No stock for watch", "watchId", watch.WatchId, "stockId", watch.StockId)
+			continue
+		}
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+		history, err := server.getUsableHistory(request, watch.StockId, actions)
+		if err != nil {
+			writeApiError(writer, getApiErrorStatus(err), err)
+			return
+		}
+
+		// the reference price is converted here so a failed rate is an error rather than a panic in Evaluate
+		if !watch.AddedPriceBuy.isUnset() {
+			if watch.AddedPriceBuy, err = watch.AddedPriceBuy.toPoundsStrict(); err != nil {
+				writeApiError(writer, http.StatusInternalServerError, fmt.Errorf("watch %v: %w", watch.WatchId, err))
+				return
+			}
+		}
+
+		wd := WatchDetail{Stock: stock, Watch: watch, History: history}
+		alerts = append(alerts, wd.Evaluate()...)
+	}
+
+	writeApiPage(writer, request, len(alerts), func(start int, end int) interface{} {
+		return alerts[start:end]
+	})
+}
@@ -0,0 +1,243 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const testApiKey = "test-key"
+
+func getTestApiServer(t *testing.T) *ApiServer {
+	repository, err := LoadMemoryRepository("examples/apisnapshot.json")
+	if err != nil {
+		t.Fatalf("load snapshot %v", err)
+	}
+
+	server := NewApiServer(repository, &Config{MyApiKey: testApiKey})
+	server.Now = func() time.Time {
+		return time.Date(2021, 1, 6, 18, 0, 0, 0, time.UTC)
+	}
+	return server
+}
+
+func doApiRequest(server *ApiServer, method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(HeaderAuthorization, "Bearer "+testApiKey)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decodeApiPage(t *testing.T, recorder *httptest.ResponseRecorder, data interface{}) Pagination {
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status expected %v actual %v %v", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	page := struct {
+		Pagination Pagination `json:"pagination"`
+		Data       json.RawMessage
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode page %v", err)
+	}
+	if err := json.Unmarshal(page.Data, data); err != nil {
+		t.Fatalf("decode data %v", err)
+	}
+	return page.Pagination
+}
+
+func TestApiKey(t *testing.T) {
+	server := getTestApiServer(t)
+
+	for _, path := range []string{"/api/stocks", "/api/stocks?api_key=wrong", "/api/stocks?api_key=" + testApiKey} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%v status expected %v actual %v", path, http.StatusUnauthorized, recorder.Code)
+		}
+		if strings.Contains(recorder.Body.String(), "wrong") {
+			t.Errorf("%v response echoes the key %v", path, recorder.Body.String())
+		}
+	}
+}
+
+func TestApiStocksPagination(t *testing.T) {
+	server := getTestApiServer(t)
+
+	var stocks []Stock
+	pagination := decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/stocks?limit=1&offset=1", ""), &stocks)
+	if pagination.Total != 2 || pagination.Count != 1 || len(stocks) != 1 || stocks[0].StockId != "vusa" {
+		t.Errorf("page expected vusa of 2 actual %+v %v", pagination, stocks)
+	}
+
+	recorder := doApiRequest(server, http.MethodGet, "/api/stocks?limit=0", "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status expected %v actual %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	recorder = doApiRequest(server, http.MethodGet, "/api/stocks/missing", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status expected %v actual %v", http.StatusNotFound, recorder.Code)
+	}
+
+	var eods []EodMarketStack
+	decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/stocks/iag/history", ""), &eods)
+	if len(eods) != 3 || !eods[0].PriceClose.Equal(NewFromInt(160)) || !eods[0].Date.Equal(time.Date(2021, 1, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("history expected 3 eods from 160 on 2021-01-06 actual %v", eods)
+	}
+}
+
+func TestApiWatches(t *testing.T) {
+	server := getTestApiServer(t)
+
+	body := `{"StockId": "iag", "WatchType": 3, "Expression": "close < sma(200)", "AddedPriceBuy": {"Currency": "GBP", "Value": 1.234}}`
+	recorder := doApiRequest(server, http.MethodPost, "/api/watches", body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status expected %v actual %v %v", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+
+	// decimals go out as strings whether they came in as numbers or not
+	if !strings.Contains(recorder.Body.String(), `"AddedPriceBuy":{"Currency":"GBP","Value":"1.234"}`) {
+		t.Errorf("money expected as a string actual %v", recorder.Body.String())
+	}
+
+	var created Watch
+	if err := json.Unmarshal(recorder.Body.Bytes(), &created); err != nil || len(created.WatchId) == 0 {
+		t.Fatalf("created watch %v %v", created, err)
+	}
+
+	recorder = doApiRequest(server, http.MethodPut, "/api/watches/"+created.WatchId, `{"StockId": "iag", "WatchType": 3, "Expression": "close <"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status expected %v actual %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	recorder = doApiRequest(server, http.MethodDelete, "/api/watches/"+created.WatchId, "")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("status expected %v actual %v", http.StatusNoContent, recorder.Code)
+	}
+	recorder = doApiRequest(server, http.MethodGet, "/api/watches/"+created.WatchId, "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status expected %v actual %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestApiTransactionsAndHoldings(t *testing.T) {
+	server := getTestApiServer(t)
+
+	body := `{"StockId": "iag", "DtTrade": "2021-01-06 10:00:00", "Units": "40", "UnitPrice": {"Currency": "GBP", "Value": "1.60"}, "ValueQuoted": {"Currency": "GBP", "Value": "64"}, "AccountId": 1}`
+	recorder := doApiRequest(server, http.MethodPost, "/api/transactions", body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status expected %v actual %v %v", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+
+	var transactions []Transaction
+	decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/transactions?accountId=1&stockId=iag", ""), &transactions)
+	if len(transactions) != 2 {
+		t.Errorf("transactions expected %v actual %v", 2, len(transactions))
+	}
+
+	var holdings []Holding
+	decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/holdings?accountId=1", ""), &holdings)
+	if len(holdings) != 1 || !holdings[0].GetUnitsTotal().Equal(NewFromInt(60)) {
+		t.Errorf("holdings expected 60 iag actual %v", holdings)
+	}
+}
+
+func TestApiValuationsAndAlerts(t *testing.T) {
+	server := getTestApiServer(t)
+
+	var valuation PortfolioValuation
+	recorder := doApiRequest(server, http.MethodGet, "/api/valuations?cash=true", "")
+	if err := json.Unmarshal(recorder.Body.Bytes(), &valuation); err != nil {
+		t.Fatalf("decode valuation %v %v", err, recorder.Body.String())
+	}
+	// 100 iag at 1.60 and 5 vusa at 59 plus 360 cash in the ISA and -300 in the share account
+	if !valuation.Value.Value.Equal(NewFromInt(515)) {
+		t.Errorf("valuation expected %v actual %v", 515, valuation.Value.Value)
+	}
+
+	var alerts []Alert
+	decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/alerts", ""), &alerts)
+	if len(alerts) != 2 {
+		t.Fatalf("alerts expected %v actual %v", 2, len(alerts))
+	}
+	if alerts[0].Instruction.StockId != "iag" || !strings.Contains(alerts[1].Message, "close < sma(3)") {
+		t.Errorf("alerts expected iag threshold and vusa expression actual %v", alerts)
+	}
+}
+
+// getDollarHistory is a stored history quoted in dollars, the pounds are left for the API to convert
+func getDollarHistory() PriceHistory {
+	eod := getEod("2021-01-06", 700, 700)
+	eod.PriceClosePounds = Money{}
+	return PriceHistory{Eods: []EodMarketStack{eod}}
+}
+
+func TestApiConversionFailureIsServerError(t *testing.T) {
+	defer replaceConversions(nil)()
+	defer replaceConfig(&Config{RateApiKey: "test-key"})()
+	defer replaceTransport(rateTransport{status: http.StatusInternalServerError})()
+
+	server := getTestApiServer(t)
+	ctx := context.Background()
+	CheckError(server.Repository.SaveStock(ctx, &Stock{StockId: "tsla", Symbol: "TSLA", QuoteCurrency: CURRENCY_USD}))
+	CheckError(server.Repository.SavePriceHistory(ctx, "tsla", getDollarHistory()))
+	CheckError(server.Repository.SaveWatch(ctx, &Watch{WatchId: "w3", StockId: "tsla", WatchType: WatchTypeExpression, Expression: "close > 1"}))
+
+	for _, path := range []string{"/api/stocks/tsla/history", "/api/alerts"} {
+		if recorder := doApiRequest(server, http.MethodGet, path, ""); recorder.Code != http.StatusInternalServerError {
+			t.Errorf("%v status expected %v actual %v %v", path, http.StatusInternalServerError, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestApiConcurrentConversions(t *testing.T) {
+	defer replaceConversions(nil)()
+	defer replaceConfig(&Config{RateApiKey: "test-key"})()
+	defer replaceTransport(rateTransport{status: http.StatusOK})()
+
+	server := getTestApiServer(t)
+	ctx := context.Background()
+	CheckError(server.Repository.SaveStock(ctx, &Stock{StockId: "tsla", Symbol: "TSLA", QuoteCurrency: CURRENCY_USD}))
+	CheckError(server.Repository.SavePriceHistory(ctx, "tsla", getDollarHistory()))
+
+	var wait sync.WaitGroup
+	codes := make([]int, 10)
+	for ix := range codes {
+		wait.Add(1)
+		go func(ix int) {
+			defer wait.Done()
+			codes[ix] = doApiRequest(server, http.MethodGet, "/api/stocks/tsla/history", "").Code
+		}(ix)
+	}
+	wait.Wait()
+
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("concurrent history status expected %v actual %v", http.StatusOK, code)
+		}
+	}
+}
+
+func TestApiHistoryAppliesCorporateActions(t *testing.T) {
+	server := getTestApiServer(t)
+	snapshot := server.Repository.(*MemoryRepository).GetSnapshot()
+	snapshot.CorporateActions = append(snapshot.CorporateActions, CorporateAction{
+		StockId: "iag", Type: CorporateActionTypeSplit, DtEffective: "2021-01-05 00:00:00", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(2),
+	})
+	server.Repository = NewMemoryRepositorySnapshot(snapshot)
+
+	var eods []EodMarketStack
+	decodeApiPage(t, doApiRequest(server, http.MethodGet, "/api/stocks/iag/history", ""), &eods)
+	if len(eods) != 3 || !eods[1].PriceClose.Equal(NewFromInt(150)) || !eods[2].PriceClose.Equal(NewFromInt(74)) {
+		t.Errorf("history expected the close before the split halved to 74 actual %v", eods)
+	}
+}
@@ -0,0 +1,223 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ApiScopeRead  = "read"
+	ApiScopeWrite = "write" // includes read
+
+	HeaderApiKey        = "X-Api-Key"
+	HeaderAuthorization = "Authorization"
+
+	// ApiKeyNameDefault is the full access key made from the MyApiKey secret
+	ApiKeyNameDefault = "default"
+
+	apiKeyBytes = 32
+)
+
+var (
+	ErrApiKeyMissing = errors.New("api key missing")
+	ErrApiKeyInvalid = errors.New("api key invalid")
+	ErrApiKeyExpired = errors.New("api key expired")
+	ErrApiKeyScope   = errors.New("api key not allowed")
+)
+
+// ApiKey is stored as the hash of the key so the config never holds the key itself, see HashApiKey
+type ApiKey struct {
+	Name      string   `json:"name" yaml:"name"`
+	Hash      string   `json:"hash" yaml:"hash"`
+	Scopes    []string `json:"scopes" yaml:"scopes"`
+	DtExpires string   `json:"dtExpires" yaml:"dtExpires"` // empty never expires
+}
+
+// HashApiKey is the hex SHA-256 of the key, keys are random so they don't need a slow hash
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateApiKey makes a new random key, give the key to the caller and put its HashApiKey in the config
+func GenerateApiKey() (string, error) {
+	buf := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (key ApiKey) HasScope(scope string) bool {
+	for _, keyScope := range key.Scopes {
+		if keyScope == scope || (keyScope == ApiScopeWrite && scope == ApiScopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired is true from the start of DtExpires, a date that can't be parsed is taken as expired
+func (key ApiKey) IsExpired(now time.Time) bool {
+	if len(key.DtExpires) == 0 {
+		return false
+	}
+	dtExpires, err := ParseDt(key.DtExpires)
+	return err != nil || !now.Before(dtExpires)
+}
+
+// GetRequiredScope is read for the methods that don't change anything, write for the rest
+func GetRequiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ApiScopeRead
+	default:
+		return ApiScopeWrite
+	}
+}
+
+// Authenticator checks the key presented in the Authorization header as "Bearer <key>" or "ApiKey <key>", in the
+// X-Api-Key header or, when AllowQueryKey is set, in the api_key query or form value the cloud functions use.
+// Keys in the query end up in access logs and browser history, so only the legacy CheckApiKey allows them
+type Authenticator struct {
+	Keys          []ApiKey
+	AllowQueryKey bool
+	Now           func() time.Time
+}
+
+// NewAuthenticator uses the config's ApiKeys and the MyApiKey secret as a default key with write scope, keys are only
+// taken from the headers
+func NewAuthenticator(cfg *Config) *Authenticator {
+	keys := append([]ApiKey{}, cfg.ApiKeys...)
+	if len(cfg.MyApiKey) > 0 {
+		keys = append(keys, ApiKey{Name: ApiKeyNameDefault, Hash: HashApiKey(cfg.MyApiKey), Scopes: []string{ApiScopeWrite}})
+	}
+
+	return &Authenticator{
+		Keys: keys,
+		Now:  time.Now,
+	}
+}
+
+// getPresentedApiKey never includes the key in the error
+func (auth *Authenticator) getPresentedApiKey(request *http.Request) (string, error) {
+	if authorization := request.Header.Get(HeaderAuthorization); len(authorization) > 0 {
+		parts := strings.Fields(authorization)
+		if len(parts) != 2 || (!strings.EqualFold(parts[0], "Bearer") && !strings.EqualFold(parts[0], "ApiKey")) {
+			return "", fmt.Errorf("%w: authorization is not Bearer or ApiKey", ErrApiKeyInvalid)
+		}
+		return parts[1], nil
+	}
+
+	if key := request.Header.Get(HeaderApiKey); len(key) > 0 {
+		return key, nil
+	}
+
+	if !auth.AllowQueryKey {
+		return "", ErrApiKeyMissing
+	}
+
+	keys := request.URL.Query()["api_key"]
+	if len(keys) == 0 && request.Method == http.MethodPost && isFormRequest(request) {
+		if err := request.ParseForm(); err != nil {
+			return "", fmt.Errorf("%w: form could not be read", ErrApiKeyInvalid)
+		}
+		keys = request.PostForm["api_key"]
+	}
+
+	switch len(keys) {
+	case 0:
+		return "", ErrApiKeyMissing
+	case 1:
+		return keys[0], nil
+	default:
+		return "", fmt.Errorf("%w: expected 1 key got %v", ErrApiKeyInvalid, len(keys))
+	}
+}
+
+// isFormRequest is true for form posts, JSON bodies are left unread for the handler
+func isFormRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data")
+}
+
+// Authenticate finds the key the request presents. Every stored hash is compared in constant time so neither the
+// time taken nor the order of the keys says anything about how close the key was
+func (auth *Authenticator) Authenticate(request *http.Request) (ApiKey, error) {
+	presented, err := auth.getPresentedApiKey(request)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if len(presented) == 0 {
+		return ApiKey{}, ErrApiKeyMissing
+	}
+
+	presentedHash := []byte(HashApiKey(presented))
+	var matched *ApiKey
+	for ix := range auth.Keys {
+		if subtle.ConstantTimeCompare(presentedHash, []byte(strings.ToLower(auth.Keys[ix].Hash))) == 1 && matched == nil {
+			matched = &auth.Keys[ix]
+		}
+	}
+
+	if matched == nil {
+		return ApiKey{}, ErrApiKeyInvalid
+	}
+	if matched.IsExpired(auth.Now()) {
+		return *matched, fmt.Errorf("%w: %v", ErrApiKeyExpired, matched.Name)
+	}
+	return *matched, nil
+}
+
+// Authorize is Authenticate then a check the key has the scope
+func (auth *Authenticator) Authorize(request *http.Request, scope string) (ApiKey, error) {
+	key, err := auth.Authenticate(request)
+	if err != nil {
+		return key, err
+	}
+	if !key.HasScope(scope) {
+		return key, fmt.Errorf("%w: %v does not have %v", ErrApiKeyScope, key.Name, scope)
+	}
+	return key, nil
+}
+
+// GetAuthErrorStatus is 403 for a valid key without the scope and 401 for anything else
+func GetAuthErrorStatus(err error) int {
+	if errors.Is(err, ErrApiKeyScope) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// WriteApiKeyError logs the refused request and answers 401 or 403 with the error, see GetAuthErrorStatus
+func WriteApiKeyError(writer http.ResponseWriter, request *http.Request, err error) {
+	status := GetAuthErrorStatus(err)
+	GetLogger().Warning("API request refused", "method", request.Method, "path", request.URL.Path, "error", err)
+	if status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="tracker"`)
+	}
+	writeApiError(writer, status, err)
+}
+
+// Middleware authorizes every request for the scope of its method before passing it on
+func (auth *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		key, err := auth.Authorize(request, GetRequiredScope(request.Method))
+		if err != nil {
+			WriteApiKeyError(writer, request, err)
+			return
+		}
+
+		GetLogger().Debug("API request", "method", request.Method, "path", request.URL.Path, "key", key.Name)
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTestAuthenticator() *Authenticator {
+	auth := NewAuthenticator(&Config{
+		MyApiKey: "legacy-key",
+		ApiKeys: []ApiKey{
+			{Name: "reader", Hash: HashApiKey("read-key"), Scopes: []string{ApiScopeRead}},
+			{Name: "old", Hash: HashApiKey("old-key"), Scopes: []string{ApiScopeWrite}, DtExpires: "2021-01-01"},
+		},
+	})
+	auth.Now = func() time.Time {
+		return time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	}
+	auth.AllowQueryKey = true
+	return auth
+}
+
+func TestAuthenticatePresentedKey(t *testing.T) {
+	auth := getTestAuthenticator()
+
+	requests := map[string]*http.Request{
+		"bearer": httptest.NewRequest(http.MethodGet, "/api/stocks", nil),
+		"apikey": httptest.NewRequest(http.MethodGet, "/api/stocks", nil),
+		"header": httptest.NewRequest(http.MethodGet, "/api/stocks", nil),
+		"query":  httptest.NewRequest(http.MethodGet, "/api/stocks?api_key=read-key", nil),
+		"form":   httptest.NewRequest(http.MethodPost, "/api/stocks", strings.NewReader(url.Values{"api_key": {"read-key"}}.Encode())),
+	}
+	requests["bearer"].Header.Set(HeaderAuthorization, "Bearer read-key")
+	requests["apikey"].Header.Set(HeaderAuthorization, "ApiKey read-key")
+	requests["header"].Header.Set(HeaderApiKey, "read-key")
+	requests["form"].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for name, request := range requests {
+		key, err := auth.Authenticate(request)
+		if err != nil || key.Name != "reader" {
+			t.Errorf("%v expected reader actual %v %v", name, key.Name, err)
+		}
+	}
+
+	auth.AllowQueryKey = false
+	if _, err := auth.Authenticate(httptest.NewRequest(http.MethodGet, "/api/stocks?api_key=read-key", nil)); !errors.Is(err, ErrApiKeyMissing) {
+		t.Errorf("query key when not allowed expected %v actual %v", ErrApiKeyMissing, err)
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	auth := getTestAuthenticator()
+
+	expected := map[string]error{
+		"/api/stocks":                            ErrApiKeyMissing,
+		"/api/stocks?api_key=":                   ErrApiKeyMissing,
+		"/api/stocks?api_key=guess-key":          ErrApiKeyInvalid,
+		"/api/stocks?api_key=a&api_key=b":        ErrApiKeyInvalid,
+		"/api/stocks?api_key=old-key":            ErrApiKeyExpired,
+		"/api/stocks?api_key=" + HashApiKey("x"): ErrApiKeyInvalid,
+	}
+
+	for path, expectedErr := range expected {
+		_, err := auth.Authenticate(httptest.NewRequest(http.MethodGet, path, nil))
+		if !errors.Is(err, expectedErr) {
+			t.Errorf("%v expected %v actual %v", path, expectedErr, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "guess-key") {
+			t.Errorf("%v error echoes the key %v", path, err)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/stocks", nil)
+	request.Header.Set(HeaderAuthorization, "Basic read-key")
+	if _, err := auth.Authenticate(request); !errors.Is(err, ErrApiKeyInvalid) {
+		t.Errorf("basic expected %v actual %v", ErrApiKeyInvalid, err)
+	}
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	auth := getTestAuthenticator()
+	handler := auth.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		method   string
+		key      string
+		expected int
+	}{
+		{http.MethodGet, "read-key", http.StatusOK},
+		{http.MethodPost, "read-key", http.StatusForbidden},
+		{http.MethodDelete, "legacy-key", http.StatusOK},
+		{http.MethodGet, "old-key", http.StatusUnauthorized},
+		{http.MethodGet, "guess-key", http.StatusUnauthorized},
+		{http.MethodGet, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/api/watches", strings.NewReader("{}"))
+		if len(test.key) > 0 {
+			request.Header.Set(HeaderApiKey, test.key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expected {
+			t.Errorf("%v with %v expected %v actual %v", test.method, test.key, test.expected, recorder.Code)
+		}
+		if test.expected == http.StatusUnauthorized && len(recorder.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%v with %v expected a WWW-Authenticate header", test.method, test.key)
+		}
+		if strings.Contains(recorder.Body.String(), "guess-key") {
+			t.Errorf("%v with %v response echoes the key %v", test.method, test.key, recorder.Body.String())
+		}
+	}
+}
+
+func TestGenerateApiKey(t *testing.T) {
+	key, err := GenerateApiKey()
+	CheckError(err)
+	other, err := GenerateApiKey()
+	CheckError(err)
+
+	if len(key) < 40 || key == other {
+		t.Errorf("expected long distinct keys actual %v %v", key, other)
+	}
+	if len(HashApiKey(key)) != 64 {
+		t.Errorf("hash length expected %v actual %v", 64, len(HashApiKey(key)))
+	}
+}
+
+func TestNewAuthenticatorRefusesQueryKey(t *testing.T) {
+	auth := NewAuthenticator(&Config{MyApiKey: "legacy-key"})
+	if _, err := auth.Authenticate(httptest.NewRequest(http.MethodGet, "/api/stocks?api_key=legacy-key", nil)); !errors.Is(err, ErrApiKeyMissing) {
+		t.Errorf("query key expected %v actual %v", ErrApiKeyMissing, err)
+	}
+}
+
+func TestCheckApiKeyResponse(t *testing.T) {
+	configMutex.Lock()
+	previous := config
+	configMutex.Unlock()
+	defer SetConfig(previous)
+	SetConfig(&Config{
+		MyApiKey: "legacy-key",
+		ApiKeys:  []ApiKey{{Name: "reader", Hash: HashApiKey("read-key"), Scopes: []string{ApiScopeRead}}},
+	})
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{http.MethodPost, "/alerts?api_key=legacy-key", http.StatusOK},
+		{http.MethodPost, "/alerts?api_key=read-key", http.StatusForbidden},
+		{http.MethodGet, "/alerts?api_key=guess-key", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		allowed := CheckApiKeyResponse(recorder, httptest.NewRequest(test.method, test.path, nil))
+		if allowed != (test.expected == http.StatusOK) || recorder.Code != test.expected {
+			t.Errorf("%v %v expected %v actual %v allowed %v", test.method, test.path, test.expected, recorder.Code, allowed)
+		}
+	}
+}
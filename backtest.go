@@ -0,0 +1,130 @@
+package common
+
+import (
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+// forward returns are measured this many trading days after each alert by default
+var DefaultBacktestHorizons = []int{5, 20, 60}
+
+type BacktestOptions struct {
+	Horizons []int // trading days after an alert to measure the return over
+	Cooldown int   // trading days after an alert before the watch can fire again, 0 fires every day it triggers
+
+	CorporateActions []CorporateAction // applied to a copy of the history so splits aren't taken as price moves
+}
+
+type BacktestAlert struct {
+	Date           time.Time
+	Price          Money
+	Alert          Alert
+	ForwardReturns []Decimal // percent, one per horizon
+	HasForward     []bool    // false where the history ends before the horizon
+}
+
+type BacktestHorizon struct {
+	Days          int
+	Count         int // alerts with enough history after them
+	AverageReturn Decimal
+	PositiveCount int
+}
+
+type BacktestResult struct {
+	Watch    Watch
+	Days     int // days replayed
+	Alerts   []BacktestAlert
+	Horizons []BacktestHorizon
+}
+
+func (result BacktestResult) GetHitCount() int {
+	return len(result.Alerts)
+}
+
+// GetHitRate is the percent of days replayed the watch fired on
+func (result BacktestResult) GetHitRate() Decimal {
+	if result.Days == 0 {
+		return NewFromInt(0)
+	}
+	return NewFromInt(int64(len(result.Alerts))).Div(NewFromInt(int64(result.Days))).Mul(NewFromInt(100))
+}
+
+// Backtest replays the history oldest to newest, evaluating the watch on each day with only the closes known by then.
+// The history needs PriceClosePounds populated as for a live WatchDetail
+func Backtest(watch Watch, stock *Stock, history PriceHistory, options BacktestOptions) BacktestResult {
+	if len(options.CorporateActions) > 0 {
+		history = copyPriceHistory(history)
+		history.ApplyCorporateActions(watch.StockId, options.CorporateActions)
+	}
+
+	horizons := options.Horizons
+	if len(horizons) == 0 {
+		horizons = DefaultBacktestHorizons
+	}
+
+	result := BacktestResult{Watch: watch}
+	eods := history.Eods
+	nextAllowed := len(eods) - 1
+
+	for ix := len(eods) - 1; ix >= 0; ix-- {
+		eod := eods[ix]
+		if isWatchStopped(watch, eod.Date.Time) {
+			break
+		}
+		result.Days++
+
+		if ix > nextAllowed {
+			continue
+		}
+
+		wd := WatchDetail{
+			Stock:   stock,
+			Watch:   watch,
+			History: PriceHistory{Eods: eods[ix:]},
+		}
+		alerts := wd.Evaluate()
+		if len(alerts) == 0 {
+			continue
+		}
+
+		backtestAlert := BacktestAlert{
+			Date:           eod.Date.Time,
+			Price:          eod.PriceClosePounds,
+			Alert:          alerts[0],
+			ForwardReturns: make([]Decimal, len(horizons)),
+			HasForward:     make([]bool, len(horizons)),
+		}
+		for hx, days := range horizons {
+			if ix-days < 0 || eod.PriceClosePounds.Value.IsZero() {
+				continue
+			}
+			later := eods[ix-days].PriceClosePounds.Value.Decimal
+			backtestAlert.ForwardReturns[hx] = getPercentChange(eod.PriceClosePounds.Value.Decimal, later)
+			backtestAlert.HasForward[hx] = true
+		}
+		result.Alerts = append(result.Alerts, backtestAlert)
+
+		nextAllowed = ix - options.Cooldown - 1
+	}
+
+	for hx, days := range horizons {
+		horizon := BacktestHorizon{Days: days, AverageReturn: NewFromInt(0)}
+		total := NewFromInt(0)
+		for _, alert := range result.Alerts {
+			if !alert.HasForward[hx] {
+				continue
+			}
+			horizon.Count++
+			total = total.Add(alert.ForwardReturns[hx])
+			if alert.ForwardReturns[hx].IsPositive() {
+				horizon.PositiveCount++
+			}
+		}
+		if horizon.Count > 0 {
+			horizon.AverageReturn = total.Div(NewFromInt(int64(horizon.Count)))
+		}
+		result.Horizons = append(result.Horizons, horizon)
+	}
+	return result
+}
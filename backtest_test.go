@@ -0,0 +1,128 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/shopspring/decimal"
+)
+
+// getBacktestHistory is one close per day from 2021-01-01, given oldest first and returned newest first
+func getBacktestHistory(closes ...float64) PriceHistory {
+	history := PriceHistory{}
+	for ix := len(closes) - 1; ix >= 0; ix-- {
+		history.Eods = append(history.Eods, getEod(fmt.Sprintf("2021-01-%02d", ix+1), closes[ix], closes[ix]))
+	}
+	return history
+}
+
+func TestBacktestThreshold(t *testing.T) {
+	history := getBacktestHistory(100, 104, 111, 112, 100, 89, 95, 100)
+	watch := Watch{
+		StockId:        "iag",
+		WatchType:      WatchTypeThreshold,
+		AddedPriceBuy:  FromPounds("100"),
+		AlertThreshold: DecimalExt{NewFromInt(10)},
+	}
+
+	result := Backtest(watch, &Stock{StockId: "iag"}, history, BacktestOptions{Horizons: []int{2}})
+
+	if result.Days != 8 {
+		t.Errorf("days expected %v actual %v", 8, result.Days)
+	}
+	if result.GetHitCount() != 3 {
+		t.Fatalf("hit count expected %v actual %v", 3, result.GetHitCount())
+	}
+
+	expectedDates := []string{"2021-01-03", "2021-01-04", "2021-01-06"}
+	for ix, date := range expectedDates {
+		if actual := result.Alerts[ix].Date.Format(TimeFormatDate); actual != date {
+			t.Errorf("alert %v date expected %v actual %v", ix, date, actual)
+		}
+	}
+
+	// 111 -> 100 and 112 -> 89 have a forward close, 89 on the 6th has 100 two days later
+	first := result.Alerts[0]
+	if !first.HasForward[0] || !first.ForwardReturns[0].Equal(getPercentChange(NewFromInt(111), NewFromInt(100))) {
+		t.Errorf("forward return expected %v actual %v", getPercentChange(NewFromInt(111), NewFromInt(100)), first.ForwardReturns[0])
+	}
+	if !first.Price.Value.Equal(NewFromInt(111)) {
+		t.Errorf("price expected %v actual %v", 111, first.Price.Value)
+	}
+
+	horizon := result.Horizons[0]
+	if horizon.Count != 3 || horizon.PositiveCount != 1 {
+		t.Errorf("horizon count expected %v/%v actual %v/%v", 3, 1, horizon.Count, horizon.PositiveCount)
+	}
+}
+
+func TestBacktestCrashCooldown(t *testing.T) {
+	history := getBacktestHistory(100, 98, 85, 80, 82, 84, 90)
+	watch := Watch{
+		StockId:        "iag",
+		WatchType:      WatchTypeCrashAnalysis,
+		AlertThreshold: DecimalExt{NewFromInt(10)},
+	}
+
+	result := Backtest(watch, nil, history, BacktestOptions{Horizons: []int{1, 10}, Cooldown: 2})
+
+	// 85 on the 3rd fires, the 4th and 5th are cooling down and 84 on the 6th is still 16% off the high
+	expectedDates := []string{"2021-01-03", "2021-01-06"}
+	if result.GetHitCount() != len(expectedDates) {
+		t.Fatalf("hit count expected %v actual %v", len(expectedDates), result.GetHitCount())
+	}
+	for ix, date := range expectedDates {
+		if actual := result.Alerts[ix].Date.Format(TimeFormatDate); actual != date {
+			t.Errorf("alert %v date expected %v actual %v", ix, date, actual)
+		}
+	}
+
+	if result.Alerts[0].Alert.Severity != AlertSeverityWarning {
+		t.Errorf("severity expected %v actual %v", AlertSeverityWarning, result.Alerts[0].Alert.Severity)
+	}
+	if result.Horizons[1].Count != 0 || !result.Horizons[1].AverageReturn.IsZero() {
+		t.Errorf("horizon beyond history expected no returns actual %v", result.Horizons[1].Count)
+	}
+}
+
+func TestBacktestStopped(t *testing.T) {
+	history := getBacktestHistory(100, 80, 70, 60)
+	watch := Watch{
+		StockId:        "iag",
+		WatchType:      WatchTypeCrashAnalysis,
+		AlertThreshold: DecimalExt{NewFromInt(10)},
+		DtStop:         "2021-01-02",
+	}
+
+	result := Backtest(watch, nil, history, BacktestOptions{})
+
+	if result.Days != 2 || result.GetHitCount() != 1 {
+		t.Errorf("days and hits expected %v/%v actual %v/%v", 2, 1, result.Days, result.GetHitCount())
+	}
+	if len(result.Horizons) != len(DefaultBacktestHorizons) {
+		t.Errorf("horizons expected %v actual %v", len(DefaultBacktestHorizons), len(result.Horizons))
+	}
+}
+
+func TestBacktestAppliesCorporateActions(t *testing.T) {
+	history := getBacktestHistory(200, 200, 100, 100)
+	watch := Watch{
+		StockId:        "tsla",
+		WatchType:      WatchTypeThreshold,
+		AddedPriceBuy:  FromPounds("100"),
+		AlertThreshold: DecimalExt{NewFromInt(10)},
+	}
+	split := CorporateAction{StockId: "tsla", Type: CorporateActionTypeSplit, DtEffective: "2021-01-03 00:00:00", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(2)}
+
+	if unadjusted := Backtest(watch, &Stock{StockId: "tsla"}, history, BacktestOptions{}); unadjusted.GetHitCount() != 2 {
+		t.Errorf("unadjusted hit count expected %v actual %v", 2, unadjusted.GetHitCount())
+	}
+
+	adjusted := Backtest(watch, &Stock{StockId: "tsla"}, history, BacktestOptions{CorporateActions: []CorporateAction{split}})
+	if adjusted.GetHitCount() != 0 {
+		t.Errorf("adjusted hit count expected %v actual %v", 0, adjusted.GetHitCount())
+	}
+	if !history.Eods[3].PriceClose.Equal(NewFromInt(200)) {
+		t.Errorf("input history expected unchanged actual %v", history.Eods[3].PriceClose)
+	}
+}
@@ -0,0 +1,257 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const benchmarkQueryLimit = 1000
+
+var ErrPricesNotInPounds = errors.New("prices not in pounds")
+
+// GetBenchmarkStock is the configured benchmark, quoted according to its exchange once the history is fetched
+func GetBenchmarkStock(cfg *Config) *Stock {
+	return &Stock{
+		StockId:     cfg.BenchmarkSymbol,
+		Description: cfg.BenchmarkSymbol,
+		Symbol:      cfg.BenchmarkSymbol,
+	}
+}
+
+// QueryBenchmarkHistory fetches the benchmark's closes from MarketStack, newest first with the pounds price populated
+func QueryBenchmarkHistory(client HttpSource, cfg *Config, dateFrom time.Time, dateTo time.Time) PriceHistory {
+	stock := GetBenchmarkStock(cfg)
+	request := RequestEndOfDay{
+		RequestCommon: RequestCommon{Symbols: []string{stock.Symbol}},
+		DateFrom:      dateFrom,
+		DateTo:        dateTo,
+		Limit:         benchmarkQueryLimit,
+	}
+
+	response := QueryEndOfDayMarketStack(client, request)
+	stock.Exchange = response.GetExchange()
+	response.PopulateUsablePrice(stock)
+	return PriceHistory{Eods: response.Data}
+}
+
+// GetValueOn is the value of the latest point on or before date
+func (series TimeSeries) GetValueOn(date time.Time) (Decimal, bool) {
+	endOfDay := truncateToDay(date).AddDate(0, 0, 1)
+	for _, point := range series {
+		if point.Date.Before(endOfDay) {
+			return point.Value, true
+		}
+	}
+	return Decimal{}, false
+}
+
+type BenchmarkInput struct {
+	AccountId    int // 0 for every account
+	Transactions []Transaction
+	Histories    map[string]PriceHistory // keyed on StockId
+	Stocks       map[string]*Stock       // to convert the histories without pounds populated, e.g. pence
+	Actions      []CorporateAction
+	Benchmark    PriceHistory
+}
+
+type BenchmarkPoint struct {
+	Date            time.Time
+	Invested        Money // net amount put into trades so far
+	Value           Money
+	BenchmarkValue  Money
+	Return          Decimal // percent gain on Invested
+	BenchmarkReturn Decimal
+}
+
+func (point BenchmarkPoint) GetDifference() (Money, error) {
+	return point.Value.SubStrict(point.BenchmarkValue)
+}
+
+// BenchmarkComparison is newest first like PriceHistory
+type BenchmarkComparison struct {
+	AccountId int
+	Points    []BenchmarkPoint
+}
+
+func (comparison BenchmarkComparison) GetLatest() (BenchmarkPoint, bool) {
+	if len(comparison.Points) == 0 {
+		return BenchmarkPoint{}, false
+	}
+	return comparison.Points[0], true
+}
+
+func (comparison BenchmarkComparison) GetValueSeries() TimeSeries {
+	series := make(TimeSeries, 0, len(comparison.Points))
+	for _, point := range comparison.Points {
+		series = append(series, TimePoint{Date: point.Date, Value: point.Value.Value.Decimal})
+	}
+	return series
+}
+
+func (comparison BenchmarkComparison) GetBenchmarkSeries() TimeSeries {
+	series := make(TimeSeries, 0, len(comparison.Points))
+	for _, point := range comparison.Points {
+		series = append(series, TimePoint{Date: point.Date, Value: point.BenchmarkValue.Value.Decimal})
+	}
+	return series
+}
+
+type benchmarkTrade struct {
+	dtSettlement time.Time
+	transaction  Transaction
+}
+
+// CompareToBenchmark builds a shadow portfolio that puts the cash of every buy into the benchmark and takes the cash
+// of every sell out of it, on the trade's settlement date. Both are valued on each day the benchmark has a close
+func CompareToBenchmark(input BenchmarkInput) (BenchmarkComparison, error) {
+	comparison := BenchmarkComparison{AccountId: input.AccountId}
+	benchmark, err := getPoundsSeries(input.Benchmark, nil)
+	if err != nil {
+		return comparison, fmt.Errorf("benchmark: %w", err)
+	}
+	if len(benchmark) == 0 {
+		return comparison, ErrNotEnoughHistory
+	}
+
+	var trades []benchmarkTrade
+	for _, transaction := range input.Transactions {
+		if transaction.Ignore || len(transaction.StockId) == 0 || transaction.Units.IsZero() || transaction.IsDividend() {
+			continue
+		}
+		if input.AccountId != 0 && transaction.AccountId != input.AccountId {
+			continue
+		}
+
+		dtSettlement, err := getCashDt(transaction)
+		if err != nil {
+			return comparison, fmt.Errorf("transaction %v date %v: %w", transaction.TransactionId, transaction.DtTrade, err)
+		}
+		trades = append(trades, benchmarkTrade{dtSettlement: dtSettlement, transaction: transaction})
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].dtSettlement.Before(trades[j].dtSettlement)
+	})
+
+	series := map[string]TimeSeries{}
+	for stockId, history := range input.Histories {
+		if series[stockId], err = getPoundsSeries(history, input.Stocks[stockId]); err != nil {
+			return comparison, fmt.Errorf("stock %v: %w", stockId, err)
+		}
+	}
+
+	invested := NewFromInt(0)
+	benchmarkUnits := NewFromInt(0)
+	var applied []Transaction
+	nextTrade := 0
+
+	for ix := len(benchmark) - 1; ix >= 0; ix-- {
+		date := benchmark[ix].Date
+		endOfDay := truncateToDay(date).AddDate(0, 0, 1)
+
+		for ; nextTrade < len(trades) && trades[nextTrade].dtSettlement.Before(endOfDay); nextTrade++ {
+			trade := trades[nextTrade]
+			price, ok := benchmark.GetValueOn(trade.dtSettlement)
+			if !ok || price.IsZero() {
+				// settled before the benchmark history starts, buy at its first close
+				price = benchmark[len(benchmark)-1].Value
+			}
+
+			cash := trade.transaction.ValueQuoted.toPounds().Value.Neg()
+			invested = invested.Add(cash)
+			benchmarkUnits = benchmarkUnits.Add(cash.Div(price))
+			applied = append(applied, trade.transaction)
+		}
+
+		value, err := getHoldingsValueOn(applied, input.Actions, series, date)
+		if err != nil {
+			return comparison, err
+		}
+		benchmarkValue := benchmarkUnits.Mul(benchmark[ix].Value)
+
+		comparison.Points = append(comparison.Points, BenchmarkPoint{
+			Date:            date,
+			Invested:        Money{Currency: CURRENCY_GBP, Value: DecimalExt{invested}},
+			Value:           Money{Currency: CURRENCY_GBP, Value: DecimalExt{value}},
+			BenchmarkValue:  Money{Currency: CURRENCY_GBP, Value: DecimalExt{benchmarkValue}},
+			Return:          getBenchmarkReturn(invested, value),
+			BenchmarkReturn: getBenchmarkReturn(invested, benchmarkValue),
+		})
+	}
+
+	// newest first
+	for i, j := 0, len(comparison.Points)-1; i < j; i, j = i+1, j-1 {
+		comparison.Points[i], comparison.Points[j] = comparison.Points[j], comparison.Points[i]
+	}
+	return comparison, nil
+}
+
+// getPoundsSeries is the closes in pounds, the quoted closes are converted through the stock when it's known and
+// are an error otherwise as pence would be 100 times the value. The history itself isn't changed
+func getPoundsSeries(history PriceHistory, stock *Stock) (TimeSeries, error) {
+	eods := make([]EodMarketStack, len(history.Eods))
+	copy(eods, history.Eods)
+
+	for ix := range eods {
+		if eods[ix].PriceClosePounds.Currency == CURRENCY_GBP {
+			continue
+		}
+		if stock == nil {
+			return nil, fmt.Errorf("%w: close on %v", ErrPricesNotInPounds, eods[ix].Date.Format(TimeFormatDate))
+		}
+		eods[ix].PopulateUsablePrice(stock)
+	}
+	return PriceHistory{Eods: eods}.ToTimeSeries(), nil
+}
+
+func getBenchmarkReturn(invested Decimal, value Decimal) Decimal {
+	if !invested.IsPositive() {
+		return NewFromInt(0)
+	}
+	return getPercentChange(invested, value)
+}
+
+// getHoldingsValueOn replays the trades settled so far with the actions effective by date and values them on date.
+// Cash paid by those actions, e.g. the cash part of a merger, is kept in the value as the benchmark shadow keeps
+// the units it bought
+func getHoldingsValueOn(transactions []Transaction, actions []CorporateAction, series map[string]TimeSeries, date time.Time) (Decimal, error) {
+	var effective []CorporateAction
+	for _, action := range actions {
+		dtEffective, err := action.GetDtEffective()
+		if err == nil && !dtEffective.After(date) {
+			effective = append(effective, action)
+		}
+	}
+
+	holdings, err := ReplayHoldings(transactions, effective)
+	if err != nil {
+		return Decimal{}, err
+	}
+
+	value := NewFromInt(0)
+	for stockId, holding := range holdings {
+		for _, payment := range holding.Payments {
+			cash, err := payment.ValueQuoted.toPoundsStrict()
+			if err != nil {
+				return Decimal{}, fmt.Errorf("stock %v corporate action cash: %w", stockId, err)
+			}
+			value = value.Add(cash.Value.Decimal)
+		}
+
+		units := holding.GetUnitsTotal()
+		if units.IsZero() {
+			continue
+		}
+
+		price, ok := series[stockId].GetValueOn(date)
+		if !ok {
+			GetLogger().Warning("No price to value holding against benchmark", "stockId", stockId, "date", date.Format(TimeFormatDate))
+			continue
+		}
+		value = value.Add(units.Mul(price))
+	}
+	return value, nil
+}
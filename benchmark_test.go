@@ -0,0 +1,118 @@
+package common
+
+import (
+	"errors"
+	. "github.com/shopspring/decimal"
+	"testing"
+)
+
+func TestCompareToBenchmark(t *testing.T) {
+	benchmark := PriceHistory{Eods: []EodMarketStack{
+		getEod("2021-01-07", 100, 100),
+		getEod("2021-01-06", 120, 120),
+		getEod("2021-01-05", 110, 110),
+		getEod("2021-01-04", 100, 100),
+	}}
+	stock := PriceHistory{Eods: []EodMarketStack{
+		getEod("2021-01-07", 15, 15),
+		getEod("2021-01-06", 15, 15),
+		getEod("2021-01-05", 10, 10),
+		getEod("2021-01-04", 10, 10),
+	}}
+
+	buy := getTradeTransaction("iag", "2021-01-04 00:00:00", 10, "10", "-100")
+	buy.AccountId = AccountIdIsa
+	sell := getTradeTransaction("iag", "2021-01-07 00:00:00", 5, "15", "75")
+	sell.AccountId = AccountIdIsa
+	other := getTradeTransaction("iag", "2021-01-04 00:00:00", 100, "10", "-1000")
+	other.AccountId = AccountIdShare
+
+	comparison, err := CompareToBenchmark(BenchmarkInput{
+		AccountId:    AccountIdIsa,
+		Transactions: []Transaction{sell, buy, other},
+		Histories:    map[string]PriceHistory{"iag": stock},
+		Benchmark:    benchmark,
+	})
+	if err != nil {
+		t.Fatalf("Compare expected no error actual %v", err)
+	}
+	if len(comparison.Points) != 4 {
+		t.Fatalf("Points expected %v actual %v", 4, len(comparison.Points))
+	}
+
+	dayThree := comparison.Points[1]
+	if !dayThree.Value.Value.Equal(NewFromInt(150)) || !dayThree.BenchmarkValue.Value.Equal(NewFromInt(120)) {
+		t.Errorf("Day three expected 150 against 120 actual %v against %v", dayThree.Value.GetDesc(), dayThree.BenchmarkValue.GetDesc())
+	}
+	if !dayThree.Return.Equal(NewFromInt(50)) || !dayThree.BenchmarkReturn.Equal(NewFromInt(20)) {
+		t.Errorf("Day three returns expected 50 and 20 actual %v and %v", dayThree.Return, dayThree.BenchmarkReturn)
+	}
+
+	latest, _ := comparison.GetLatest()
+	if !latest.Invested.Value.Equal(NewFromInt(25)) || !latest.Value.Value.Equal(NewFromInt(75)) || !latest.BenchmarkValue.Value.Equal(NewFromInt(25)) {
+		t.Errorf("Latest expected invested 25 value 75 benchmark 25 actual %v %v %v", latest.Invested.GetDesc(), latest.Value.GetDesc(), latest.BenchmarkValue.GetDesc())
+	}
+	if difference, err := latest.GetDifference(); err != nil || !difference.Value.Equal(NewFromInt(50)) {
+		t.Errorf("Difference expected %v actual %v", 50, difference.GetDesc())
+	}
+}
+
+func TestCompareToBenchmarkConvertsPence(t *testing.T) {
+	benchmark := PriceHistory{Eods: []EodMarketStack{getEod("2021-01-05", 110, 110), getEod("2021-01-04", 100, 100)}}
+
+	// stored closes in pence without pounds populated
+	pence := PriceHistory{Eods: []EodMarketStack{getEod("2021-01-05", 1500, 1500), getEod("2021-01-04", 1000, 1000)}}
+	for ix := range pence.Eods {
+		pence.Eods[ix].PriceClosePounds = Money{}
+	}
+
+	input := BenchmarkInput{
+		Transactions: []Transaction{getTradeTransaction("iag", "2021-01-04 00:00:00", 10, "10", "-100")},
+		Histories:    map[string]PriceHistory{"iag": pence},
+		Benchmark:    benchmark,
+	}
+	if _, err := CompareToBenchmark(input); !errors.Is(err, ErrPricesNotInPounds) {
+		t.Errorf("Compare expected ErrPricesNotInPounds without the stock actual %v", err)
+	}
+
+	input.Stocks = map[string]*Stock{"iag": {StockId: "iag", QuoteCurrency: CURRENCY_GBX}}
+	comparison, err := CompareToBenchmark(input)
+	if err != nil {
+		t.Fatalf("Compare expected no error actual %v", err)
+	}
+	if latest, _ := comparison.GetLatest(); !latest.Value.Value.Equal(NewFromInt(150)) {
+		t.Errorf("Latest expected 150 GBP from pence actual %v", latest.Value.GetDesc())
+	}
+	if !pence.Eods[0].PriceClosePounds.isUnset() {
+		t.Errorf("Input history expected unchanged actual %v", pence.Eods[0].PriceClosePounds.GetDesc())
+	}
+}
+
+func TestCompareToBenchmarkKeepsMergerCash(t *testing.T) {
+	benchmark := PriceHistory{Eods: []EodMarketStack{
+		getEod("2021-01-07", 100, 100),
+		getEod("2021-01-06", 100, 100),
+		getEod("2021-01-05", 100, 100),
+		getEod("2021-01-04", 100, 100),
+	}}
+	old := PriceHistory{Eods: []EodMarketStack{getEod("2021-01-05", 10, 10), getEod("2021-01-04", 10, 10)}}
+	merged := PriceHistory{Eods: []EodMarketStack{getEod("2021-01-07", 8, 8), getEod("2021-01-06", 8, 8)}}
+
+	comparison, err := CompareToBenchmark(BenchmarkInput{
+		Transactions: []Transaction{getTradeTransaction("old", "2021-01-04 00:00:00", 10, "10", "-100")},
+		Actions: []CorporateAction{
+			{StockId: "old", Type: CorporateActionTypeMerger, DtEffective: "2021-01-06 00:00:00", NewStockId: "new", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(1), CashPerUnit: FromPounds("2")},
+		},
+		Histories: map[string]PriceHistory{"old": old, "new": merged},
+		Benchmark: benchmark,
+	})
+	if err != nil {
+		t.Fatalf("Compare expected no error actual %v", err)
+	}
+
+	// 10 new at 8 plus 2 cash for each of the 10 old
+	latest, _ := comparison.GetLatest()
+	if !latest.Value.Value.Equal(NewFromInt(100)) || !latest.BenchmarkValue.Value.Equal(NewFromInt(100)) {
+		t.Errorf("Latest expected 100 against 100 actual %v against %v", latest.Value.GetDesc(), latest.BenchmarkValue.GetDesc())
+	}
+}
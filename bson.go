@@ -0,0 +1,280 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	. "github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	tDecimal    = reflect.TypeOf(Decimal{})
+	tDecimalExt = reflect.TypeOf(DecimalExt{})
+	tMoney      = reflect.TypeOf(Money{})
+)
+
+// BsonRegistry stores decimals as Decimal128 and still reads the legacy {"value": "..."} documents
+var BsonRegistry = NewBsonRegistry()
+
+func NewBsonRegistry() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+
+	rb.RegisterTypeEncoder(tDecimal, bsoncodec.ValueEncoderFunc(encodeDecimalValue))
+	rb.RegisterTypeDecoder(tDecimal, bsoncodec.ValueDecoderFunc(decodeDecimalValue))
+	rb.RegisterTypeEncoder(tDecimalExt, bsoncodec.ValueEncoderFunc(encodeDecimalExtValue))
+	rb.RegisterTypeDecoder(tDecimalExt, bsoncodec.ValueDecoderFunc(decodeDecimalExtValue))
+	rb.RegisterTypeEncoder(tMoney, bsoncodec.ValueEncoderFunc(encodeMoneyValue))
+	rb.RegisterTypeDecoder(tMoney, bsoncodec.ValueDecoderFunc(decodeMoneyValue))
+
+	return rb.Build()
+}
+
+func toDecimal128(d Decimal) (primitive.Decimal128, error) {
+	d128, ok := primitive.ParseDecimal128FromBigInt(d.Coefficient(), int(d.Exponent()))
+	if !ok {
+		return primitive.Decimal128{}, fmt.Errorf("decimal %v does not fit in Decimal128", d.String())
+	}
+	return d128, nil
+}
+
+func fromDecimal128(d128 primitive.Decimal128) (Decimal, error) {
+	coefficient, exponent, err := d128.BigInt()
+	if err != nil {
+		return Decimal{}, err
+	}
+	return NewFromBigInt(coefficient, int32(exponent)), nil
+}
+
+func writeDecimal(vw bsonrw.ValueWriter, d Decimal) error {
+	d128, err := toDecimal128(d)
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(d128)
+}
+
+// readDecimal accepts Decimal128, numbers, strings and the legacy {"value": "..."} document
+func readDecimal(vr bsonrw.ValueReader) (Decimal, error) {
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		d128, err := vr.ReadDecimal128()
+		if err != nil {
+			return Decimal{}, err
+		}
+		return fromDecimal128(d128)
+	case bsontype.String:
+		str, err := vr.ReadString()
+		if err != nil {
+			return Decimal{}, err
+		}
+		if len(str) == 0 {
+			return NewFromInt(0), nil
+		}
+		return NewFromString(str)
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		return NewFromFloat(f), err
+	case bsontype.Int32:
+		i, err := vr.ReadInt32()
+		return NewFromInt32(i), err
+	case bsontype.Int64:
+		i, err := vr.ReadInt64()
+		return NewFromInt(i), err
+	case bsontype.Null:
+		return NewFromInt(0), vr.ReadNull()
+	case bsontype.Undefined:
+		return NewFromInt(0), vr.ReadUndefined()
+	case bsontype.EmbeddedDocument:
+		return readLegacyDecimal(vr)
+	default:
+		return Decimal{}, fmt.Errorf("cannot decode %v into a decimal", vr.Type())
+	}
+}
+
+func readLegacyDecimal(vr bsonrw.ValueReader) (Decimal, error) {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return Decimal{}, err
+	}
+
+	retVal := NewFromInt(0)
+	for {
+		key, elementReader, err := dr.ReadElement()
+		if errors.Is(err, bsonrw.ErrEOD) {
+			return retVal, nil
+		}
+		if err != nil {
+			return Decimal{}, err
+		}
+
+		if key == "value" {
+			retVal, err = readDecimal(elementReader)
+		} else {
+			err = elementReader.Skip()
+		}
+		if err != nil {
+			return Decimal{}, err
+		}
+	}
+}
+
+func encodeDecimalValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tDecimal {
+		return bsoncodec.ValueEncoderError{Name: "DecimalEncodeValue", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+	return writeDecimal(vw, val.Interface().(Decimal))
+}
+
+func decodeDecimalValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDecimal {
+		return bsoncodec.ValueDecoderError{Name: "DecimalDecodeValue", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+
+	d, err := readDecimal(vr)
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(d))
+	return nil
+}
+
+func encodeDecimalExtValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tDecimalExt {
+		return bsoncodec.ValueEncoderError{Name: "DecimalExtEncodeValue", Types: []reflect.Type{tDecimalExt}, Received: val}
+	}
+	return writeDecimal(vw, val.Interface().(DecimalExt).Decimal)
+}
+
+func decodeDecimalExtValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDecimalExt {
+		return bsoncodec.ValueDecoderError{Name: "DecimalExtDecodeValue", Types: []reflect.Type{tDecimalExt}, Received: val}
+	}
+
+	d, err := readDecimal(vr)
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(DecimalExt{d}))
+	return nil
+}
+
+func encodeMoneyValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tMoney {
+		return bsoncodec.ValueEncoderError{Name: "MoneyEncodeValue", Types: []reflect.Type{tMoney}, Received: val}
+	}
+	money := val.Interface().(Money)
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	valueWriter, err := dw.WriteDocumentElement("value")
+	if err != nil {
+		return err
+	}
+	if err = writeDecimal(valueWriter, money.Value.Decimal); err != nil {
+		return err
+	}
+
+	currencyWriter, err := dw.WriteDocumentElement("currency")
+	if err != nil {
+		return err
+	}
+	if err = currencyWriter.WriteString(money.Currency); err != nil {
+		return err
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+func decodeMoneyValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tMoney {
+		return bsoncodec.ValueDecoderError{Name: "MoneyDecodeValue", Types: []reflect.Type{tMoney}, Received: val}
+	}
+
+	if vr.Type() == bsontype.Null {
+		val.Set(reflect.ValueOf(Money{}))
+		return vr.ReadNull()
+	}
+
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return err
+	}
+
+	var money Money
+	for {
+		key, elementReader, err := dr.ReadElement()
+		if errors.Is(err, bsonrw.ErrEOD) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "value":
+			var value Decimal
+			value, err = readDecimal(elementReader)
+			money.Value = DecimalExt{value}
+		case "currency":
+			money.Currency, err = elementReader.ReadString()
+		default:
+			err = elementReader.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	val.Set(reflect.ValueOf(money))
+	return nil
+}
+
+func (w DecimalExt) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	d128, err := toDecimal128(w.Decimal)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return bsontype.Decimal128, bsoncore.AppendDecimal128(nil, d128), nil
+}
+
+func (w *DecimalExt) UnmarshalBSONValue(t bsontype.Type, raw []byte) error {
+	d, err := readDecimal(bsonrw.NewBSONValueReader(t, raw))
+	if err != nil {
+		return err
+	}
+
+	w.Decimal = d
+	return nil
+}
+
+// MarshalBSON goes straight to the codec, the bson encoder would call back into MarshalBSON
+func (w Money) MarshalBSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	vw, err := bsonrw.NewBSONValueWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encodeMoneyValue(bsoncodec.EncodeContext{Registry: BsonRegistry}, vw, reflect.ValueOf(w))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *Money) UnmarshalBSON(raw []byte) error {
+	vr := bsonrw.NewBSONDocumentReader(raw)
+	return decodeMoneyValue(bsoncodec.DecodeContext{Registry: BsonRegistry}, vr, reflect.ValueOf(w).Elem())
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestBsonRoundTripDecimal128(t *testing.T) {
+	transaction := Transaction{
+		StockId:     "5fb5d1f3c1b7a0f1b2c3d4e5",
+		UnitPrice:   FromPounds("4.2391"),
+		Units:       DecimalExt{NewFromFloat(123.5)},
+		ValueQuoted: FromPounds("-523.53"),
+	}
+	lot := Lot{
+		PriceBought: NewFromFloat(4.2391),
+		Units:       NewFromInt(10),
+		Transaction: transaction,
+	}
+
+	raw, err := bson.MarshalWithRegistry(BsonRegistry, lot)
+	CheckError(err)
+
+	document := bson.Raw(raw)
+	if priceType := document.Lookup("pricebought").Type; priceType != bsontype.Decimal128 {
+		t.Errorf("Expected Decimal price bought stored as Decimal128 actual %v", priceType)
+	}
+	if valueType := document.Lookup("transaction", "unitprice", "value").Type; valueType != bsontype.Decimal128 {
+		t.Errorf("Expected Money value stored as Decimal128 actual %v", valueType)
+	}
+	if unitsType := document.Lookup("transaction", "units").Type; unitsType != bsontype.Decimal128 {
+		t.Errorf("Expected DecimalExt stored as Decimal128 actual %v", unitsType)
+	}
+
+	var decoded Lot
+	err = bson.UnmarshalWithRegistry(BsonRegistry, raw, &decoded)
+	CheckError(err)
+
+	if !decoded.PriceBought.Equal(lot.PriceBought) || !decoded.Units.Equal(lot.Units) {
+		t.Errorf("Lot round trip expected %v x %v actual %v x %v", lot.PriceBought, lot.Units, decoded.PriceBought, decoded.Units)
+	}
+	if decoded.Transaction.UnitPrice.Currency != CURRENCY_GBP || !decoded.Transaction.UnitPrice.Value.Equal(transaction.UnitPrice.Value.Decimal) {
+		t.Errorf("Money round trip expected %v actual %v", transaction.UnitPrice.GetDesc(), decoded.Transaction.UnitPrice.GetDesc())
+	}
+	if !decoded.Transaction.Units.Equal(transaction.Units.Decimal) {
+		t.Errorf("DecimalExt round trip expected %v actual %v", transaction.Units, decoded.Transaction.Units)
+	}
+
+	// the default registry goes through the marshaler methods and should agree
+	rawDefault, err := bson.Marshal(transaction)
+	CheckError(err)
+	if unitsType := bson.Raw(rawDefault).Lookup("units").Type; unitsType != bsontype.Decimal128 {
+		t.Errorf("Expected DecimalExt marshaled as Decimal128 actual %v", unitsType)
+	}
+}
+
+func TestBsonReadLegacyDocuments(t *testing.T) {
+	legacy := bson.M{
+		"addedpricebuy":  bson.M{"value": "411.45", "currency": CURRENCY_GBP},
+		"alertthreshold": bson.M{"value": "5"},
+		"notes":          "legacy",
+	}
+
+	raw, err := bson.Marshal(legacy)
+	CheckError(err)
+
+	for _, decode := range []func(interface{}) error{
+		func(watch interface{}) error { return bson.UnmarshalWithRegistry(BsonRegistry, raw, watch) },
+		func(watch interface{}) error { return bson.Unmarshal(raw, watch) },
+	} {
+		var watch Watch
+		CheckError(decode(&watch))
+
+		if watch.AddedPriceBuy.Currency != CURRENCY_GBP || !watch.AddedPriceBuy.Value.Equal(NewFromFloat(411.45)) {
+			t.Errorf("Expected legacy money 411.45 GBP actual %v", watch.AddedPriceBuy.GetDesc())
+		}
+		if !watch.AlertThreshold.Equal(NewFromInt(5)) {
+			t.Errorf("Expected legacy threshold 5 actual %v", watch.AlertThreshold)
+		}
+	}
+}
+
+func TestTransactionDocumentDecodesAnyId(t *testing.T) {
+	objectId := primitive.NewObjectID()
+	for _, test := range []struct {
+		id       interface{}
+		expected string
+	}{
+		{objectId, objectId.Hex()},
+		{"set-by-hand", "set-by-hand"},
+	} {
+		raw, err := bson.MarshalWithRegistry(BsonRegistry, bson.M{"_id": test.id, "stockid": "iag"})
+		CheckError(err)
+
+		var document transactionDocument
+		if err = bson.UnmarshalWithRegistry(BsonRegistry, raw, &document); err != nil {
+			t.Fatalf("Decode expected no error actual %v", err)
+		}
+		if actual := getDocumentIdString(document.Id); actual != test.expected || document.StockId != "iag" {
+			t.Errorf("Transaction id expected %v actual %v", test.expected, actual)
+		}
+	}
+}
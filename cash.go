@@ -0,0 +1,178 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+// statement and ledger balances within a penny are taken as reconciled
+var CashReconcileTolerance = NewFromFloat(0.01)
+
+// CashEntry is one movement of cash, Balance is the running balance after it
+type CashEntry struct {
+	TransactionId string
+	AccountId     int
+	Dt            time.Time
+	Type          string
+	Description   string
+	Amount        Money
+	Balance       Money
+}
+
+// CashLedger is the uninvested cash of an account derived from the ValueQuoted of every transaction, oldest first.
+// Buys and fees take cash out, sells, income and deposits put it in
+type CashLedger struct {
+	AccountId int
+	Entries   []CashEntry
+}
+
+type CashReconciliation struct {
+	AccountId        int
+	DtStatement      time.Time
+	StatementBalance Money
+	LedgerBalance    Money
+	Difference       Money
+}
+
+func (reconciliation CashReconciliation) IsReconciled() bool {
+	return reconciliation.Difference.Value.Abs().LessThanOrEqual(CashReconcileTolerance)
+}
+
+func (reconciliation CashReconciliation) String() string {
+	if reconciliation.IsReconciled() {
+		return fmt.Sprintf("%v cash reconciled at %v", GetAccountName(reconciliation.AccountId), reconciliation.LedgerBalance.GetDesc())
+	}
+	return fmt.Sprintf("%v cash statement %v ledger %v difference %v", GetAccountName(reconciliation.AccountId),
+		reconciliation.StatementBalance.GetDesc(), reconciliation.LedgerBalance.GetDesc(), reconciliation.Difference.GetDesc())
+}
+
+// getCashDt is when the cash moves, settlement if known
+func getCashDt(transaction Transaction) (time.Time, error) {
+	if len(transaction.DtSettlement) > 0 {
+		if dt, err := ParseDt(transaction.DtSettlement); err == nil {
+			return dt, nil
+		}
+	}
+	return ParseDt(transaction.DtTrade)
+}
+
+// BuildCashLedgers runs the balance of every account in GBP, keyed on AccountId
+func BuildCashLedgers(transactions []Transaction) (map[int]*CashLedger, error) {
+	var entries []CashEntry
+	for _, transaction := range transactions {
+		if transaction.Ignore || transaction.ValueQuoted.isUnset() {
+			continue
+		}
+
+		dt, err := getCashDt(transaction)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %v date %v: %w", transaction.TransactionId, transaction.DtTrade, err)
+		}
+
+		entries = append(entries, CashEntry{
+			TransactionId: transaction.TransactionId,
+			AccountId:     transaction.AccountId,
+			Dt:            dt,
+			Type:          transaction.GetTransactionType(),
+			Description:   transaction.Description,
+			Amount:        transaction.ValueQuoted,
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Dt.Before(entries[j].Dt)
+	})
+
+	ledgers := map[int]*CashLedger{}
+	balances := map[int]*MoneyBag{}
+	for _, entry := range entries {
+		ledger, ok := ledgers[entry.AccountId]
+		if !ok {
+			ledger = &CashLedger{AccountId: entry.AccountId}
+			ledgers[entry.AccountId] = ledger
+			bag := NewMoneyBag()
+			balances[entry.AccountId] = &bag
+		}
+
+		balance := balances[entry.AccountId]
+		balance.Add(entry.Amount)
+		total, err := balance.Total(CURRENCY_GBP)
+		if err != nil {
+			return nil, fmt.Errorf("account %v balance: %w", entry.AccountId, err)
+		}
+		entry.Balance = total
+		ledger.Entries = append(ledger.Entries, entry)
+	}
+	return ledgers, nil
+}
+
+// BuildCashLedgersWithActions also books the cash paid by corporate actions, which statements don't list as a trade
+func BuildCashLedgersWithActions(transactions []Transaction, actions []CorporateAction) (map[int]*CashLedger, error) {
+	holdings, err := ReplayHoldings(transactions, actions)
+	if err != nil {
+		return nil, err
+	}
+
+	booked := append(append([]Transaction{}, transactions...), GetHoldingPayments(holdings)...)
+	return BuildCashLedgers(booked)
+}
+
+func (ledger CashLedger) GetBalance() Money {
+	if len(ledger.Entries) == 0 {
+		return FromPounds("0")
+	}
+	return ledger.Entries[len(ledger.Entries)-1].Balance
+}
+
+// GetBalanceAt is the balance at the end of the day of dt
+func (ledger CashLedger) GetBalanceAt(dt time.Time) Money {
+	endOfDay := truncateToDay(dt).AddDate(0, 0, 1)
+
+	balance := FromPounds("0")
+	for _, entry := range ledger.Entries {
+		if !entry.Dt.Before(endOfDay) {
+			break
+		}
+		balance = entry.Balance
+	}
+	return balance
+}
+
+// Reconcile compares the ledger to a statement balance, the difference is statement less ledger
+func (ledger CashLedger) Reconcile(statementBalance Money, dtStatement time.Time) (CashReconciliation, error) {
+	ledgerBalance := ledger.GetBalanceAt(dtStatement)
+	statementPounds := statementBalance.toPounds()
+	difference, err := statementPounds.SubStrict(ledgerBalance)
+	if err != nil {
+		return CashReconciliation{}, err
+	}
+
+	reconciliation := CashReconciliation{
+		AccountId:        ledger.AccountId,
+		DtStatement:      dtStatement,
+		StatementBalance: statementPounds,
+		LedgerBalance:    ledgerBalance,
+		Difference:       difference,
+	}
+	if !reconciliation.IsReconciled() {
+		GetLogger().Warning("Cash does not reconcile", "accountId", ledger.AccountId, "statement", statementPounds.GetDesc(), "ledger", ledgerBalance.GetDesc())
+	}
+	return reconciliation, nil
+}
+
+// ToPosition is the cash as a pseudo holding for valuations, one unit per pound
+func (ledger CashLedger) ToPosition() PositionValue {
+	balance := ledger.GetBalance()
+	return PositionValue{
+		StockId: CashStockId,
+		Name:    "Cash",
+		Units:   balance.Value.Decimal,
+		Price:   FromPounds("1"),
+		Value:   balance,
+		Cost:    balance,
+		IsCash:  true,
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func getCashTestTransactions() []Transaction {
+	buy := getTradeTransaction("vusa", "2020-01-03 00:00:00", 10, "50", "-500")
+	buy.AccountId = AccountIdIsa
+
+	return []Transaction{
+		buy,
+		{DtTrade: "2020-01-02 00:00:00", Reference: "Card Web", ValueQuoted: FromPounds("1000"), AccountId: AccountIdIsa},
+		{DtTrade: "2020-02-01 00:00:00", Reference: "Manage Fee", ValueQuoted: FromPounds("-1.5"), AccountId: AccountIdIsa},
+		{DtTrade: "2020-02-05 00:00:00", Reference: "Interest", ValueQuoted: FromPounds("0.25"), AccountId: AccountIdIsa},
+		{DtTrade: "2020-01-10 00:00:00", Reference: "Card Web", ValueQuoted: FromPounds("200"), AccountId: AccountIdShare},
+		{DtTrade: "2020-01-11 00:00:00", Reference: "FPD", ValueQuoted: FromPounds("-50"), AccountId: AccountIdShare},
+		{DtTrade: "2020-01-12 00:00:00", ValueQuoted: FromPounds("-999"), AccountId: AccountIdShare, Ignore: true},
+	}
+}
+
+func TestBuildCashLedgers(t *testing.T) {
+	ledgers, err := BuildCashLedgers(getCashTestTransactions())
+	if err != nil {
+		t.Fatalf("Ledgers expected no error actual %v", err)
+	}
+
+	isa := ledgers[AccountIdIsa]
+	if balance := isa.GetBalance(); !balance.Value.Equal(NewFromFloat(498.75)) {
+		t.Errorf("ISA balance expected %v actual %v", 498.75, balance.GetDesc())
+	}
+	if balance := isa.GetBalanceAt(time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)); !balance.Value.Equal(NewFromInt(500)) {
+		t.Errorf("ISA balance on 3 Jan expected %v actual %v", 500, balance.GetDesc())
+	}
+	if isa.Entries[0].Type != TransactionTypeInputCard {
+		t.Errorf("First entry expected deposit actual %v", isa.Entries[0].Type)
+	}
+
+	share := ledgers[AccountIdShare]
+	if balance := share.GetBalance(); !balance.Value.Equal(NewFromInt(150)) {
+		t.Errorf("Share balance expected %v actual %v", 150, balance.GetDesc())
+	}
+}
+
+func TestReconcileCash(t *testing.T) {
+	ledgers, err := BuildCashLedgers(getCashTestTransactions())
+	CheckError(err)
+	isa := ledgers[AccountIdIsa]
+	dt := time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)
+
+	reconciliation, err := isa.Reconcile(FromPounds("498.75"), dt)
+	if err != nil || !reconciliation.IsReconciled() {
+		t.Errorf("Reconciliation expected reconciled actual %v %v", reconciliation, err)
+	}
+
+	reconciliation, err = isa.Reconcile(FromPounds("500"), dt)
+	CheckError(err)
+	if reconciliation.IsReconciled() || !reconciliation.Difference.Value.Equal(NewFromFloat(1.25)) {
+		t.Errorf("Reconciliation expected difference 1.25 actual %v", reconciliation)
+	}
+}
+
+func TestValuePortfolioWithCash(t *testing.T) {
+	transactions := getCashTestTransactions()
+	holdings, err := ReplayHoldings(transactions, nil)
+	CheckError(err)
+	ledgers, err := BuildCashLedgers(transactions)
+	CheckError(err)
+
+	stocks := map[string]*Stock{
+		"vusa": {Description: "Vanguard S&P 500", PriceSell: FromPounds("60")},
+	}
+	valuation, err := ValuePortfolio(time.Now(), []Holding{*holdings["vusa"]}, stocks, ledgers)
+	CheckError(err)
+
+	if !valuation.Value.Value.Equal(NewFromFloat(1248.75)) {
+		t.Errorf("Portfolio value expected %v actual %v", 1248.75, valuation.Value.GetDesc())
+	}
+
+	isa, ok := valuation.GetAccount(AccountIdIsa)
+	cash, errCash := isa.GetCash()
+	invested, err := isa.GetInvested()
+	if !ok || err != nil || errCash != nil || !cash.Value.Equal(NewFromFloat(498.75)) || !invested.Value.Equal(NewFromInt(600)) {
+		t.Errorf("ISA expected cash 498.75 invested 600 actual %v", isa)
+	}
+
+	positions, err := valuation.GetPositions()
+	if err != nil || len(positions) != 2 || positions[1].StockId != CashStockId || !positions[1].Value.Value.Equal(NewFromFloat(648.75)) {
+		t.Errorf("Positions expected vusa and combined cash actual %v", positions)
+	}
+}
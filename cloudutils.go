@@ -7,9 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"golang.org/x/net/context"
-	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
-	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
 )
@@ -31,7 +29,11 @@ func FixTemplateSourceDir() {
 }
 
 func PostJson(alerts []Alert) {
-	url := os.Getenv(EnvUrlEmailQueue)
+	PostJsonConfig(GetConfig(), alerts)
+}
+
+func PostJsonConfig(cfg *Config, alerts []Alert) {
+	url := cfg.EmailQueueUrl
 
 	buf := new(bytes.Buffer)
 	_ = json.NewEncoder(buf).Encode(alerts)
@@ -43,53 +45,26 @@ func PostJson(alerts []Alert) {
 
 	defer res.Body.Close()
 
-	fmt.Println("response Status:", res.Status)
-	// Print the body to the stdout
-	_, _ = io.Copy(os.Stdout, res.Body)
+	body, _ := ioutil.ReadAll(res.Body)
+	GetLogger().Info("Posted alerts", "url", url, "status", res.Status, "alerts", len(alerts))
+	GetLogger().Debug("Post alerts response", "url", url, "body", string(body))
 }
 
 func GetSecretsClient() *secretmanager.Client {
 	// Create the client.
 	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		log.Fatalf("failed to setup client: %v", err)
-	}
+	CheckError(err)
 
 	return client
 }
 
 func GetSecret(envSecretName string) string {
-	Log("Getting secret " + envSecretName)
-	if len(envSecretName) == 0 { return "" }
-
-	if os.Getenv("LOCAL") == "1" {
-		return getSecretLocal(envSecretName)
-	} else {
-		return getSecret(envSecretName)
-	}
-}
-
-func getSecretLocal(envSecretName string) string {
-	return os.Getenv(envSecretName)
-}
-
-func getSecret(envSecretName string) string {
-	secretName := os.Getenv(envSecretName)
-	if len(secretName) == 0 { return ""}
-
-	client := GetSecretsClient()
+	GetLogger().Debug("Getting secret", "name", envSecretName)
 
-	accessRequest := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: "projects/investor-tracker/secrets/" + secretName + "/versions/latest",
-	}
-
-	ctx := context.Background()
-	result, err := client.AccessSecretVersion(ctx, accessRequest)
-	if err != nil {
-		log.Fatalf("failed to access secret version: %v", err)
-	}
-	return string(result.Payload.Data)
+	secret, err := LookupSecret(envSecretName)
+	CheckError(err)
+	return secret
 }
 
 func PubSubPublish(projectID, topicID, msg string) error {
@@ -109,22 +84,33 @@ func PubSubPublish(projectID, topicID, msg string) error {
 	if err != nil {
 		return fmt.Errorf("Get: %v", err)
 	}
-	Log(fmt.Sprintf("Published a message; msg ID: %v", id))
+	GetLogger().Info("Published a message", "projectId", projectID, "topicId", topicID, "messageId", id)
 	return nil
 }
 
 func SendEmail(email MessageSendEmail) {
+	SendEmailConfig(GetConfig(), email)
+}
+
+func SendEmailConfig(cfg *Config, email MessageSendEmail) {
+	CheckError(sendEmail(cfg, email))
+}
+
+func sendEmail(cfg *Config, email MessageSendEmail) error {
 	jsonBytes, err := json.Marshal(email)
-	CheckError(err)
+	if err != nil {
+		return err
+	}
 	jsonStr := string(jsonBytes)
 
-	Log(fmt.Sprintf("JSON to publish: %v", jsonStr))
-	if os.Getenv("LOCAL") == "1" {
+	GetLogger().Debug("Email to publish", "subject", email.Subject, "json", jsonStr)
+	if cfg.Local {
+		if err = cfg.ValidateEmail(); err != nil {
+			return err
+		}
 		WriteStringToFile("output/email.json", jsonStr)
-		url := os.Getenv(EnvUrlEmailQueue)
-		PostJsonToUrl(url, email)
+		return postJson(http.DefaultClient, cfg.EmailQueueUrl, jsonBytes, nil)
 	} else {
-		err := PubSubPublish("investor-tracker", "alerts-ready", jsonStr)
-		CheckError(err)
+		return PubSubPublish(cfg.ProjectId, "alerts-ready", jsonStr)
 	}
 }
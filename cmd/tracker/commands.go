@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"text/tabwriter"
+	"time"
+
+	common "github.com/asharma3007/investor-tracker-common"
+	. "github.com/shopspring/decimal"
+)
+
+func newTable(app *app) *tabwriter.Writer {
+	return tabwriter.NewWriter(app.out, 0, 4, 2, ' ', 0)
+}
+
+func formatMoney(m common.Money) string {
+	return common.GetFormatter().FormatMoney(m)
+}
+
+func runStocks(app *app, args []string) error {
+	if err := newFlagSet("stocks").Parse(args); err != nil {
+		return err
+	}
+
+	stocks, err := app.getSortedStocks()
+	if err != nil {
+		return err
+	}
+
+	table := newTable(app)
+	fmt.Fprintln(table, "ID\tNAME\tSYMBOL\tSOURCE\tASSET CLASS")
+	for _, stock := range stocks {
+		source := "MarketStack"
+		if stock.IsSourceHl() {
+			source = "HL"
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\n", stock.StockId, stock.GetDisplayName(), stock.Symbol, source, stock.AssetClass)
+	}
+	return table.Flush()
+}
+
+// getStock is the stock with its price URL set, as GetStocksReference does
+func (app *app) getStock(stockId string) (*common.Stock, error) {
+	stock, err := app.repository.GetStock(app.ctx, stockId)
+	if err != nil {
+		return nil, err
+	}
+	stock.Url = stock.GetPriceUrlConfig(app.cfg)
+	return stock, nil
+}
+
+func runQuote(app *app, args []string) error {
+	stockId, err := getOneArg(newFlagSet("quote"), args, "a stock id")
+	if err != nil {
+		return err
+	}
+
+	if err = app.cfg.ValidatePrices(); err != nil {
+		return err
+	}
+	stock, err := app.getStock(stockId)
+	if err != nil {
+		return err
+	}
+
+	stock.PopulateQuoteCurrency(&common.DefaultHttp{})
+	stock.PopulateCurrentPrice()
+	fmt.Fprintf(app.out, "%v buy %v sell %v\n", stock.GetDisplayName(), formatMoney(stock.PriceBuy), formatMoney(stock.PriceSell))
+	return nil
+}
+
+// getWatchDetail is the stock's prices from its source, or the stored history adjusted for its splits when offline
+func (app *app) getWatchDetail(stock *common.Stock, offline bool) (common.WatchDetail, error) {
+	if !offline {
+		stock.PopulateQuoteCurrency(&common.DefaultHttp{})
+		wd := common.BuildWatchDetail(&common.DefaultHttp{}, *stock)
+		wd.Stock = stock
+		return wd, nil
+	}
+
+	history, err := app.repository.GetPriceHistory(app.ctx, stock.StockId)
+	if err != nil {
+		return common.WatchDetail{}, err
+	}
+	actions, err := app.getCorporateActions()
+	if err != nil {
+		return common.WatchDetail{}, err
+	}
+	for ix := range history.Eods {
+		if history.Eods[ix].PriceClosePounds.Value.IsZero() {
+			history.Eods[ix].PopulateUsablePrice(stock)
+		}
+	}
+	history.ApplyCorporateActions(stock.StockId, actions)
+	return common.WatchDetail{Stock: stock, History: history}, nil
+}
+
+func runWatch(app *app, args []string) error {
+	flags := newFlagSet("watch")
+	offline := flags.Bool("offline", false, "use the stored price history instead of fetching prices")
+	watchId, err := getOneArg(flags, args, "a watch id")
+	if err != nil {
+		return err
+	}
+
+	watch, err := app.repository.GetWatch(app.ctx, watchId)
+	if err != nil {
+		return err
+	}
+	stock, err := app.getStock(watch.StockId)
+	if err != nil {
+		return err
+	}
+	wd, err := app.getWatchDetail(stock, *offline)
+	if err != nil {
+		return err
+	}
+	wd.Watch = watch
+
+	table := newTable(app)
+	fmt.Fprintf(table, "Stock\t%v (%v)\n", stock.GetDisplayName(), stock.StockId)
+	fmt.Fprintf(table, "Last close\t%v\n", wd.GetPriceLastClosePoundsDesc())
+	fmt.Fprintf(table, "Previous close\t%v\n", wd.GetPricePreviousCloseDesc())
+	fmt.Fprintf(table, "Change\t%v\n", wd.GetChangePercentDesc())
+	if !watch.AddedPriceBuy.Value.IsZero() {
+		fmt.Fprintf(table, "Reference\t%v on %v\n", watch.GetPriceBuyDesc(), wd.GetDtReferenceDesc())
+		fmt.Fprintf(table, "Since reference\t%v\n", wd.GetDeltaReferencePercentDesc())
+	}
+	fmt.Fprintf(table, "Threshold\t%v\n", watch.GetAlertThresholdDesc())
+	if len(watch.Expression) > 0 {
+		fmt.Fprintf(table, "Expression\t%v\n", watch.Expression)
+	}
+	if len(watch.Notes) > 0 {
+		fmt.Fprintf(table, "Notes\t%v\n", watch.Notes)
+	}
+	if err = table.Flush(); err != nil {
+		return err
+	}
+
+	alerts := wd.Evaluate()
+	if len(alerts) == 0 {
+		fmt.Fprintln(app.out, "No alert")
+	}
+	for _, alert := range alerts {
+		fmt.Fprintf(app.out, "ALERT %v\n", alert.Message)
+	}
+	return nil
+}
+
+// isSameTransaction matches an imported transaction to one already held when the id isn't set
+func isSameTransaction(a common.Transaction, b common.Transaction) bool {
+	if len(a.TransactionId) > 0 && a.TransactionId == b.TransactionId {
+		return true
+	}
+	return a.AccountId == b.AccountId && a.StockId == b.StockId && a.DtTrade == b.DtTrade &&
+		a.Units.Equal(b.Units.Decimal) && a.ValueQuoted.Value.Equal(b.ValueQuoted.Value.Decimal) && a.Reference == b.Reference
+}
+
+func runImport(app *app, args []string) error {
+	flags := newFlagSet("import")
+	dryRun := flags.Bool("dry-run", false, "check and report without saving")
+	filename, err := getOneArg(flags, args, "a transactions file")
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var imported []common.Transaction
+	if err = json.Unmarshal(data, &imported); err != nil {
+		return fmt.Errorf("%v: %w", filename, err)
+	}
+
+	existing, err := app.repository.GetTransactions(app.ctx)
+	if err != nil {
+		return err
+	}
+	stocks, err := app.repository.GetStocks(app.ctx)
+	if err != nil {
+		return err
+	}
+
+	var added, skipped int
+	for ix := range imported {
+		transaction := &imported[ix]
+		if _, err = common.ParseDt(transaction.DtTrade); err != nil {
+			return fmt.Errorf("transaction %v: DtTrade %w", ix+1, err)
+		}
+		if _, ok := stocks[transaction.StockId]; len(transaction.StockId) > 0 && !ok {
+			return fmt.Errorf("transaction %v: unknown stock %v", ix+1, transaction.StockId)
+		}
+
+		isDuplicate := false
+		for _, held := range existing {
+			if isSameTransaction(*transaction, held) {
+				isDuplicate = true
+				break
+			}
+		}
+		if isDuplicate {
+			skipped++
+			continue
+		}
+
+		added++
+		existing = append(existing, *transaction)
+		if *dryRun {
+			continue
+		}
+		if err = app.repository.SaveTransaction(app.ctx, transaction); err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		fmt.Fprintf(app.out, "Dry run, would import %v skipping %v already held\n", added, skipped)
+		return nil
+	}
+	if app.save != nil && added > 0 {
+		if err = app.save(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(app.out, "Imported %v skipping %v already held\n", added, skipped)
+	return nil
+}
+
+// getPrice is the stock's sell price now, or its last stored close when offline
+func (app *app) getPrice(stock *common.Stock, offline bool) (common.Money, error) {
+	if !offline {
+		stock.PopulateQuoteCurrency(&common.DefaultHttp{})
+		stock.PopulateCurrentPrice()
+		return stock.PriceSell, nil
+	}
+
+	wd, err := app.getWatchDetail(stock, true)
+	if err != nil {
+		return common.Money{}, err
+	}
+	if len(wd.History.Eods) == 0 {
+		return common.Money{}, fmt.Errorf("no stored price for %v", stock.StockId)
+	}
+	return wd.History.Eods[0].PriceClosePounds, nil
+}
+
+func runHoldings(app *app, args []string) error {
+	flags := newFlagSet("holdings")
+	offline := flags.Bool("offline", false, "value at the stored last close instead of fetching prices")
+	accountId := flags.Int("account", 0, "only this account, 1 ISA 2 share account")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	transactions, err := app.repository.GetTransactions(app.ctx)
+	if err != nil {
+		return err
+	}
+	actions, err := app.getCorporateActions()
+	if err != nil {
+		return err
+	}
+
+	var filtered []common.Transaction
+	for _, transaction := range transactions {
+		if *accountId == 0 || transaction.AccountId == *accountId {
+			filtered = append(filtered, transaction)
+		}
+	}
+	holdings, err := common.ReplayHoldings(filtered, actions)
+	if err != nil {
+		return err
+	}
+
+	stocks, err := app.getSortedStocks()
+	if err != nil {
+		return err
+	}
+
+	table := newTable(app)
+	fmt.Fprintln(table, "STOCK\tUNITS\tAVG COST\tCOST\tPRICE\tVALUE\tP&L\tP&L %")
+	totalCost, totalValue := pounds(NewFromInt(0)), pounds(NewFromInt(0))
+	for _, stock := range stocks {
+		holding, ok := holdings[stock.StockId]
+		if !ok || !holding.GetUnitsTotal().IsPositive() {
+			continue
+		}
+
+		stock.Url = stock.GetPriceUrlConfig(app.cfg)
+		price, err := app.getPrice(stock, *offline)
+		if err != nil {
+			return err
+		}
+
+		units := holding.GetUnitsTotal()
+		cost := pounds(holding.GetValueTotalBought())
+		value := price.Mul(units)
+		gain, err := value.SubStrict(cost)
+		if err != nil {
+			return fmt.Errorf("%v: %w", stock.StockId, err)
+		}
+		if totalCost, err = totalCost.AddStrict(cost); err != nil {
+			return err
+		}
+		if totalValue, err = totalValue.AddStrict(value); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", stock.GetDisplayName(), common.GetFormatter().FormatUnits(units),
+			formatMoney(pounds(holding.GetPriceAverageBought())), formatMoney(cost),
+			formatMoney(price), formatMoney(value), formatMoney(gain), formatGainPercent(gain, cost))
+	}
+
+	totalGain, err := totalValue.SubStrict(totalCost)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(table, "TOTAL\t\t\t%v\t\t%v\t%v\t%v\n", formatMoney(totalCost), formatMoney(totalValue), formatMoney(totalGain),
+		formatGainPercent(totalGain, totalCost))
+	return table.Flush()
+}
+
+func pounds(value Decimal) common.Money {
+	return common.Money{Currency: common.CURRENCY_GBP, Value: common.DecimalExt{Decimal: value}}
+}
+
+func formatGainPercent(gain common.Money, cost common.Money) string {
+	ratio, err := gain.DivStrict(cost)
+	if err != nil {
+		return ""
+	}
+	return common.GetPercentDesc(ratio.Mul(NewFromInt(100)))
+}
+
+func runEvaluate(app *app, args []string) error {
+	flags := newFlagSet("evaluate")
+	offline := flags.Bool("offline", false, "use the stored price histories instead of fetching prices")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	watches, err := app.repository.GetWatches(app.ctx)
+	if err != nil {
+		return err
+	}
+
+	details := map[string]common.WatchDetail{}
+	var alerts []common.Alert
+	var evaluated []common.WatchDetail
+	now := time.Now()
+
+	for _, watch := range watches {
+		if dtStop, err := common.ParseDt(watch.DtStop); err == nil && dtStop.Before(now) {
+			continue
+		}
+
+		wd, ok := details[watch.StockId]
+		if !ok {
+			stock, err := app.getStock(watch.StockId)
+			if errors.Is(err, common.ErrNotFound) {
+				fmt.Fprintf(app.out, "Skipping watch %v, no stock %v\n", watch.WatchId, watch.StockId)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if wd, err = app.getWatchDetail(stock, *offline); err != nil {
+				return err
+			}
+			details[watch.StockId] = wd
+		}
+
+		wd.Watch = watch
+		evaluated = append(evaluated, wd)
+		alerts = append(alerts, wd.Evaluate()...)
+	}
+
+	fmt.Fprintf(app.out, "Dry run, %v watches evaluated, %v alerts, nothing sent\n", len(evaluated), len(alerts))
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	email, err := common.RenderAlertEmail(fmt.Sprintf("%v alerts", len(alerts)), alerts, evaluated)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(app.out)
+	fmt.Fprint(app.out, email.PlainText)
+	return nil
+}
+
+func runTestEmail(app *app, args []string) error {
+	if err := newFlagSet("test-email").Parse(args); err != nil {
+		return err
+	}
+	if err := app.cfg.ValidateEmail(); err != nil {
+		return err
+	}
+
+	alert := common.Alert{
+		Message:  "Test alert sent by the tracker command line",
+		Severity: common.AlertSeverityInfo,
+	}
+	email, err := common.RenderAlertEmail("Tracker test email", []common.Alert{alert}, nil)
+	if err != nil {
+		return err
+	}
+
+	common.SendEmailConfig(app.cfg, email)
+	fmt.Fprintf(app.out, "Sent test email to %v\n", app.cfg.EmailQueueUrl)
+	return nil
+}
+
+func runServe(app *app, args []string) error {
+	flags := newFlagSet("serve")
+	address := flags.String("address", defaultServeAddress, "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("serve takes no arguments")
+	}
+
+	fmt.Fprintf(app.out, "Serving the API on %v\n", *address)
+	return common.ServeApi(*address, app.repository, app.cfg)
+}
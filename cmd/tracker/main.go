@@ -0,0 +1,215 @@
+// Command tracker runs the day to day tracker operations from a laptop.
+// It always loads the config as LOCAL, so secrets come from the environment (or SECRET_SOURCE=file) rather than
+// Secret Manager, and reads and writes either Mongo or a memory snapshot file.
+//
+//	tracker [-config file] [-store mongo|snapshot.json] <command> [flags] [args]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	common "github.com/asharma3007/investor-tracker-common"
+)
+
+const (
+	storeMongo          = "mongo"
+	defaultServeAddress = "localhost:8080"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(app *app, args []string) error
+}
+
+// commands is set in init as newFlagSet looks the command up for its usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"stocks", "", "list the stocks", runStocks},
+		{"quote", "<stockId>", "fetch the current buy and sell price", runQuote},
+		{"watch", "[-offline] <watchId>", "show the watch detail and whether it alerts", runWatch},
+		{"import", "[-dry-run] <transactions.json>", "import a JSON array of transactions, skipping ones already held", runImport},
+		{"holdings", "[-offline] [-account id]", "print holdings with profit and loss", runHoldings},
+		{"evaluate", "[-offline]", "evaluate every running watch and print the alerts without sending them", runEvaluate},
+		{"test-email", "", "send a test alert email", runTestEmail},
+		{"serve", "[-address host:port]", "serve the REST API over the store until stopped", runServe},
+	}
+}
+
+// app is what every command runs against
+type app struct {
+	ctx        context.Context
+	cfg        *common.Config
+	repository common.Repository
+	out        io.Writer
+
+	// save persists a memory store after a change, nil for Mongo
+	save func() error
+
+	corporateActions []common.CorporateAction // loaded once by getCorporateActions
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "tracker:", err)
+		os.Exit(1)
+	}
+}
+
+func run(arguments []string, out io.Writer) error {
+	flags := flag.NewFlagSet("tracker", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file, overrides "+common.EnvConfigFile)
+	store := flags.String("store", storeMongo, "mongo or a memory snapshot JSON file")
+	flags.Usage = func() {
+		printUsage(flags.Output(), flags)
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no command")
+	}
+
+	cmd, ok := findCommand(flags.Arg(0))
+	if !ok {
+		flags.Usage()
+		return fmt.Errorf("unknown command %v", flags.Arg(0))
+	}
+
+	app, closeStore, err := newApp(*configFile, *store, out)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	return runCommand(app, cmd, flags.Args()[1:])
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(out io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(out, "usage: tracker [-config file] [-store mongo|snapshot.json] <command> [flags] [args]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-12v %-34v %v\n", cmd.name, cmd.args, cmd.usage)
+	}
+	fmt.Fprintln(out)
+	flags.PrintDefaults()
+}
+
+// runCommand turns the package's panics, e.g. from CheckError on a failed price fetch, into an error
+func runCommand(app *app, cmd command, args []string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v: %v", cmd.name, recovered)
+		}
+	}()
+	return cmd.run(app, args)
+}
+
+// newApp loads the config as LOCAL and opens the store
+func newApp(configFile string, store string, out io.Writer) (*app, func(), error) {
+	if _, isSet := os.LookupEnv(common.EnvLocal); !isSet {
+		os.Setenv(common.EnvLocal, "true")
+	}
+	if len(configFile) > 0 {
+		os.Setenv(common.EnvConfigFile, configFile)
+	}
+
+	cfg, err := common.LoadConfig(os.Getenv(common.EnvConfigFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	common.SetConfig(&cfg)
+
+	app := &app{ctx: context.Background(), cfg: &cfg, out: out}
+	if store != storeMongo {
+		repository, err := common.LoadMemoryRepository(store)
+		if err != nil {
+			return nil, nil, err
+		}
+		app.repository = repository
+		app.save = func() error {
+			return repository.SaveSnapshot(store)
+		}
+		return app, func() {}, nil
+	}
+
+	if err = cfg.ValidateMongo(); err != nil {
+		return nil, nil, err
+	}
+	client, db := common.ConnectDbMongoConfig(&cfg)
+	app.repository = common.NewMongoRepository(db)
+	return app, func() { common.DisconnectMongoDb(client) }, nil
+}
+
+// newFlagSet is a command's flags, the usage names the command
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	cmd, _ := findCommand(name)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: tracker %v %v\n", name, cmd.args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// getOneArg parses the flags and returns the single argument after them
+func getOneArg(flags *flag.FlagSet, args []string, name string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", fmt.Errorf("%v expects %v", flags.Name(), name)
+	}
+	return flags.Arg(0), nil
+}
+
+func (app *app) getCorporateActions() ([]common.CorporateAction, error) {
+	if app.corporateActions != nil {
+		return app.corporateActions, nil
+	}
+
+	actions, err := app.repository.GetCorporateActions(app.ctx)
+	if err != nil {
+		return nil, err
+	}
+	app.corporateActions = append([]common.CorporateAction{}, actions...)
+	return app.corporateActions, nil
+}
+
+func (app *app) getSortedStocks() ([]*common.Stock, error) {
+	stocks, err := app.repository.GetStocks(app.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var sorted []*common.Stock
+	for _, stock := range stocks {
+		sorted = append(sorted, stock)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].GetDisplayName()) < strings.ToLower(sorted[j].GetDisplayName())
+	})
+	return sorted, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/asharma3007/investor-tracker-common"
+)
+
+// restoreGlobals puts back what run changes for the whole process, the environment it loads the config from and
+// the package config
+func restoreGlobals() func() {
+	saved := map[string]*string{}
+	for _, name := range []string{common.EnvLocal, common.EnvConfigFile} {
+		if value, isSet := os.LookupEnv(name); isSet {
+			saved[name] = &value
+		} else {
+			saved[name] = nil
+		}
+	}
+
+	return func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+		common.SetConfig(nil)
+	}
+}
+
+// getTempDir is a directory removed by the returned func
+func getTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// copySnapshot copies the example snapshot into dir so imports don't change the fixture
+func copySnapshot(t *testing.T, dir string) string {
+	data, err := ioutil.ReadFile("../../examples/apisnapshot.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(dir, "snapshot.json")
+	if err = ioutil.WriteFile(snapshot, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// runTracker runs the command line against the snapshot and restores the globals it changes
+func runTracker(snapshot string, args ...string) (string, error) {
+	defer restoreGlobals()()
+
+	var out bytes.Buffer
+	err := run(append([]string{"-store", snapshot}, args...), &out)
+	return out.String(), err
+}
+
+// runOffline runs the command against a copy of the example snapshot
+func runOffline(t *testing.T, args ...string) string {
+	dir, remove := getTempDir(t)
+	defer remove()
+
+	out, err := runTracker(copySnapshot(t, dir), args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return out
+}
+
+func TestStocks(t *testing.T) {
+	out := runOffline(t, "stocks")
+	if !strings.Contains(out, "iag") || !strings.Contains(out, "vusa") {
+		t.Errorf("stocks expected iag and vusa actual %v", out)
+	}
+}
+
+func TestWatchOffline(t *testing.T) {
+	out := runOffline(t, "watch", "-offline", "w1")
+	if !strings.Contains(out, "ALERT") {
+		t.Errorf("watch expected an alert actual %v", out)
+	}
+}
+
+func TestHoldingsOffline(t *testing.T) {
+	out := runOffline(t, "holdings", "-offline")
+	if !strings.Contains(out, "TOTAL") || !strings.Contains(out, "£15.00") {
+		t.Errorf("holdings expected a total P&L of £15.00 actual %v", out)
+	}
+}
+
+func TestEvaluateOfflineDryRun(t *testing.T) {
+	out := runOffline(t, "evaluate", "-offline")
+	if !strings.HasPrefix(out, "Dry run, 2 watches evaluated, 2 alerts, nothing sent") {
+		t.Errorf("evaluate expected 2 alerts actual %v", out)
+	}
+}
+
+func TestImportSavesSnapshotAndSkipsDuplicates(t *testing.T) {
+	dir, remove := getTempDir(t)
+	defer remove()
+	snapshot := copySnapshot(t, dir)
+
+	// the first is t2 again without its id, the second is new
+	transactions := writeTestFile(t, dir, "transactions.json", `[
+		{"StockId": "iag", "DtTrade": "2021-01-04 10:00:00", "UnitPrice": {"Currency": "GBP", "Value": "1.40"}, "Units": "100", "ValueQuoted": {"Currency": "GBP", "Value": "-140"}, "AccountId": 1},
+		{"StockId": "iag", "DtTrade": "2021-01-05 10:00:00", "UnitPrice": {"Currency": "GBP", "Value": "1.50"}, "Units": "10", "ValueQuoted": {"Currency": "GBP", "Value": "-15"}, "AccountId": 1}
+	]`)
+
+	out, err := runTracker(snapshot, "import", "-dry-run", transactions)
+	if err != nil || !strings.HasPrefix(out, "Dry run, would import 1 skipping 1 already held") {
+		t.Errorf("dry run expected 1 skipping 1 actual %v %v", out, err)
+	}
+	if repository, _ := common.LoadMemoryRepository(snapshot); len(getTransactions(t, repository)) != 3 {
+		t.Errorf("dry run expected the snapshot unchanged")
+	}
+
+	out, err = runTracker(snapshot, "import", transactions)
+	if err != nil || !strings.HasPrefix(out, "Imported 1 skipping 1 already held") {
+		t.Errorf("import expected 1 skipping 1 actual %v %v", out, err)
+	}
+
+	repository, err := common.LoadMemoryRepository(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := getTransactions(t, repository)
+	if len(saved) != 4 {
+		t.Fatalf("reloaded snapshot expected 4 transactions actual %v", len(saved))
+	}
+	imported := 0
+	for _, transaction := range saved {
+		if transaction.DtTrade == "2021-01-05 10:00:00" && len(transaction.TransactionId) > 0 {
+			imported++
+		}
+	}
+	if imported != 1 {
+		t.Errorf("reloaded snapshot expected the import saved with an id once actual %v", imported)
+	}
+
+	out, err = runTracker(snapshot, "import", transactions)
+	if err != nil || !strings.HasPrefix(out, "Imported 0 skipping 2 already held") {
+		t.Errorf("import again expected 0 skipping 2 actual %v %v", out, err)
+	}
+}
+
+func TestImportRejectsUnknownStock(t *testing.T) {
+	dir, remove := getTempDir(t)
+	defer remove()
+	transactions := writeTestFile(t, dir, "transactions.json", `[{"StockId": "tsla", "DtTrade": "2021-01-05 10:00:00", "AccountId": 1}]`)
+
+	if _, err := runTracker(copySnapshot(t, dir), "import", transactions); err == nil || !strings.Contains(err.Error(), "unknown stock tsla") {
+		t.Errorf("import expected unknown stock actual %v", err)
+	}
+}
+
+func getTransactions(t *testing.T, repository common.Repository) []common.Transaction {
+	transactions, err := repository.GetTransactions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transactions
+}
+
+// exampleTransport answers MarketStack requests from the example responses
+type exampleTransport map[string]string
+
+func (transport exampleTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	filename, ok := transport[request.URL.Path]
+	if !ok {
+		recorder.WriteHeader(http.StatusNotFound)
+		return recorder.Result(), nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	recorder.Write(data)
+	return recorder.Result(), nil
+}
+
+func TestQuote(t *testing.T) {
+	dir, remove := getTempDir(t)
+	defer remove()
+	cfg := writeTestFile(t, dir, "config.yaml", "tokenMarketStack: test-token\nrateApiKey: test-key\n")
+
+	saved := http.DefaultTransport
+	defer func() { http.DefaultTransport = saved }()
+	http.DefaultTransport = exampleTransport{"/v1/eod": "../../examples/iag.json"}
+
+	out, err := runTracker(copySnapshot(t, dir), "-config", cfg, "quote", "iag")
+	if err != nil {
+		t.Fatalf("quote expected no error actual %v", err)
+	}
+	if !strings.Contains(out, "buy £0.96") || !strings.Contains(out, "sell £0.96") {
+		t.Errorf("quote expected the last close of 96.44p in pounds actual %v", out)
+	}
+}
+
+func TestQuoteNeedsPriceSecrets(t *testing.T) {
+	dir, remove := getTempDir(t)
+	defer remove()
+	cfg := writeTestFile(t, dir, "config.yaml", "debug: false\n")
+
+	if _, err := runTracker(copySnapshot(t, dir), "-config", cfg, "quote", "iag"); err == nil {
+		t.Errorf("quote without a MarketStack token expected an error")
+	}
+}
+
+func TestTestEmail(t *testing.T) {
+	var posted []common.MessageSendEmail
+	queue := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var email common.MessageSendEmail
+		if err := json.NewDecoder(request.Body).Decode(&email); err != nil {
+			t.Errorf("email queue expected JSON actual %v", err)
+		}
+		posted = append(posted, email)
+	}))
+	defer queue.Close()
+
+	dir, remove := getTempDir(t)
+	defer remove()
+	cfg := writeTestFile(t, dir, "config.yaml", "emailQueueUrl: "+queue.URL+"\n")
+
+	out, err := runTracker(copySnapshot(t, dir), "-config", cfg, "test-email")
+	if err != nil {
+		t.Fatalf("test-email expected no error actual %v", err)
+	}
+	if !strings.HasPrefix(out, "Sent test email to "+queue.URL) {
+		t.Errorf("test-email expected the queue named actual %v", out)
+	}
+	if len(posted) != 1 || posted[0].Subject != "Tracker test email" {
+		t.Errorf("email queue expected the test email actual %v", posted)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	defer restoreGlobals()()
+
+	var out bytes.Buffer
+	if err := run([]string{"bogus"}, &out); err == nil {
+		t.Errorf("unknown command expected an error")
+	}
+}
+
+func TestServeRejectsArguments(t *testing.T) {
+	if _, err := runTracker("../../examples/apisnapshot.json", "serve", "extra"); err == nil {
+		t.Errorf("serve with an argument expected an error")
+	}
+}
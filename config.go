@@ -0,0 +1,357 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	EnvConfigFile        = "CONFIG_FILE"
+	EnvLocal             = "LOCAL"
+	EnvDebug             = "DEBUG"
+	EnvDebugStock        = "DEBUG_STOCK"
+	EnvDatabaseSocketDir = "DB_SOCKET_DIR"
+	EnvRiskFreeRate      = "RISK_FREE_RATE"
+	EnvBenchmarkSymbol   = "BENCHMARK_SYMBOL"
+
+	EnvDatabaseUserMySql     = "DB_USER_MYSQL"
+	EnvDatabasePasswordMySql = "DB_PASSWORD_MYSQL"
+	EnvDatabaseUrlMySql      = "DB_URL_MYSQL"
+	EnvDatabasePortMySql     = "DB_PORT_MYSQL"
+	EnvDatabaseNameMySql     = "DB_NAME_MYSQL"
+
+	DefaultSocketDir       = "cloudsql"
+	DefaultBenchmarkSymbol = "VUSA.XLON"
+)
+
+type Config struct {
+	Local         bool           `json:"local" yaml:"local"`
+	Debug         bool           `json:"debug" yaml:"debug"`
+	DebugStock    string         `json:"debugStock" yaml:"debugStock"`
+	EmailQueueUrl string         `json:"emailQueueUrl" yaml:"emailQueueUrl"`
+	ProjectId     string         `json:"projectId" yaml:"projectId"`
+	SecretSource  string         `json:"secretSource" yaml:"secretSource"`
+	SecretsDir    string         `json:"secretsDir" yaml:"secretsDir"`
+	Database      DatabaseConfig `json:"database" yaml:"database"`
+	MySql         MySqlConfig    `json:"mysql" yaml:"mysql"`
+
+	RiskFreeRate    float64 `json:"riskFreeRate" yaml:"riskFreeRate"` // annual, 0.01 for 1%
+	BenchmarkSymbol string  `json:"benchmarkSymbol" yaml:"benchmarkSymbol"`
+
+	TokenMarketStack string `json:"tokenMarketStack" yaml:"tokenMarketStack"`
+	TokenIex         string `json:"tokenIex" yaml:"tokenIex"`
+	RateApiKey       string `json:"rateApiKey" yaml:"rateApiKey"`
+	MyApiKey         string `json:"myApiKey" yaml:"myApiKey"`
+
+	ApiKeys []ApiKey `json:"apiKeys" yaml:"apiKeys"` // hashed, in addition to MyApiKey
+}
+
+type DatabaseConfig struct {
+	Url            string `json:"url" yaml:"url"`
+	Port           string `json:"port" yaml:"port"`
+	Name           string `json:"name" yaml:"name"`
+	User           string `json:"user" yaml:"user"`
+	Password       string `json:"password" yaml:"password"`
+	ConnectionName string `json:"connectionName" yaml:"connectionName"`
+	PrivateIp      bool   `json:"privateIp" yaml:"privateIp"`
+	SocketDir      string `json:"socketDir" yaml:"socketDir"`
+}
+
+// MySqlConfig is the direct TCP connection used instead of the cloud sql socket when DatabaseConfig.PrivateIp is set
+type MySqlConfig struct {
+	Url      string `json:"url" yaml:"url"`
+	Port     string `json:"port" yaml:"port"`
+	Name     string `json:"name" yaml:"name"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// ConfigError lists every missing value rather than stopping at the first
+type ConfigError struct {
+	Missing []string
+}
+
+func (err *ConfigError) Error() string {
+	return "missing configuration: " + strings.Join(err.Missing, ", ")
+}
+
+var (
+	config      *Config
+	configMutex sync.Mutex
+)
+
+// GetConfig returns the process wide config, loading it from the environment and CONFIG_FILE on first use.
+// The lock is held while loading so concurrent first callers share one load
+func GetConfig() *Config {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if config == nil {
+		loaded, err := LoadConfig(os.Getenv(EnvConfigFile))
+		CheckError(err)
+		config = &loaded
+		configureLogging(config)
+	}
+	return config
+}
+
+func SetConfig(cfg *Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config = cfg
+}
+
+// LoadConfig applies the optional file at path, then the environment, then secrets, each overriding the last
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{
+		ProjectId:       DefaultProjectId,
+		SecretsDir:      DefaultSecretsDir,
+		BenchmarkSymbol: DefaultBenchmarkSymbol,
+		Database: DatabaseConfig{
+			SocketDir: DefaultSocketDir,
+		},
+	}
+
+	if len(path) > 0 {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := applyConfigEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	provider := getSecretProviderOverride()
+	if provider == nil {
+		var err error
+		if provider, err = NewSecretProvider(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	err := applyConfigSecrets(&cfg, provider)
+	cfg.registerSecrets()
+	return cfg, err
+}
+
+// registerSecrets redacts secret values from logs wherever they came from, including the config file
+func (cfg *Config) registerSecrets() {
+	for _, secret := range []string{
+		cfg.Database.User,
+		cfg.Database.Password,
+		cfg.Database.ConnectionName,
+		cfg.MySql.Password,
+		cfg.TokenMarketStack,
+		cfg.TokenIex,
+		cfg.RateApiKey,
+		cfg.MyApiKey,
+	} {
+		RegisterSecretValue(secret)
+	}
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config %v: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	default:
+		err = json.Unmarshal(data, cfg)
+	}
+
+	if err != nil {
+		return fmt.Errorf("parse config %v: %w", path, err)
+	}
+	return nil
+}
+
+func applyConfigEnv(cfg *Config) error {
+	setFromEnvBool(&cfg.Local, EnvLocal)
+	setFromEnvBool(&cfg.Debug, EnvDebug)
+	setFromEnv(&cfg.DebugStock, EnvDebugStock)
+	setFromEnv(&cfg.EmailQueueUrl, EnvUrlEmailQueue)
+	setFromEnv(&cfg.ProjectId, EnvProjectId)
+	setFromEnv(&cfg.SecretSource, EnvSecretSource)
+	setFromEnv(&cfg.SecretsDir, EnvSecretsDir)
+	setFromEnv(&cfg.BenchmarkSymbol, EnvBenchmarkSymbol)
+	if err := setFromEnvFloat(&cfg.RiskFreeRate, EnvRiskFreeRate); err != nil {
+		return err
+	}
+
+	setFromEnv(&cfg.Database.Url, EnvDatabaseUrl)
+	setFromEnv(&cfg.Database.Port, EnvDatabasePort)
+	setFromEnv(&cfg.Database.Name, EnvDatabaseName)
+	setFromEnvBool(&cfg.Database.PrivateIp, EnvDatabasePrivateIp)
+	setFromEnv(&cfg.Database.SocketDir, EnvDatabaseSocketDir)
+
+	setFromEnv(&cfg.MySql.User, EnvDatabaseUserMySql)
+	setFromEnv(&cfg.MySql.Password, EnvDatabasePasswordMySql)
+	setFromEnv(&cfg.MySql.Url, EnvDatabaseUrlMySql)
+	setFromEnv(&cfg.MySql.Port, EnvDatabasePortMySql)
+	setFromEnv(&cfg.MySql.Name, EnvDatabaseNameMySql)
+	return nil
+}
+
+func applyConfigSecrets(cfg *Config, provider SecretProvider) error {
+	secrets := []struct {
+		target        *string
+		envSecretName string
+	}{
+		{&cfg.Database.User, EnvSecretDbUser},
+		{&cfg.Database.Password, EnvSecretDbPassword},
+		{&cfg.Database.ConnectionName, EnvSecretDatabaseConnectionName},
+		{&cfg.TokenMarketStack, EnvSecretTokenMarketStack},
+		{&cfg.TokenIex, EnvSecretTokenIex},
+		{&cfg.RateApiKey, EnvSecretRateApiKey},
+		{&cfg.MyApiKey, EnvSecretMyApiKey},
+	}
+
+	var failed []string
+	for _, secret := range secrets {
+		value, err := lookupSecret(cfg, provider, secret.envSecretName)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", secret.envSecretName, err))
+			continue
+		}
+
+		// leave the target alone when the secret isn't configured so file values still apply
+		if len(value) > 0 {
+			*secret.target = value
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("load secrets: %v", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func setFromEnv(target *string, envName string) {
+	if value, isSet := os.LookupEnv(envName); isSet {
+		*target = value
+	}
+}
+
+func setFromEnvFloat(target *float64, envName string) error {
+	value, isSet := os.LookupEnv(envName)
+	if !isSet {
+		return nil
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%v: %w", envName, err)
+	}
+	*target = parsed
+	return nil
+}
+
+func setFromEnvBool(target *bool, envName string) {
+	if value, isSet := os.LookupEnv(envName); isSet {
+		*target = value == "1" || strings.EqualFold(value, "true")
+	}
+}
+
+func addMissing(missing []string, value string, name string) []string {
+	if len(value) == 0 {
+		return append(missing, name)
+	}
+	return missing
+}
+
+func toConfigError(missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	return &ConfigError{Missing: missing}
+}
+
+func (cfg *Config) getMissingMongo() []string {
+	var missing []string
+	missing = addMissing(missing, cfg.Database.Url, EnvDatabaseUrl)
+	missing = addMissing(missing, cfg.Database.Name, EnvDatabaseName)
+	missing = addMissing(missing, cfg.Database.User, EnvSecretDbUser)
+	missing = addMissing(missing, cfg.Database.Password, EnvSecretDbPassword)
+	return missing
+}
+
+func (cfg *Config) getMissingMySql() []string {
+	var missing []string
+	if cfg.Database.PrivateIp {
+		missing = addMissing(missing, cfg.MySql.Url, EnvDatabaseUrlMySql)
+		missing = addMissing(missing, cfg.MySql.Port, EnvDatabasePortMySql)
+		missing = addMissing(missing, cfg.MySql.Name, EnvDatabaseNameMySql)
+		missing = addMissing(missing, cfg.MySql.User, EnvDatabaseUserMySql)
+		missing = addMissing(missing, cfg.MySql.Password, EnvDatabasePasswordMySql)
+	} else {
+		missing = addMissing(missing, cfg.Database.Name, EnvDatabaseName)
+		missing = addMissing(missing, cfg.Database.User, EnvSecretDbUser)
+		missing = addMissing(missing, cfg.Database.Password, EnvSecretDbPassword)
+		missing = addMissing(missing, cfg.Database.ConnectionName, EnvSecretDatabaseConnectionName)
+	}
+	return missing
+}
+
+func (cfg *Config) getMissingPrices() []string {
+	var missing []string
+	missing = addMissing(missing, cfg.TokenMarketStack, EnvSecretTokenMarketStack)
+	missing = addMissing(missing, cfg.RateApiKey, EnvSecretRateApiKey)
+	return missing
+}
+
+func (cfg *Config) getMissingEmail() []string {
+	var missing []string
+	if cfg.Local {
+		missing = addMissing(missing, cfg.EmailQueueUrl, EnvUrlEmailQueue)
+	}
+	return missing
+}
+
+func (cfg *Config) ValidateMongo() error {
+	return toConfigError(cfg.getMissingMongo())
+}
+
+func (cfg *Config) ValidateMySql() error {
+	return toConfigError(cfg.getMissingMySql())
+}
+
+func (cfg *Config) ValidatePrices() error {
+	return toConfigError(cfg.getMissingPrices())
+}
+
+func (cfg *Config) ValidateEmail() error {
+	return toConfigError(cfg.getMissingEmail())
+}
+
+// Validate checks everything the package can use, services only needing part of it use the specific Validate* methods
+func (cfg *Config) Validate() error {
+	var missing []string
+	for _, group := range [][]string{cfg.getMissingMongo(), cfg.getMissingMySql(), cfg.getMissingPrices(), cfg.getMissingEmail()} {
+		for _, name := range group {
+			missing = addMissingOnce(missing, name)
+		}
+	}
+	return toConfigError(missing)
+}
+
+func addMissingOnce(missing []string, name string) []string {
+	for _, existing := range missing {
+		if existing == name {
+			return missing
+		}
+	}
+	return append(missing, name)
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFileThenEnvironment(t *testing.T) {
+	os.Setenv(EnvDatabaseName, "tracker-test")
+	defer os.Unsetenv(EnvDatabaseName)
+
+	cfg, err := LoadConfig("examples/config.yaml")
+	CheckError(err)
+
+	if !cfg.Debug || cfg.EmailQueueUrl != "http://localhost:8080/email" || cfg.Database.User != "trackerapp" {
+		t.Errorf("Config file values not loaded %+v", cfg)
+	}
+	if cfg.Database.Name != "tracker-test" {
+		t.Errorf("Expected environment to override file, database name %v", cfg.Database.Name)
+	}
+	if cfg.Database.SocketDir != DefaultSocketDir {
+		t.Errorf("Expected default socket dir actual %v", cfg.Database.SocketDir)
+	}
+}
+
+func TestConfigValidationListsEverythingMissing(t *testing.T) {
+	cfg, err := LoadConfig("examples/config.yaml")
+	CheckError(err)
+	cfg.Database.PrivateIp = true
+
+	err = cfg.ValidateMySql()
+
+	var configError *ConfigError
+	if !errors.As(err, &configError) {
+		t.Fatalf("Expected ConfigError actual %v", err)
+	}
+
+	expected := []string{EnvDatabaseNameMySql, EnvDatabaseUserMySql, EnvDatabasePasswordMySql}
+	if !reflect.DeepEqual(configError.Missing, expected) {
+		t.Errorf("Expected missing %v actual %v", expected, configError.Missing)
+	}
+
+	if err = cfg.ValidateMongo(); err == nil {
+		t.Errorf("Expected mongo password to be missing")
+	}
+}
+
+type countingSecretProvider struct {
+	calls int
+}
+
+func (provider *countingSecretProvider) GetSecret(name string) (string, error) {
+	provider.calls++
+	return "value-" + name, nil
+}
+
+func TestSecretProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	CheckError(err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "marketstack-token"), []byte("abc123\n"), 0600)
+	CheckError(err)
+
+	fileProvider := FileSecretProvider{Dir: dir}
+	if secret, err := fileProvider.GetSecret("marketstack-token"); err != nil || secret != "abc123" {
+		t.Errorf("Expected file secret abc123 actual %v error %v", secret, err)
+	}
+	if _, err = fileProvider.GetSecret("missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expected ErrSecretNotFound actual %v", err)
+	}
+
+	counting := &countingSecretProvider{}
+	caching := NewCachingSecretProvider(counting)
+	for i := 0; i < 3; i++ {
+		if secret, _ := caching.GetSecret("rates"); secret != "value-rates" {
+			t.Errorf("Expected cached secret value-rates actual %v", secret)
+		}
+	}
+	if counting.calls != 1 {
+		t.Errorf("Expected 1 lookup through the cache actual %v", counting.calls)
+	}
+}
+
+func TestLoadConfigLocalUsesSecretProvider(t *testing.T) {
+	os.Setenv(EnvSecretSource, SecretSourceEnv)
+	os.Setenv(EnvSecretRateApiKey, "from-environment")
+	defer os.Unsetenv(EnvSecretSource)
+	defer os.Unsetenv(EnvSecretRateApiKey)
+
+	cfg, err := LoadConfig("examples/config.yaml")
+	CheckError(err)
+	if cfg.RateApiKey != "from-environment" {
+		t.Errorf("Expected rate key from the environment actual %v", cfg.RateApiKey)
+	}
+
+	counting := &countingSecretProvider{}
+	SetSecretProvider(counting)
+	defer SetSecretProvider(nil)
+
+	cfg, err = LoadConfig("examples/config.yaml")
+	CheckError(err)
+	if cfg.RateApiKey != "value-"+EnvSecretRateApiKey || counting.calls == 0 {
+		t.Errorf("Expected rate key from the provider set actual %v after %v lookups", cfg.RateApiKey, counting.calls)
+	}
+}
+
+func TestLoadConfigSecretsFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	CheckError(err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "db-password"), []byte("hunter2"), 0600)
+	CheckError(err)
+
+	os.Setenv(EnvSecretSource, SecretSourceFile)
+	os.Setenv(EnvSecretsDir, dir)
+	os.Setenv(EnvSecretDbPassword, "db-password")
+	defer os.Unsetenv(EnvSecretSource)
+	defer os.Unsetenv(EnvSecretsDir)
+	defer os.Unsetenv(EnvSecretDbPassword)
+
+	cfg, err := LoadConfig("examples/config.yaml")
+	CheckError(err)
+
+	if cfg.Database.Password != "hunter2" {
+		t.Errorf("Expected password from mounted secret actual %v", cfg.Database.Password)
+	}
+	if err = cfg.ValidateMongo(); err != nil {
+		t.Errorf("Expected mongo config to be complete, got %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const (
+	CorporateActionTypeSplit         = 1
+	CorporateActionTypeConsolidation = 2
+	CorporateActionTypeTickerChange  = 3
+	CorporateActionTypeMerger        = 4
+
+	CollectionCorporateAction = "corporateaction"
+)
+
+// a day on day change in close/adj_close bigger than this is taken as a split rather than a dividend adjustment
+var SplitDetectionThreshold = NewFromFloat(1.4)
+
+// CorporateAction changes the units held from DtEffective, RatioTo new units for every RatioFrom old ones
+// e.g. a 2 for 1 split is RatioFrom 1 RatioTo 2 and a 1 for 10 consolidation is RatioFrom 10 RatioTo 1.
+// Mergers move the lots to NewStockId, paying CashPerUnit for each old unit, RatioTo 0 for an all cash takeover
+type CorporateAction struct {
+	CorporateActionId string `bson:"_id,omitempty"`
+	StockId           string
+	Type              int
+	DtEffective       string
+	RatioFrom         Decimal
+	RatioTo           Decimal
+	NewStockId        string
+	NewSymbol         string
+	CashPerUnit       Money
+	Notes             string
+}
+
+func (action CorporateAction) GetRatio() Decimal {
+	if action.Type == CorporateActionTypeTickerChange || action.RatioFrom.IsZero() {
+		return NewFromInt(1)
+	}
+	return action.RatioTo.Div(action.RatioFrom)
+}
+
+// Validate rejects ratios that can't be applied, only a merger may have RatioTo 0 as it pays cash for every unit
+func (action CorporateAction) Validate() error {
+	if action.Type == CorporateActionTypeTickerChange {
+		return nil
+	}
+	if !action.RatioFrom.IsPositive() {
+		return fmt.Errorf("corporate action %v: RatioFrom %v must be more than 0", action.GetKey(), action.RatioFrom)
+	}
+	if action.RatioTo.IsNegative() || (action.RatioTo.IsZero() && action.Type != CorporateActionTypeMerger) {
+		return fmt.Errorf("corporate action %v: RatioTo %v must be more than 0", action.GetKey(), action.RatioTo)
+	}
+	return nil
+}
+
+func (action CorporateAction) GetDtEffective() (time.Time, error) {
+	return ParseDt(action.DtEffective)
+}
+
+// IsUnitChange is true for the actions that change the units and price of the same stock
+func (action CorporateAction) IsUnitChange() bool {
+	return action.Type == CorporateActionTypeSplit || action.Type == CorporateActionTypeConsolidation
+}
+
+func (action CorporateAction) GetTargetStockId() string {
+	if (action.Type == CorporateActionTypeTickerChange || action.Type == CorporateActionTypeMerger) && len(action.NewStockId) > 0 {
+		return action.NewStockId
+	}
+	return action.StockId
+}
+
+// ApplyToLot keeps the lot's total cost, less any cash paid out, spread over the new units
+func (action CorporateAction) ApplyToLot(lot Lot) Lot {
+	ratio := action.GetRatio()
+
+	priceBought := lot.PriceBought
+	if action.Type == CorporateActionTypeMerger && !action.CashPerUnit.Value.IsZero() {
+		priceBought = priceBought.Sub(action.CashPerUnit.Value.Decimal)
+		if priceBought.IsNegative() {
+			priceBought = NewFromInt(0)
+		}
+	}
+
+	lot.StockId = action.GetTargetStockId()
+	lot.Units = lot.Units.Mul(ratio)
+	if !ratio.IsZero() {
+		lot.PriceBought = priceBought.Div(ratio)
+	}
+	return lot
+}
+
+func (action CorporateAction) ApplyToStock(stock *Stock) {
+	if action.Type == CorporateActionTypeTickerChange && stock.StockId == action.StockId && len(action.NewSymbol) > 0 {
+		stock.Symbol = action.NewSymbol
+	}
+}
+
+type holdingEvent struct {
+	dt          time.Time
+	transaction *Transaction
+	action      *CorporateAction
+}
+
+// ReplayHoldings rebuilds the holdings keyed on StockId from the trades, applying the corporate actions as they
+// take effect. Sells use the oldest lots first. Actions go before trades on the same day as those trade post action.
+// Dividends stay in the holding's Transactions for its income ledger without changing the lots
+func ReplayHoldings(transactions []Transaction, actions []CorporateAction) (map[string]*Holding, error) {
+	var events []holdingEvent
+	for ix := range transactions {
+		transaction := &transactions[ix]
+		if transaction.Ignore || len(transaction.StockId) == 0 || (transaction.Units.IsZero() && !transaction.IsDividend()) {
+			continue
+		}
+
+		dt, err := ParseDt(transaction.DtTrade)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %v date %v: %w", transaction.TransactionId, transaction.DtTrade, err)
+		}
+		events = append(events, holdingEvent{dt: dt, transaction: transaction})
+	}
+
+	for ix := range actions {
+		action := &actions[ix]
+		if err := action.Validate(); err != nil {
+			return nil, err
+		}
+		dt, err := action.GetDtEffective()
+		if err != nil {
+			return nil, fmt.Errorf("corporate action %v date %v: %w", action.CorporateActionId, action.DtEffective, err)
+		}
+		events = append(events, holdingEvent{dt: truncateToDay(dt), action: action})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		dayI, dayJ := truncateToDay(events[i].dt), truncateToDay(events[j].dt)
+		if !dayI.Equal(dayJ) {
+			return dayI.Before(dayJ)
+		}
+		return events[i].action != nil && events[j].action == nil
+	})
+
+	holdings := map[string]*Holding{}
+	getHolding := func(stockId string) *Holding {
+		holding, ok := holdings[stockId]
+		if !ok {
+			holding = &Holding{StockId: stockId}
+			holdings[stockId] = holding
+		}
+		return holding
+	}
+
+	for _, event := range events {
+		if event.action != nil {
+			applyCorporateAction(holdings, getHolding, *event.action)
+			continue
+		}
+
+		transaction := *event.transaction
+		holding := getHolding(transaction.StockId)
+		holding.Transactions = append(holding.Transactions, transaction)
+
+		if transaction.IsDividend() {
+			continue
+		}
+		if transaction.IsBuy() {
+			holding.Lots = append(holding.Lots, Lot{
+				StockId:     transaction.StockId,
+				PriceBought: getTransactionUnitPrice(transaction),
+				Units:       transaction.Units.Abs(),
+				Transaction: transaction,
+			})
+		} else if transaction.IsSell() {
+			if err := holding.sellFifo(transaction.Units.Abs()); err != nil {
+				return nil, fmt.Errorf("transaction %v on %v: %w", transaction.TransactionId, transaction.DtTrade, err)
+			}
+		}
+	}
+	return holdings, nil
+}
+
+func applyCorporateAction(holdings map[string]*Holding, getHolding func(string) *Holding, action CorporateAction) {
+	holding, ok := holdings[action.StockId]
+	if !ok {
+		return
+	}
+
+	GetLogger().Info("Applying corporate action", "stockId", action.StockId, "type", action.Type, "dtEffective", action.DtEffective, "ratio", action.GetRatio())
+	holding.Payments = append(holding.Payments, getCorporateActionPayments(action, holding.Lots)...)
+
+	var lots []Lot
+	for _, lot := range holding.Lots {
+		adjusted := action.ApplyToLot(lot)
+		if !adjusted.Units.IsZero() {
+			lots = append(lots, adjusted)
+		}
+	}
+
+	targetStockId := action.GetTargetStockId()
+	if targetStockId == action.StockId {
+		holding.Lots = lots
+		return
+	}
+
+	holding.Lots = nil
+	target := getHolding(targetStockId)
+	target.Lots = append(target.Lots, lots...)
+}
+
+// getCorporateActionPayments is the merger cash due on the lots, one payment per account
+func getCorporateActionPayments(action CorporateAction, lots []Lot) []Transaction {
+	if action.Type != CorporateActionTypeMerger || action.CashPerUnit.Value.IsZero() {
+		return nil
+	}
+
+	var accountIds []int
+	unitsByAccount := map[int]Decimal{}
+	for _, lot := range lots {
+		accountId := lot.Transaction.AccountId
+		if _, ok := unitsByAccount[accountId]; !ok {
+			accountIds = append(accountIds, accountId)
+			unitsByAccount[accountId] = NewFromInt(0)
+		}
+		unitsByAccount[accountId] = unitsByAccount[accountId].Add(lot.Units)
+	}
+
+	var payments []Transaction
+	for _, accountId := range accountIds {
+		units := unitsByAccount[accountId]
+		payments = append(payments, Transaction{
+			TransactionId: fmt.Sprintf("%v:%v", action.GetKey(), accountId),
+			StockId:       action.StockId,
+			DtTrade:       action.DtEffective,
+			Units:         DecimalExt{units},
+			UnitPrice:     action.CashPerUnit,
+			ValueQuoted:   action.CashPerUnit.Mul(units),
+			Reference:     "Corporate action",
+			Description:   fmt.Sprintf("%v merger cash", action.StockId),
+			AccountId:     accountId,
+		})
+	}
+	return payments
+}
+
+// GetHoldingPayments is every holding's corporate action cash, oldest first
+func GetHoldingPayments(holdings map[string]*Holding) []Transaction {
+	var payments []Transaction
+	for _, holding := range holdings {
+		payments = append(payments, holding.Payments...)
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		if payments[i].DtTrade != payments[j].DtTrade {
+			return payments[i].DtTrade < payments[j].DtTrade
+		}
+		return payments[i].TransactionId < payments[j].TransactionId
+	})
+	return payments
+}
+
+func (holding *Holding) sellFifo(units Decimal) error {
+	remaining := units
+	for len(holding.Lots) > 0 && remaining.IsPositive() {
+		lot := &holding.Lots[0]
+		if lot.Units.GreaterThan(remaining) {
+			lot.Units = lot.Units.Sub(remaining)
+			remaining = NewFromInt(0)
+			break
+		}
+		remaining = remaining.Sub(lot.Units)
+		holding.Lots = holding.Lots[1:]
+	}
+
+	if remaining.IsPositive() {
+		return fmt.Errorf("sold %v units of %v, %v more than held", units, holding.StockId, remaining)
+	}
+	return nil
+}
+
+func getTransactionUnitPrice(transaction Transaction) Decimal {
+	if !transaction.UnitPrice.Value.IsZero() {
+		return transaction.UnitPrice.Value.Decimal
+	}
+	return transaction.ValueQuoted.Value.Abs().Div(transaction.Units.Abs())
+}
+
+func truncateToDay(dt time.Time) time.Time {
+	return time.Date(dt.Year(), dt.Month(), dt.Day(), 0, 0, 0, 0, dt.Location())
+}
+
+// GetKey identifies the action when it has no id yet, e.g. one just detected
+func (action CorporateAction) GetKey() string {
+	if len(action.CorporateActionId) > 0 {
+		return action.CorporateActionId
+	}
+	return fmt.Sprintf("%v:%v:%v:%v:%v", action.StockId, action.Type, action.DtEffective, action.RatioFrom, action.RatioTo)
+}
+
+func (history *PriceHistory) isActionApplied(action CorporateAction) bool {
+	key := action.GetKey()
+	for _, applied := range history.AppliedActions {
+		if applied == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyCorporateActions puts the closes before each split or consolidation of the stock into post action terms.
+// Each action is recorded in AppliedActions so applying it again, e.g. to a stored history, changes nothing
+func (history *PriceHistory) ApplyCorporateActions(stockId string, actions []CorporateAction) {
+	for _, action := range actions {
+		if action.StockId != stockId || !action.IsUnitChange() || history.isActionApplied(action) {
+			continue
+		}
+		if err := action.Validate(); err != nil {
+			GetLogger().Warning("Skipping corporate action", "stockId", stockId, "error", err)
+			continue
+		}
+
+		dtEffective, err := action.GetDtEffective()
+		if err != nil {
+			GetLogger().Warning("Could not parse corporate action date", "stockId", stockId, "dtEffective", action.DtEffective, "error", err)
+			continue
+		}
+
+		ratio := action.GetRatio()
+		for ix := range history.Eods {
+			eod := &history.Eods[ix]
+			if !eod.Date.Before(truncateToDay(dtEffective)) {
+				continue
+			}
+			eod.PriceClose = eod.PriceClose.Div(ratio)
+			if !eod.PriceClosePounds.Value.IsZero() {
+				eod.PriceClosePounds.Value = DecimalExt{eod.PriceClosePounds.Value.Div(ratio)}
+			}
+		}
+		history.AppliedActions = append(history.AppliedActions, action.GetKey())
+	}
+}
+
+// DetectUnrecordedSplits compares close to adj_close on consecutive days of the newest first history, a jump in the
+// ratio between them that isn't covered by a recorded action is returned as a suggested action
+func DetectUnrecordedSplits(stockId string, history PriceHistory, recorded []CorporateAction) []CorporateAction {
+	var detected []CorporateAction
+
+	for ix := 0; ix+1 < len(history.Eods); ix++ {
+		newer := history.Eods[ix]
+		older := history.Eods[ix+1]
+		if newer.PriceAdjClose.IsZero() || older.PriceAdjClose.IsZero() || newer.PriceClose.IsZero() || older.PriceClose.IsZero() {
+			continue
+		}
+
+		factorNewer := newer.PriceClose.Div(newer.PriceAdjClose)
+		factorOlder := older.PriceClose.Div(older.PriceAdjClose)
+		ratio := factorOlder.Div(factorNewer)
+
+		isSplit := ratio.GreaterThanOrEqual(SplitDetectionThreshold)
+		isConsolidation := NewFromInt(1).Div(ratio).GreaterThanOrEqual(SplitDetectionThreshold)
+		if !isSplit && !isConsolidation {
+			continue
+		}
+		if isSplitRecorded(stockId, recorded, older.Date.Time, newer.Date.Time) {
+			continue
+		}
+
+		action := CorporateAction{
+			StockId:     stockId,
+			DtEffective: newer.Date.Format(TimeFormatMySql),
+			Notes:       "detected from adj_close",
+		}
+		if isSplit {
+			action.Type = CorporateActionTypeSplit
+			action.RatioFrom = NewFromInt(1)
+			action.RatioTo = ratio.Round(2)
+		} else {
+			action.Type = CorporateActionTypeConsolidation
+			action.RatioFrom = NewFromInt(1).Div(ratio).Round(2)
+			action.RatioTo = NewFromInt(1)
+		}
+
+		GetLogger().Warning("Unrecorded split detected", "stockId", stockId, "dtEffective", action.DtEffective, "ratioFrom", action.RatioFrom, "ratioTo", action.RatioTo)
+		detected = append(detected, action)
+	}
+	return detected
+}
+
+// isSplitRecorded is true if a split or consolidation of the stock takes effect after older and on or before newer
+func isSplitRecorded(stockId string, recorded []CorporateAction, older time.Time, newer time.Time) bool {
+	for _, action := range recorded {
+		if action.StockId != stockId || !action.IsUnitChange() {
+			continue
+		}
+		dtEffective, err := action.GetDtEffective()
+		if err != nil {
+			continue
+		}
+		if dtEffective.After(older) && !dtEffective.After(newer) {
+			return true
+		}
+	}
+	return false
+}
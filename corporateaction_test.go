@@ -0,0 +1,186 @@
+package common
+
+import (
+	"context"
+	. "github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func getTradeTransaction(stockId string, dtTrade string, units int64, unitPrice string, valueQuoted string) Transaction {
+	return Transaction{
+		StockId:     stockId,
+		DtTrade:     dtTrade,
+		Units:       DecimalExt{NewFromInt(units)},
+		UnitPrice:   FromPounds(unitPrice),
+		ValueQuoted: FromPounds(valueQuoted),
+	}
+}
+
+func TestReplayHoldingsSplit(t *testing.T) {
+	transactions := []Transaction{
+		getTradeTransaction("tsla", "2020-01-02 00:00:00", 10, "400", "-4000"),
+		getTradeTransaction("tsla", "2020-09-01 00:00:00", 20, "100", "2000"),
+		getTradeTransaction("tsla", "2020-06-01 00:00:00", 10, "800", "-8000"),
+	}
+	actions := []CorporateAction{
+		{StockId: "tsla", Type: CorporateActionTypeSplit, DtEffective: "2020-08-31", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(5)},
+	}
+
+	holdings, err := ReplayHoldings(transactions, actions)
+	if err != nil {
+		t.Fatalf("Replay expected no error actual %v", err)
+	}
+
+	holding := holdings["tsla"]
+	// 100 units after the split, 20 sold from the first lot
+	if units := holding.GetUnitsTotal(); !units.Equal(NewFromInt(80)) {
+		t.Errorf("Units expected %v actual %v", 80, units)
+	}
+	if len(holding.Lots) != 2 || !holding.Lots[0].Units.Equal(NewFromInt(30)) || !holding.Lots[0].PriceBought.Equal(NewFromInt(80)) {
+		t.Errorf("First lot expected 30 units at 80 actual %v", holding.Lots)
+	}
+	if average := holding.GetPriceAverageBought(); !average.Equal(NewFromFloat(130)) {
+		t.Errorf("Average price expected %v actual %v", 130, average)
+	}
+}
+
+func TestReplayHoldingsMerger(t *testing.T) {
+	transactions := []Transaction{
+		getTradeTransaction("old", "2020-01-02 00:00:00", 100, "10", "-1000"),
+	}
+	actions := []CorporateAction{
+		{StockId: "old", Type: CorporateActionTypeMerger, DtEffective: "2020-05-01", NewStockId: "new", RatioFrom: NewFromInt(2), RatioTo: NewFromInt(1), CashPerUnit: FromPounds("2")},
+	}
+
+	holdings, err := ReplayHoldings(transactions, actions)
+	if err != nil {
+		t.Fatalf("Replay expected no error actual %v", err)
+	}
+
+	if len(holdings["old"].Lots) != 0 {
+		t.Errorf("Old holding expected no lots actual %v", holdings["old"].Lots)
+	}
+	merged := holdings["new"]
+	if merged == nil || !merged.GetUnitsTotal().Equal(NewFromInt(50)) || !merged.Lots[0].PriceBought.Equal(NewFromInt(16)) {
+		t.Errorf("New holding expected 50 units at 16 actual %v", merged)
+	}
+
+	payments := holdings["old"].Payments
+	if len(payments) != 1 || !payments[0].ValueQuoted.Value.Equal(NewFromInt(200)) || payments[0].GetTransactionType() != TransactionTypeCorporateAction {
+		t.Errorf("Old holding expected merger cash of 200 actual %v", payments)
+	}
+
+	ledgers, err := BuildCashLedgersWithActions(transactions, actions)
+	CheckError(err)
+	if balance := ledgers[0].GetBalance(); !balance.Value.Equal(NewFromInt(-800)) {
+		t.Errorf("Cash expected -1000 paid and 200 merger cash back actual %v", balance.GetDesc())
+	}
+}
+
+func TestReplayHoldingsOversold(t *testing.T) {
+	transactions := []Transaction{
+		getTradeTransaction("iag", "2020-01-02 00:00:00", 10, "2", "-20"),
+		getTradeTransaction("iag", "2020-01-03 00:00:00", 11, "2", "22"),
+	}
+	if _, err := ReplayHoldings(transactions, nil); err == nil {
+		t.Errorf("Replay expected error selling more than held")
+	}
+}
+
+func getEod(date string, close float64, adjClose float64) EodMarketStack {
+	dt, err := time.Parse(TimeFormatDate, date)
+	CheckError(err)
+	return EodMarketStack{
+		Date:             timeMarketStack{dt},
+		PriceClose:       NewFromFloat(close),
+		PriceAdjClose:    NewFromFloat(adjClose),
+		PriceClosePounds: Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(close)}},
+	}
+}
+
+func TestDetectAndApplySplit(t *testing.T) {
+	history := PriceHistory{Eods: []EodMarketStack{
+		getEod("2020-09-01", 480, 480),
+		getEod("2020-08-31", 500, 500),
+		getEod("2020-08-28", 2200, 440),
+		getEod("2020-08-27", 2100, 420),
+	}}
+
+	detected := DetectUnrecordedSplits("tsla", history, nil)
+	if len(detected) != 1 {
+		t.Fatalf("Detected expected %v actual %v", 1, len(detected))
+	}
+	split := detected[0]
+	if split.Type != CorporateActionTypeSplit || !split.RatioTo.Equal(NewFromInt(5)) || split.DtEffective != "2020-08-31 00:00:00" {
+		t.Errorf("Detected expected 5 for 1 split on 2020-08-31 actual %v", split)
+	}
+
+	if again := DetectUnrecordedSplits("tsla", history, detected); len(again) != 0 {
+		t.Errorf("Detected expected none once recorded actual %v", again)
+	}
+
+	history.ApplyCorporateActions("tsla", detected)
+	if !history.Eods[2].PriceClose.Equal(NewFromInt(440)) || !history.Eods[1].PriceClose.Equal(NewFromInt(500)) {
+		t.Errorf("Adjusted closes expected 440 and 500 actual %v %v", history.Eods[2].PriceClose, history.Eods[1].PriceClose)
+	}
+	if !history.Eods[3].PriceClosePounds.Value.Equal(NewFromInt(420)) {
+		t.Errorf("Adjusted close pounds expected %v actual %v", 420, history.Eods[3].PriceClosePounds.GetDesc())
+	}
+
+	history.ApplyCorporateActions("tsla", detected)
+	if !history.Eods[2].PriceClose.Equal(NewFromInt(440)) || len(history.AppliedActions) != 1 {
+		t.Errorf("Applying again expected no change actual %v applied %v", history.Eods[2].PriceClose, history.AppliedActions)
+	}
+}
+
+func TestMemoryRepositoryKeepsAppliedActions(t *testing.T) {
+	history := PriceHistory{Eods: []EodMarketStack{
+		getEod("2020-08-31", 500, 500),
+		getEod("2020-08-28", 2200, 440),
+	}}
+	split := CorporateAction{StockId: "tsla", Type: CorporateActionTypeSplit, DtEffective: "2020-08-31 00:00:00", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(5)}
+	history.ApplyCorporateActions("tsla", []CorporateAction{split})
+
+	ctx := context.Background()
+	repository := NewMemoryRepository()
+	CheckError(repository.SavePriceHistory(ctx, "tsla", history))
+
+	stored, err := repository.GetPriceHistory(ctx, "tsla")
+	CheckError(err)
+	stored.ApplyCorporateActions("tsla", []CorporateAction{split})
+	if !stored.Eods[1].PriceClose.Equal(NewFromInt(440)) || len(stored.AppliedActions) != 1 {
+		t.Errorf("Stored history expected the split applied once actual %v applied %v", stored.Eods[1].PriceClose, stored.AppliedActions)
+	}
+}
+
+func TestCorporateActionRatioValidation(t *testing.T) {
+	tests := []struct {
+		action CorporateAction
+		valid  bool
+	}{
+		{CorporateAction{Type: CorporateActionTypeSplit, RatioFrom: NewFromInt(1), RatioTo: NewFromInt(2)}, true},
+		{CorporateAction{Type: CorporateActionTypeSplit, RatioFrom: NewFromInt(1), RatioTo: NewFromInt(0)}, false},
+		{CorporateAction{Type: CorporateActionTypeConsolidation, RatioFrom: NewFromInt(0), RatioTo: NewFromInt(1)}, false},
+		{CorporateAction{Type: CorporateActionTypeMerger, RatioFrom: NewFromInt(1), RatioTo: NewFromInt(0)}, true},
+		{CorporateAction{Type: CorporateActionTypeMerger, RatioFrom: NewFromInt(1), RatioTo: NewFromInt(-1)}, false},
+		{CorporateAction{Type: CorporateActionTypeTickerChange}, true},
+	}
+	for _, test := range tests {
+		if err := test.action.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate %v expected valid %v actual %v", test.action.GetKey(), test.valid, err)
+		}
+	}
+
+	zeroSplit := CorporateAction{StockId: "tsla", Type: CorporateActionTypeSplit, DtEffective: "2020-08-31 00:00:00", RatioFrom: NewFromInt(1), RatioTo: NewFromInt(0)}
+	history := PriceHistory{Eods: []EodMarketStack{getEod("2020-08-31", 500, 500), getEod("2020-08-28", 2200, 440)}}
+	history.ApplyCorporateActions("tsla", []CorporateAction{zeroSplit})
+	if !history.Eods[1].PriceClose.Equal(NewFromInt(2200)) || len(history.AppliedActions) != 0 {
+		t.Errorf("Zero ratio split expected skipped actual %v applied %v", history.Eods[1].PriceClose, history.AppliedActions)
+	}
+
+	transactions := []Transaction{getTradeTransaction("tsla", "2020-01-02 00:00:00", 10, "100", "-1000")}
+	if _, err := ReplayHoldings(transactions, []CorporateAction{zeroSplit}); err == nil {
+		t.Errorf("Replay with a zero ratio split expected an error")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -14,82 +13,65 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-type dbOptions struct {
-	Url            string
-	User           string
-	Password       string
-	Port           string
-	DbName         string
-	PrivateIp      string
-	ConnectionName string
-}
+const (
+	CollectionStock       = "stock"
+	CollectionWatch       = "watch"
+	CollectionTransaction = "transaction"
+)
 
-func getDbOptions() dbOptions {
-	return dbOptions{
-		Url:            os.Getenv(EnvDatabaseUrl),
-		User:           GetSecret(EnvSecretDbUser),
-		DbName:         os.Getenv(EnvDatabaseName),
-		Password:       GetSecret(EnvSecretDbPassword),
-		Port:           os.Getenv(EnvDatabasePort),
-		PrivateIp:      os.Getenv(EnvDatabasePrivateIp),
-		ConnectionName: GetSecret(EnvSecretDatabaseConnectionName),
-	}
+func ConnectDb() *sql.DB {
+	return ConnectDbConfig(GetConfig())
 }
 
-func ConnectDb() *sql.DB {
-	Log("Connecting to db")
+func ConnectDbConfig(cfg *Config) *sql.DB {
+	log := GetLogger()
+	log.Info("Connecting to db")
 
-	options := getDbOptions()
+	CheckError(cfg.ValidateMySql())
 
-	Log("Connection string")
 	// connection string
-	connectString := getConnectionString(options)
+	connectString := getConnectionString(cfg)
 
-	Log("Opening db")
+	log.Debug("Opening db")
 	// open database
 	//Access denied for user 'trackerapp'@'cloudsqlproxy~107.178.231.18' (using password: YES)
 	db, err := sql.Open("mysql", connectString)
 	CheckError(err)
 
-	Log("Doing ping")
+	log.Debug("Doing ping")
 	// check db
 	err = db.Ping()
 	CheckError(err)
 
-	fmt.Println("Connected!")
+	log.Info("Connected to db")
 
 	return db
 }
 
-func getConnectionString(options dbOptions) string {
-	if options.PrivateIp == "1" {
-		return getConnectionStringDirect(options)
+func getConnectionString(cfg *Config) string {
+	if cfg.Database.PrivateIp {
+		return getConnectionStringDirect(cfg.MySql)
 	} else {
-		return getConnectionStringSocket(options)
+		return getConnectionStringSocket(cfg.Database)
 	}
 }
 
-func getConnectionStringDirect(options dbOptions) string {
-	Log("USING LOCAL ENVIRONMENT VARIABLES NOT SECRETS")
-	user := os.Getenv("DB_USER_MYSQL")
-	password := os.Getenv("DB_PASSWORD_MYSQL")
-	url := os.Getenv("DB_URL_MYSQL")
-	port := os.Getenv("DB_PORT_MYSQL")
-	dbName := os.Getenv("DB_NAME_MYSQL")
+func getConnectionStringDirect(options MySqlConfig) string {
+	GetLogger().Warning("Connecting directly to MySQL with the DB_*_MYSQL settings not secrets", "url", options.Url, "db", options.Name)
 
-	return user + ":" + password + "@tcp(" + url + ":" + port + ")/" + dbName
+	return options.User + ":" + options.Password + "@tcp(" + options.Url + ":" + options.Port + ")/" + options.Name
 }
 
-func getConnectionStringSocket(options dbOptions) string {
-	socketDir, isSet := os.LookupEnv("DB_SOCKET_DIR")
-	if !isSet {
-		socketDir = "cloudsql"
+func getConnectionStringSocket(options DatabaseConfig) string {
+	socketDir := options.SocketDir
+	if len(socketDir) == 0 {
+		socketDir = DefaultSocketDir
 	}
 
-	Log(fmt.Sprintf("user %v socket %v conx %v db %v", options.User, socketDir, options.ConnectionName, options.DbName))
+	GetLogger().Info("Connecting to MySQL over the cloud sql socket", "socketDir", socketDir, "db", options.Name)
 
 	var dbURI string
-	dbURI = fmt.Sprintf("%s:%s@unix(/%s/%s)/%s?parseTime=true", options.User, options.Password, socketDir, options.ConnectionName, options.DbName)
+	dbURI = fmt.Sprintf("%s:%s@unix(/%s/%s)/%s?parseTime=true", options.User, options.Password, socketDir, options.ConnectionName, options.Name)
 
 	// dbPool is the pool of database connections.
 	//_, err := sql.Open("mysql", dbURI)
@@ -103,9 +85,15 @@ func DisconnectMongoDb(dbClient *mongo.Client) {
 }
 
 func ConnectDbMongo() (*mongo.Client, *mongo.Database) {
-	Log("Connecting mongo")
+	return ConnectDbMongoConfig(GetConfig())
+}
+
+func ConnectDbMongoConfig(config *Config) (*mongo.Client, *mongo.Database) {
+	log := GetLogger()
+	log.Info("Connecting mongo")
 
-	cfg := getDbOptions()
+	CheckError(config.ValidateMongo())
+	cfg := config.Database
 
 	context, _ := context.WithTimeout(context.Background(), 10*time.Second)
 
@@ -115,12 +103,12 @@ func ConnectDbMongo() (*mongo.Client, *mongo.Database) {
 		cfg.User,
 		cfg.Password,
 		cfg.Url,
-		cfg.DbName)
+		cfg.Name)
 
 	logUri := strings.Replace(uri, cfg.Password, "password", -1)
-	Log("URI " + logUri)
+	log.Info("Mongo URI", "uri", logUri)
 
-	dbClient, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	dbClient, err := mongo.NewClient(options.Client().ApplyURI(uri).SetRegistry(BsonRegistry))
 	CheckError(err)
 
 	err = dbClient.Connect(context)
@@ -132,8 +120,8 @@ func ConnectDbMongo() (*mongo.Client, *mongo.Database) {
 	databases, err := dbClient.ListDatabaseNames(context, bson.M{})
 	CheckError(err)
 
-	fmt.Println(databases)
+	log.Debug("Connected mongo", "databases", databases)
 
-	database := dbClient.Database(cfg.DbName)
+	database := dbClient.Database(cfg.Name)
 	return dbClient, database
 }
@@ -0,0 +1,412 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"sort"
+	texttemplate "text/template"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const (
+	DigestTopMovers  = 5
+	DigestExpiryDays = 7
+)
+
+// a watch is near its threshold once the move since reference is this fraction of AlertThreshold
+var DigestNearThresholdRatio = NewFromFloat(0.8)
+
+// DigestPrice is the price a holding is valued at now and at the previous close, for the day change
+type DigestPrice struct {
+	Current       Money
+	PreviousClose Money
+}
+
+type DigestInput struct {
+	Date     time.Time
+	Holdings []Holding
+	Stocks   map[string]*Stock      // keyed on StockId, for names
+	Prices   map[string]DigestPrice // keyed on StockId
+	Watches  []WatchDetail
+}
+
+type Digest struct {
+	Date             time.Time       `json:"date"`
+	Currency         string          `json:"currency"`
+	Accounts         []DigestAccount `json:"accounts"`
+	Value            Money           `json:"value"`
+	DayChange        Money           `json:"dayChange"`
+	DayChangePercent Decimal         `json:"dayChangePercent"`
+	TopMovers        []DigestMover   `json:"topMovers"`
+	NearThreshold    []DigestWatch   `json:"nearThreshold"`
+	Expiring         []DigestExpiry  `json:"expiring"`
+}
+
+type DigestAccount struct {
+	AccountId        int     `json:"accountId"`
+	Name             string  `json:"name"`
+	Value            Money   `json:"value"`
+	DayChange        Money   `json:"dayChange"`
+	DayChangePercent Decimal `json:"dayChangePercent"`
+}
+
+type DigestMover struct {
+	StockId       string  `json:"stockId"`
+	Name          string  `json:"name"`
+	Price         Money   `json:"price"`
+	ChangePercent Decimal `json:"changePercent"`
+	Value         Money   `json:"value"`
+}
+
+type DigestWatch struct {
+	StockId        string  `json:"stockId"`
+	Name           string  `json:"name"`
+	DeltaReference Decimal `json:"deltaReference"`
+	Threshold      Decimal `json:"threshold"`
+}
+
+type DigestExpiry struct {
+	StockId  string    `json:"stockId"`
+	Name     string    `json:"name"`
+	DtStop   time.Time `json:"dtStop"`
+	DaysLeft int       `json:"daysLeft"`
+}
+
+type digestAccountTotals struct {
+	current  MoneyBag
+	previous MoneyBag
+}
+
+// BuildDigest values every lot at the current price in its own account, amounts are reported in GBP
+func BuildDigest(input DigestInput) (Digest, error) {
+	digest := Digest{
+		Date:     input.Date,
+		Currency: CURRENCY_GBP,
+	}
+
+	totalsByAccount := map[int]*digestAccountTotals{}
+	var movers []DigestMover
+	seenMovers := map[string]bool{}
+
+	for _, holding := range input.Holdings {
+		price, ok := input.Prices[holding.StockId]
+		if !ok {
+			GetLogger().Warning("No price for holding in digest", "stockId", holding.StockId)
+			continue
+		}
+
+		for _, lot := range holding.Lots {
+			accountId := lot.Transaction.AccountId
+			totals, ok := totalsByAccount[accountId]
+			if !ok {
+				totals = &digestAccountTotals{current: NewMoneyBag(), previous: NewMoneyBag()}
+				totalsByAccount[accountId] = totals
+			}
+			totals.current.Add(price.Current.Mul(lot.Units))
+			totals.previous.Add(price.PreviousClose.Mul(lot.Units))
+		}
+
+		if seenMovers[holding.StockId] || price.PreviousClose.Value.IsZero() {
+			continue
+		}
+		seenMovers[holding.StockId] = true
+
+		movers = append(movers, DigestMover{
+			StockId:       holding.StockId,
+			Name:          getDigestStockName(input.Stocks, holding.StockId),
+			Price:         price.Current,
+			ChangePercent: getPercentChange(price.PreviousClose.Value.Decimal, price.Current.Value.Decimal),
+			Value:         price.Current.Mul(holding.GetUnitsTotal()),
+		})
+	}
+
+	var accountIds []int
+	for accountId := range totalsByAccount {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Ints(accountIds)
+
+	total := NewMoneyBag()
+	totalPrevious := NewMoneyBag()
+	for _, accountId := range accountIds {
+		totals := totalsByAccount[accountId]
+		total.AddBag(totals.current)
+		totalPrevious.AddBag(totals.previous)
+
+		value, err := totals.current.Total(digest.Currency)
+		if err != nil {
+			return Digest{}, err
+		}
+		previous, err := totals.previous.Total(digest.Currency)
+		if err != nil {
+			return Digest{}, err
+		}
+		dayChange, err := value.SubStrict(previous)
+		if err != nil {
+			return Digest{}, err
+		}
+		digest.Accounts = append(digest.Accounts, DigestAccount{
+			AccountId:        accountId,
+			Name:             GetAccountName(accountId),
+			Value:            value,
+			DayChange:        dayChange,
+			DayChangePercent: getDigestPercent(previous, value),
+		})
+	}
+
+	value, err := total.Total(digest.Currency)
+	if err != nil {
+		return Digest{}, err
+	}
+	previous, err := totalPrevious.Total(digest.Currency)
+	if err != nil {
+		return Digest{}, err
+	}
+	digest.Value = value
+	dayChange, err := digest.Value.SubStrict(previous)
+	if err != nil {
+		return Digest{}, err
+	}
+	digest.DayChange = dayChange
+	digest.DayChangePercent = getDigestPercent(previous, digest.Value)
+
+	sort.SliceStable(movers, func(i, j int) bool {
+		return movers[i].ChangePercent.Abs().GreaterThan(movers[j].ChangePercent.Abs())
+	})
+	if len(movers) > DigestTopMovers {
+		movers = movers[:DigestTopMovers]
+	}
+	digest.TopMovers = movers
+
+	digest.NearThreshold = getDigestNearThreshold(input)
+	digest.Expiring = getDigestExpiring(input)
+	return digest, nil
+}
+
+func getDigestPercent(was Money, is Money) Decimal {
+	if was.Value.IsZero() {
+		return NewFromInt(0)
+	}
+	return getPercentChange(was.Value.Decimal, is.Value.Decimal)
+}
+
+func getDigestStockName(stocks map[string]*Stock, stockId string) string {
+	if stock, ok := stocks[stockId]; ok && stock != nil {
+		return stock.GetDisplayName()
+	}
+	return stockId
+}
+
+// isWatchStopped is true when the watch has a DtStop before date
+func isWatchStopped(watch Watch, date time.Time) bool {
+	if len(watch.DtStop) == 0 {
+		return false
+	}
+	dtStop, err := ParseDt(watch.DtStop)
+	return err == nil && dtStop.Before(date)
+}
+
+func getDigestNearThreshold(input DigestInput) []DigestWatch {
+	var near []DigestWatch
+	for ix := range input.Watches {
+		wd := &input.Watches[ix]
+		threshold := wd.Watch.AlertThreshold.Decimal.Abs()
+		if threshold.IsZero() || len(wd.History.Eods) == 0 || wd.Watch.AddedPriceBuy.Value.IsZero() || isWatchStopped(wd.Watch, input.Date) {
+			continue
+		}
+
+		delta := wd.GetDeltaReferencePercent()
+		if delta.Abs().LessThan(threshold.Mul(DigestNearThresholdRatio)) {
+			continue
+		}
+
+		near = append(near, DigestWatch{
+			StockId:        wd.Watch.StockId,
+			Name:           wd.getName(),
+			DeltaReference: delta,
+			Threshold:      wd.Watch.AlertThreshold.Decimal,
+		})
+	}
+
+	// closest to (or furthest past) the threshold first
+	sort.SliceStable(near, func(i, j int) bool {
+		return near[i].DeltaReference.Abs().Div(near[i].Threshold.Abs()).GreaterThan(near[j].DeltaReference.Abs().Div(near[j].Threshold.Abs()))
+	})
+	return near
+}
+
+func getDigestExpiring(input DigestInput) []DigestExpiry {
+	day := time.Date(input.Date.Year(), input.Date.Month(), input.Date.Day(), 0, 0, 0, 0, input.Date.Location())
+	cutoff := day.AddDate(0, 0, DigestExpiryDays)
+
+	var expiring []DigestExpiry
+	for ix := range input.Watches {
+		wd := &input.Watches[ix]
+		if len(wd.Watch.DtStop) == 0 {
+			continue
+		}
+
+		dtStop, err := ParseDt(wd.Watch.DtStop)
+		if err != nil {
+			GetLogger().Warning("Could not parse watch DtStop", "watchId", wd.Watch.WatchId, "dtStop", wd.Watch.DtStop, "error", err)
+			continue
+		}
+		if dtStop.Before(day) || dtStop.After(cutoff) {
+			continue
+		}
+
+		expiring = append(expiring, DigestExpiry{
+			StockId:  wd.Watch.StockId,
+			Name:     wd.getName(),
+			DtStop:   dtStop,
+			DaysLeft: int(dtStop.Sub(day).Hours() / 24),
+		})
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].DtStop.Before(expiring[j].DtStop)
+	})
+	return expiring
+}
+
+func (digest Digest) ToJson() ([]byte, error) {
+	return json.MarshalIndent(digest, "", "  ")
+}
+
+func (digest Digest) GetSubject() string {
+	return "Portfolio digest " + digest.Date.Format("02 Jan 2006")
+}
+
+const digestHtmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+</head>
+<body style="font-family: Arial, sans-serif;">
+<h2>{{.Subject}}</h2>
+<p>Total {{money .Digest.Value}}, day change {{money .Digest.DayChange}} ({{percent .Digest.DayChangePercent}})</p>
+{{- if .Digest.Accounts}}
+<h3>Accounts</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Account</th><th>Value</th><th>Day change</th></tr>
+{{- range .Digest.Accounts}}
+<tr><td>{{.Name}}</td><td>{{money .Value}}</td><td>{{money .DayChange}} ({{percent .DayChangePercent}})</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Digest.TopMovers}}
+<h3>Top movers</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Stock</th><th>Price</th><th>Change</th><th>Holding value</th></tr>
+{{- range .Digest.TopMovers}}
+<tr><td>{{.Name}}</td><td>{{money .Price}}</td><td>{{percent .ChangePercent}}</td><td>{{money .Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Digest.NearThreshold}}
+<h3>Near watch threshold</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Stock</th><th>Since reference</th><th>Threshold</th></tr>
+{{- range .Digest.NearThreshold}}
+<tr><td>{{.Name}}</td><td>{{percent .DeltaReference}}</td><td>{{percent .Threshold}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Digest.Expiring}}
+<h3>Watches stopping soon</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Stock</th><th>Stops</th><th>Days left</th></tr>
+{{- range .Digest.Expiring}}
+<tr><td>{{.Name}}</td><td>{{date .DtStop}}</td><td>{{.DaysLeft}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`
+
+const digestTextTemplate = `{{.Subject}}
+
+Total {{money .Digest.Value}}, day change {{money .Digest.DayChange}} ({{percent .Digest.DayChangePercent}})
+{{- if .Digest.Accounts}}
+
+Accounts
+{{- range .Digest.Accounts}}
+- {{.Name}}: {{money .Value}}, day change {{money .DayChange}} ({{percent .DayChangePercent}})
+{{- end}}
+{{- end}}
+{{- if .Digest.TopMovers}}
+
+Top movers
+{{- range .Digest.TopMovers}}
+- {{.Name}}: {{percent .ChangePercent}} at {{money .Price}}, holding {{money .Value}}
+{{- end}}
+{{- end}}
+{{- if .Digest.NearThreshold}}
+
+Near watch threshold
+{{- range .Digest.NearThreshold}}
+- {{.Name}}: {{percent .DeltaReference}} since reference, threshold {{percent .Threshold}}
+{{- end}}
+{{- end}}
+{{- if .Digest.Expiring}}
+
+Watches stopping soon
+{{- range .Digest.Expiring}}
+- {{.Name}}: stops {{date .DtStop}} in {{.DaysLeft}} days
+{{- end}}
+{{- end}}
+`
+
+type digestTemplateData struct {
+	Subject string
+	Digest  Digest
+}
+
+func getDigestTemplateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"money":   GetFormatter().FormatMoney,
+		"percent": GetFormatter().FormatPercent,
+		"date": func(date time.Time) string {
+			return date.Format("02 Jan 2006")
+		},
+	}
+}
+
+// ToEmail renders the digest as an email with the current formatter
+func (digest Digest) ToEmail() (MessageSendEmail, error) {
+	data := digestTemplateData{
+		Subject: digest.GetSubject(),
+		Digest:  digest,
+	}
+	funcs := getDigestTemplateFuncs()
+
+	htmlTemplate, err := htmltemplate.New("digestHtml").Funcs(funcs).Parse(digestHtmlTemplate)
+	if err != nil {
+		return MessageSendEmail{}, err
+	}
+	var html bytes.Buffer
+	if err = htmlTemplate.Execute(&html, data); err != nil {
+		return MessageSendEmail{}, err
+	}
+
+	textTemplate, err := texttemplate.New("digestText").Funcs(funcs).Parse(digestTextTemplate)
+	if err != nil {
+		return MessageSendEmail{}, err
+	}
+	var text bytes.Buffer
+	if err = textTemplate.Execute(&text, data); err != nil {
+		return MessageSendEmail{}, err
+	}
+
+	return MessageSendEmail{
+		Html:       html.String(),
+		PlainText:  text.String(),
+		SenderName: EmailSenderName,
+		Subject:    data.Subject,
+	}, nil
+}
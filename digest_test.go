@@ -0,0 +1,116 @@
+package common
+
+import (
+	"encoding/json"
+	. "github.com/shopspring/decimal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getDigestTestInput() DigestInput {
+	lot := func(stockId string, units int64, accountId int) Lot {
+		return Lot{StockId: stockId, Units: NewFromInt(units), Transaction: Transaction{AccountId: accountId}}
+	}
+
+	return DigestInput{
+		Date: time.Date(2021, 3, 1, 18, 0, 0, 0, time.UTC),
+		Holdings: []Holding{
+			{StockId: "vusa", Lots: []Lot{lot("vusa", 10, AccountIdIsa), lot("vusa", 5, AccountIdShare)}},
+			{StockId: "iag", Lots: []Lot{lot("iag", 100, AccountIdShare)}},
+		},
+		Stocks: map[string]*Stock{
+			"vusa": {Description: "Vanguard S&P 500"},
+			"iag":  {Description: "IAG"},
+		},
+		Prices: map[string]DigestPrice{
+			"vusa": {Current: FromPounds("60"), PreviousClose: FromPounds("50")},
+			"iag":  {Current: FromPounds("1.5"), PreviousClose: FromPounds("2")},
+		},
+		Watches: []WatchDetail{
+			{
+				Stock: &Stock{Description: "Tesla"},
+				Watch: Watch{
+					StockId:        "tsla",
+					AddedPriceBuy:  FromPounds("400"),
+					AlertThreshold: DecimalExt{NewFromInt(10)},
+					DtStop:         "2021-03-05 00:00:00",
+				},
+				History: PriceHistory{Eods: []EodMarketStack{{PriceClosePounds: FromPounds("436")}}},
+			},
+			{
+				Stock: &Stock{Description: "Apple"},
+				Watch: Watch{
+					StockId:        "aapl",
+					AddedPriceBuy:  FromPounds("100"),
+					AlertThreshold: DecimalExt{NewFromInt(10)},
+					DtStop:         "2021-04-01",
+				},
+				History: PriceHistory{Eods: []EodMarketStack{{PriceClosePounds: FromPounds("101")}}},
+			},
+		},
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	digest, err := BuildDigest(getDigestTestInput())
+	CheckError(err)
+
+	if len(digest.Accounts) != 2 {
+		t.Fatalf("Accounts expected %v actual %v", 2, len(digest.Accounts))
+	}
+
+	isa := digest.Accounts[0]
+	if isa.Name != "ISA" || !isa.Value.Value.Equal(NewFromInt(600)) || !isa.DayChange.Value.Equal(NewFromInt(100)) {
+		t.Errorf("ISA expected 600 change 100 actual %v change %v", isa.Value.GetDesc(), isa.DayChange.GetDesc())
+	}
+
+	share := digest.Accounts[1]
+	if !share.Value.Value.Equal(NewFromInt(450)) || !share.DayChange.Value.Equal(NewFromInt(0)) {
+		t.Errorf("Share expected 450 change 0 actual %v change %v", share.Value.GetDesc(), share.DayChange.GetDesc())
+	}
+
+	if !digest.Value.Value.Equal(NewFromInt(1050)) {
+		t.Errorf("Total expected %v actual %v", 1050, digest.Value.GetDesc())
+	}
+
+	if len(digest.TopMovers) != 2 || digest.TopMovers[0].StockId != "iag" {
+		t.Errorf("Top mover expected iag actual %v", digest.TopMovers)
+	}
+
+	if len(digest.NearThreshold) != 1 || digest.NearThreshold[0].StockId != "tsla" {
+		t.Errorf("Near threshold expected tsla actual %v", digest.NearThreshold)
+	}
+
+	if len(digest.Expiring) != 1 || digest.Expiring[0].DaysLeft != 4 {
+		t.Errorf("Expiring expected tsla in 4 days actual %v", digest.Expiring)
+	}
+}
+
+func TestDigestRender(t *testing.T) {
+	digest, err := BuildDigest(getDigestTestInput())
+	CheckError(err)
+
+	email, err := digest.ToEmail()
+	if err != nil {
+		t.Errorf("Render expected no error actual %v", err)
+	}
+
+	for _, expected := range []string{"Total £1,050.00, day change £100.00 (+10.53%)", "- IAG: -25.00% at £1.50", "- Tesla: stops 05 Mar 2021 in 4 days"} {
+		if !strings.Contains(email.PlainText, expected) {
+			t.Errorf("Plain text expected to contain %v actual\n%v", expected, email.PlainText)
+		}
+	}
+	if !strings.Contains(email.Html, "<td>Vanguard S&amp;P 500</td>") {
+		t.Errorf("Html expected escaped name actual\n%v", email.Html)
+	}
+
+	data, err := digest.ToJson()
+	if err != nil {
+		t.Errorf("Json expected no error actual %v", err)
+	}
+	var decoded Digest
+	if err = json.Unmarshal(data, &decoded); err != nil || len(decoded.Accounts) != 2 {
+		t.Errorf("Json expected to round trip actual %v %v", err, string(data))
+	}
+}
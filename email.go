@@ -0,0 +1,185 @@
+package common
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+const EmailSenderName = "Investor Tracker"
+
+// templates are kept in the package so every cloud function renders the same email without shipping template files
+const alertEmailHtmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+</head>
+<body style="font-family: Arial, sans-serif;">
+<h2>{{.Subject}}</h2>
+{{- if .Alerts}}
+<h3>Alerts</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Stock</th><th>Instruction</th><th>Price</th><th>Marker</th><th>Message</th></tr>
+{{- range .Alerts}}
+<tr><td>{{if .Url}}<a href="{{.Url}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.Instruction}}</td><td>{{.Price}}</td><td>{{.Marker}}</td><td>{{.Message}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Watches}}
+<h3>Watches</h3>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th>Stock</th><th>Last close</th><th>Previous close</th><th>Change</th><th>Since reference</th><th>Notes</th></tr>
+{{- range .Watches}}
+<tr><td>{{if .Url}}<a href="{{.Url}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.PriceLastClose}}</td><td>{{.PricePreviousClose}}</td><td>{{.Change}}</td><td>{{.DeltaReference}}{{if .DtReference}} since {{.DtReference}}{{end}}</td><td>{{.Notes}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`
+
+const alertEmailTextTemplate = `{{.Subject}}
+{{- if .Alerts}}
+
+Alerts
+{{- range .Alerts}}
+- {{.Name}}: {{.Instruction}} at {{.Price}} (marker {{.Marker}}) {{.Message}}
+{{- if .Url}}
+  {{.Url}}
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Watches}}
+
+Watches
+{{- range .Watches}}
+- {{.Name}}: {{.PriceLastClose}}, change {{.Change}}, {{.DeltaReference}}{{if .DtReference}} since {{.DtReference}}{{end}}
+{{- if .Notes}}
+  {{.Notes}}
+{{- end}}
+{{- if .Url}}
+  {{.Url}}
+{{- end}}
+{{- end}}
+{{- end}}
+`
+
+type alertEmailData struct {
+	Subject string
+	Alerts  []alertEmailRow
+	Watches []watchEmailRow
+}
+
+type alertEmailRow struct {
+	Name        string
+	Url         string
+	Instruction string
+	Price       string
+	Marker      string
+	Message     string
+}
+
+type watchEmailRow struct {
+	Name               string
+	Url                string
+	PriceLastClose     string
+	PricePreviousClose string
+	Change             string
+	DeltaReference     string
+	DtReference        string
+	Notes              string
+}
+
+// EmailRenderer builds the HTML and plain text bodies of the alert email
+type EmailRenderer struct {
+	SenderName string
+
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+func NewEmailRenderer() *EmailRenderer {
+	return &EmailRenderer{
+		SenderName: EmailSenderName,
+		html:       htmltemplate.Must(htmltemplate.New("alertEmailHtml").Parse(alertEmailHtmlTemplate)),
+		text:       texttemplate.Must(texttemplate.New("alertEmailText").Parse(alertEmailTextTemplate)),
+	}
+}
+
+func (renderer *EmailRenderer) Render(subject string, alerts []Alert, watchDetails []WatchDetail) (MessageSendEmail, error) {
+	data := alertEmailData{
+		Subject: subject,
+	}
+	for _, alert := range alerts {
+		data.Alerts = append(data.Alerts, getAlertEmailRow(alert))
+	}
+	for ix := range watchDetails {
+		data.Watches = append(data.Watches, getWatchEmailRow(&watchDetails[ix]))
+	}
+
+	var html bytes.Buffer
+	if err := renderer.html.Execute(&html, data); err != nil {
+		return MessageSendEmail{}, err
+	}
+
+	var text bytes.Buffer
+	if err := renderer.text.Execute(&text, data); err != nil {
+		return MessageSendEmail{}, err
+	}
+
+	return MessageSendEmail{
+		Html:       html.String(),
+		PlainText:  text.String(),
+		SenderName: renderer.SenderName,
+		Subject:    subject,
+	}, nil
+}
+
+// RenderAlertEmail is Render with the default renderer
+func RenderAlertEmail(subject string, alerts []Alert, watchDetails []WatchDetail) (MessageSendEmail, error) {
+	return NewEmailRenderer().Render(subject, alerts, watchDetails)
+}
+
+func getAlertEmailRow(alert Alert) alertEmailRow {
+	row := alertEmailRow{
+		Instruction: alert.Instruction.GetDesc(),
+		Marker:      GetFormatter().FormatUnits(alert.Instruction.MarkerPrice),
+		Message:     alert.Message,
+	}
+
+	if alert.Stock != nil {
+		row.Name = alert.Stock.GetDisplayName()
+		row.Url = alert.Stock.GetPricePageUrl()
+		if alert.Instruction.IsBuy() || alert.Instruction.IsSell() {
+			price := alert.Stock.GetRelevantPrice(alert.Instruction)
+			row.Price = price.GetDesc()
+		}
+	}
+	return row
+}
+
+func getWatchEmailRow(wd *WatchDetail) watchEmailRow {
+	row := watchEmailRow{
+		PriceLastClose:     wd.GetPriceLastClosePoundsDesc(),
+		PricePreviousClose: wd.GetPricePreviousCloseDesc(),
+		Notes:              wd.Watch.Notes,
+	}
+
+	if wd.Stock != nil {
+		row.Name = wd.Stock.GetDisplayName()
+		row.Url = wd.Stock.GetPricePageUrl()
+	}
+
+	if len(wd.History.Eods) > 0 || !wd.ChangePercent.IsZero() {
+		row.Change = wd.GetChangePercentDesc()
+	}
+
+	if len(wd.History.Eods) > 0 && !wd.Watch.AddedPriceBuy.Value.IsZero() && wd.Stock != nil {
+		row.DeltaReference = wd.GetDeltaReferencePercentDesc()
+	}
+	if len(wd.Watch.DtReference) > 0 {
+		row.DtReference = wd.GetDtReferenceDesc()
+	}
+	return row
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"flag"
+	. "github.com/shopspring/decimal"
+	"io/ioutil"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in examples")
+
+func getEmailTestData() ([]Alert, []WatchDetail) {
+	vusa := &Stock{
+		Description: "Vanguard S&P 500 UCITS ETF",
+		Symbol:      "VUSA.XLON",
+		PriceBuy:    Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(61.25)}},
+		PriceSell:   Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(61.2)}},
+	}
+	tsla := &Stock{
+		Description: "Tesla Inc",
+		Symbol:      "TSLA",
+	}
+
+	alerts := []Alert{
+		{
+			Instruction: MonitorInstruction{PriceTypeToMonitor: PriceTypeBuy, MarkerPrice: NewFromFloat(62.5)},
+			Stock:       vusa,
+			Message:     "Below buy target <62.50>",
+		},
+	}
+
+	watchDetails := []WatchDetail{
+		{
+			Stock: tsla,
+			Watch: Watch{
+				DtReference:   "2021-01-04 00:00:00",
+				AddedPriceBuy: Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(420)}},
+				Notes:         "Crash watch",
+			},
+			History: PriceHistory{
+				Eods: []EodMarketStack{
+					{PriceClosePounds: Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(434)}}},
+					{PriceClosePounds: Money{Currency: CURRENCY_GBP, Value: DecimalExt{NewFromFloat(430)}}},
+				},
+			},
+		},
+	}
+	return alerts, watchDetails
+}
+
+func checkGolden(t *testing.T, path string, actual string) {
+	if *updateGolden {
+		CheckError(ioutil.WriteFile(path, []byte(actual), 0644))
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	CheckError(err)
+	if string(expected) != actual {
+		t.Errorf("%v expected\n%v\nactual\n%v", path, string(expected), actual)
+	}
+}
+
+func TestRenderAlertEmail(t *testing.T) {
+	// the golden files are in the legacy format
+	defer replaceFormatter(NewLegacyFormatter())()
+
+	alerts, watchDetails := getEmailTestData()
+
+	email, err := RenderAlertEmail("Investor Tracker alerts", alerts, watchDetails)
+	if err != nil {
+		t.Errorf("Render expected no error actual %v", err)
+	}
+
+	checkGolden(t, "examples/alertemail.html", email.Html)
+	checkGolden(t, "examples/alertemail.txt", email.PlainText)
+
+	if email.SenderName != EmailSenderName {
+		t.Errorf("Sender expected %v actual %v", EmailSenderName, email.SenderName)
+	}
+}
+
+func TestRenderAlertEmailEmpty(t *testing.T) {
+	email, err := RenderAlertEmail("Nothing to report", nil, nil)
+	if err != nil {
+		t.Errorf("Render expected no error actual %v", err)
+	}
+
+	expected := "Nothing to report\n"
+	if email.PlainText != expected {
+		t.Errorf("Plain text expected %q actual %q", expected, email.PlainText)
+	}
+}
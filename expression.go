@@ -0,0 +1,637 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	. "github.com/shopspring/decimal"
+)
+
+// Expression is a condition on a watch's price history, e.g. "close < sma(200) and drawdown(90) > 20%".
+// Numbers are decimals and a trailing % is only for readability, percents are in percent so 20% is 20.
+// Operators, loosest first: or, and, not, comparisons (< <= > >= == !=), + -, * /, unary -.
+// Names are the close, previous_close and volume of the last day, reference (the watch's AddedPriceBuy),
+// change_ref (percent since reference) and threshold (the watch's AlertThreshold). Functions take whole day periods:
+// sma(n), ema(n), rsi(n) (n defaults to 14), highest(n), lowest(n), change_pct(n) (percent change over n days)
+// and drawdown(n) (percent the close is below the n day high, positive)
+type Expression struct {
+	Source string
+	root   expressionNode
+}
+
+const (
+	expressionTypeNumber = 1
+	expressionTypeBool   = 2
+
+	// ExpressionMaxPeriod is the longest period a function takes, about 40 years of trading days
+	ExpressionMaxPeriod = 10000
+)
+
+var ErrExpressionDivideByZero = errors.New("divide by zero")
+
+// ParseExpression parses and type checks the source, which has to evaluate to true or false
+func ParseExpression(source string) (*Expression, error) {
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+
+	parser := expressionParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+	if next := parser.peek(); next.kind != tokenEnd {
+		return nil, fmt.Errorf("expression %q: position %v: unexpected %q", source, next.pos+1, next.text)
+	}
+
+	expressionType, err := root.check()
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+	if expressionType != expressionTypeBool {
+		return nil, fmt.Errorf("expression %q: is a number not a condition", source)
+	}
+	return &Expression{Source: source, root: root}, nil
+}
+
+func (expression *Expression) String() string {
+	return expression.Source
+}
+
+// Evaluate is whether the condition holds on the last day of the watch's history. ErrNotEnoughHistory is returned
+// when a function needs more days than there are
+func (expression *Expression) Evaluate(wd *WatchDetail) (bool, error) {
+	context := &expressionContext{wd: wd, series: wd.History.ToTimeSeries()}
+	value, err := expression.root.evaluate(context)
+	if err != nil {
+		return false, fmt.Errorf("expression %q: %w", expression.Source, err)
+	}
+	return value.boolean, nil
+}
+
+// GetExpression parses the watch's Expression, nil if it has none
+func (watch Watch) GetExpression() (*Expression, error) {
+	if len(strings.TrimSpace(watch.Expression)) == 0 {
+		return nil, nil
+	}
+	return ParseExpression(watch.Expression)
+}
+
+// tokens
+
+const (
+	tokenEnd = iota
+	tokenNumber
+	tokenName
+	tokenOperator
+)
+
+type expressionToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var expressionOperators = []string{"<=", ">=", "==", "!=", "<", ">", "+", "-", "*", "/", "(", ")", ","}
+
+func tokenizeExpression(source string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	runes := []rune(source)
+
+	for ix := 0; ix < len(runes); {
+		r := runes[ix]
+		switch {
+		case unicode.IsSpace(r):
+			ix++
+
+		case unicode.IsDigit(r) || r == '.':
+			start := ix
+			for ix < len(runes) && (unicode.IsDigit(runes[ix]) || runes[ix] == '.') {
+				ix++
+			}
+			tokens = append(tokens, expressionToken{kind: tokenNumber, text: string(runes[start:ix]), pos: start})
+			if ix < len(runes) && runes[ix] == '%' {
+				ix++
+			}
+
+		case unicode.IsLetter(r) || r == '_':
+			start := ix
+			for ix < len(runes) && (unicode.IsLetter(runes[ix]) || unicode.IsDigit(runes[ix]) || runes[ix] == '_') {
+				ix++
+			}
+			tokens = append(tokens, expressionToken{kind: tokenName, text: strings.ToLower(string(runes[start:ix])), pos: start})
+
+		default:
+			matched := false
+			for _, operator := range expressionOperators {
+				if strings.HasPrefix(string(runes[ix:]), operator) {
+					tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, pos: ix})
+					ix += len([]rune(operator))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("position %v: unexpected %q", ix+1, string(r))
+			}
+		}
+	}
+
+	return append(tokens, expressionToken{kind: tokenEnd, text: "end", pos: len(runes)}), nil
+}
+
+// parser, one function per precedence level
+
+type expressionParser struct {
+	tokens []expressionToken
+	ix     int
+}
+
+func (parser *expressionParser) peek() expressionToken {
+	return parser.tokens[parser.ix]
+}
+
+func (parser *expressionParser) next() expressionToken {
+	token := parser.tokens[parser.ix]
+	if token.kind != tokenEnd {
+		parser.ix++
+	}
+	return token
+}
+
+func (parser *expressionParser) isNext(kind int, texts ...string) bool {
+	token := parser.peek()
+	if token.kind != kind {
+		return false
+	}
+	for _, text := range texts {
+		if token.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+func (parser *expressionParser) expect(text string) error {
+	token := parser.next()
+	if token.kind != tokenOperator || token.text != text {
+		return fmt.Errorf("position %v: expected %q found %q", token.pos+1, text, token.text)
+	}
+	return nil
+}
+
+func (parser *expressionParser) parseOr() (expressionNode, error) {
+	return parser.parseBinary([]string{"or"}, tokenName, parser.parseAnd)
+}
+
+func (parser *expressionParser) parseAnd() (expressionNode, error) {
+	return parser.parseBinary([]string{"and"}, tokenName, parser.parseNot)
+}
+
+func (parser *expressionParser) parseNot() (expressionNode, error) {
+	if parser.isNext(tokenName, "not") {
+		token := parser.next()
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{pos: token.pos, operator: "not", operand: operand}, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *expressionParser) parseComparison() (expressionNode, error) {
+	left, err := parser.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.isNext(tokenOperator, "<", "<=", ">", ">=", "==", "!=") {
+		return left, nil
+	}
+
+	token := parser.next()
+	right, err := parser.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{pos: token.pos, operator: token.text, left: left, right: right}, nil
+}
+
+func (parser *expressionParser) parseAdditive() (expressionNode, error) {
+	return parser.parseBinary([]string{"+", "-"}, tokenOperator, parser.parseMultiplicative)
+}
+
+func (parser *expressionParser) parseMultiplicative() (expressionNode, error) {
+	return parser.parseBinary([]string{"*", "/"}, tokenOperator, parser.parseUnary)
+}
+
+// parseBinary is a left associative chain of operands joined by the operators
+func (parser *expressionParser) parseBinary(operators []string, kind int, parseOperand func() (expressionNode, error)) (expressionNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.isNext(kind, operators...) {
+		token := parser.next()
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{pos: token.pos, operator: token.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (parser *expressionParser) parseUnary() (expressionNode, error) {
+	if parser.isNext(tokenOperator, "-") {
+		token := parser.next()
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{pos: token.pos, operator: "-", operand: operand}, nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *expressionParser) parsePrimary() (expressionNode, error) {
+	token := parser.next()
+	switch token.kind {
+	case tokenNumber:
+		value, err := NewFromString(token.text)
+		if err != nil {
+			return nil, fmt.Errorf("position %v: bad number %q", token.pos+1, token.text)
+		}
+		return &numberNode{pos: token.pos, value: value}, nil
+
+	case tokenName:
+		if !parser.isNext(tokenOperator, "(") {
+			return &nameNode{pos: token.pos, name: token.text}, nil
+		}
+		parser.next()
+
+		call := &callNode{pos: token.pos, name: token.text}
+		for !parser.isNext(tokenOperator, ")") {
+			if len(call.args) > 0 {
+				if err := parser.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		parser.next()
+		return call, nil
+
+	case tokenOperator:
+		if token.text == "(" {
+			inner, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := parser.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("position %v: unexpected %q", token.pos+1, token.text)
+}
+
+// nodes, check is the type checker and evaluate only runs on a checked tree
+
+type expressionValue struct {
+	number  Decimal
+	boolean bool
+}
+
+type expressionContext struct {
+	wd     *WatchDetail
+	series TimeSeries // closes in pounds, newest first
+}
+
+type expressionNode interface {
+	check() (int, error)
+	evaluate(context *expressionContext) (expressionValue, error)
+}
+
+type numberNode struct {
+	pos   int
+	value Decimal
+}
+
+func (node *numberNode) check() (int, error) {
+	return expressionTypeNumber, nil
+}
+
+func (node *numberNode) evaluate(context *expressionContext) (expressionValue, error) {
+	return expressionValue{number: node.value}, nil
+}
+
+type nameNode struct {
+	pos  int
+	name string
+}
+
+func (node *nameNode) check() (int, error) {
+	if _, ok := expressionNames[node.name]; !ok {
+		return 0, fmt.Errorf("position %v: unknown name %q", node.pos+1, node.name)
+	}
+	return expressionTypeNumber, nil
+}
+
+func (node *nameNode) evaluate(context *expressionContext) (expressionValue, error) {
+	value, err := expressionNames[node.name](context)
+	return expressionValue{number: value}, err
+}
+
+type callNode struct {
+	pos     int
+	name    string
+	args    []expressionNode
+	periods []int
+}
+
+func (node *callNode) check() (int, error) {
+	function, ok := expressionFunctions[node.name]
+	if !ok {
+		return 0, fmt.Errorf("position %v: unknown function %q", node.pos+1, node.name)
+	}
+
+	if len(node.args) > 1 || (len(node.args) == 0 && function.defaultPeriod == 0) {
+		return 0, fmt.Errorf("position %v: %v takes one period", node.pos+1, node.name)
+	}
+
+	period := function.defaultPeriod
+	if len(node.args) == 1 {
+		number, ok := node.args[0].(*numberNode)
+		if !ok || !number.value.Equal(number.value.Truncate(0)) || !number.value.IsPositive() {
+			return 0, fmt.Errorf("position %v: %v period has to be a whole number of days", node.pos+1, node.name)
+		}
+		if number.value.GreaterThan(NewFromInt(ExpressionMaxPeriod)) {
+			return 0, fmt.Errorf("position %v: %v period can't be more than %v days", node.pos+1, node.name, ExpressionMaxPeriod)
+		}
+		period = int(number.value.IntPart())
+	}
+	node.periods = []int{period}
+	return expressionTypeNumber, nil
+}
+
+func (node *callNode) evaluate(context *expressionContext) (expressionValue, error) {
+	value, err := expressionFunctions[node.name].evaluate(context, node.periods[0])
+	if err != nil {
+		return expressionValue{}, fmt.Errorf("%v(%v): %w", node.name, node.periods[0], err)
+	}
+	return expressionValue{number: value}, nil
+}
+
+type unaryNode struct {
+	pos      int
+	operator string
+	operand  expressionNode
+}
+
+func (node *unaryNode) check() (int, error) {
+	operandType, err := node.operand.check()
+	if err != nil {
+		return 0, err
+	}
+
+	expected := expressionTypeNumber
+	if node.operator == "not" {
+		expected = expressionTypeBool
+	}
+	if operandType != expected {
+		return 0, fmt.Errorf("position %v: %v needs a %v", node.pos+1, node.operator, getExpressionTypeName(expected))
+	}
+	return expected, nil
+}
+
+func (node *unaryNode) evaluate(context *expressionContext) (expressionValue, error) {
+	value, err := node.operand.evaluate(context)
+	if err != nil {
+		return value, err
+	}
+	if node.operator == "not" {
+		return expressionValue{boolean: !value.boolean}, nil
+	}
+	return expressionValue{number: value.number.Neg()}, nil
+}
+
+type binaryNode struct {
+	pos      int
+	operator string
+	left     expressionNode
+	right    expressionNode
+}
+
+func (node *binaryNode) check() (int, error) {
+	leftType, err := node.left.check()
+	if err != nil {
+		return 0, err
+	}
+	rightType, err := node.right.check()
+	if err != nil {
+		return 0, err
+	}
+
+	operandType, resultType := expressionTypeNumber, expressionTypeNumber
+	switch node.operator {
+	case "and", "or":
+		operandType, resultType = expressionTypeBool, expressionTypeBool
+	case "<", "<=", ">", ">=", "==", "!=":
+		resultType = expressionTypeBool
+	}
+
+	if leftType != operandType || rightType != operandType {
+		return 0, fmt.Errorf("position %v: %v needs a %v either side", node.pos+1, node.operator, getExpressionTypeName(operandType))
+	}
+	return resultType, nil
+}
+
+func (node *binaryNode) evaluate(context *expressionContext) (expressionValue, error) {
+	left, err := node.left.evaluate(context)
+	if err != nil {
+		return left, err
+	}
+
+	// short circuit so the other side's history isn't needed
+	if node.operator == "and" && !left.boolean {
+		return expressionValue{boolean: false}, nil
+	}
+	if node.operator == "or" && left.boolean {
+		return expressionValue{boolean: true}, nil
+	}
+
+	right, err := node.right.evaluate(context)
+	if err != nil {
+		return right, err
+	}
+
+	switch node.operator {
+	case "and", "or":
+		return expressionValue{boolean: right.boolean}, nil
+	case "<":
+		return expressionValue{boolean: left.number.LessThan(right.number)}, nil
+	case "<=":
+		return expressionValue{boolean: left.number.LessThanOrEqual(right.number)}, nil
+	case ">":
+		return expressionValue{boolean: left.number.GreaterThan(right.number)}, nil
+	case ">=":
+		return expressionValue{boolean: left.number.GreaterThanOrEqual(right.number)}, nil
+	case "==":
+		return expressionValue{boolean: left.number.Equal(right.number)}, nil
+	case "!=":
+		return expressionValue{boolean: !left.number.Equal(right.number)}, nil
+	case "+":
+		return expressionValue{number: left.number.Add(right.number)}, nil
+	case "-":
+		return expressionValue{number: left.number.Sub(right.number)}, nil
+	case "*":
+		return expressionValue{number: left.number.Mul(right.number)}, nil
+	case "/":
+		if right.number.IsZero() {
+			return expressionValue{}, fmt.Errorf("position %v: %w", node.pos+1, ErrExpressionDivideByZero)
+		}
+		return expressionValue{number: left.number.Div(right.number)}, nil
+	}
+	return expressionValue{}, fmt.Errorf("position %v: unknown operator %q", node.pos+1, node.operator)
+}
+
+func getExpressionTypeName(expressionType int) string {
+	if expressionType == expressionTypeBool {
+		return "condition"
+	}
+	return "number"
+}
+
+// names and functions
+
+var expressionNames = map[string]func(context *expressionContext) (Decimal, error){
+	"close": func(context *expressionContext) (Decimal, error) {
+		return context.getClose(0)
+	},
+	"previous_close": func(context *expressionContext) (Decimal, error) {
+		return context.getClose(1)
+	},
+	"volume": func(context *expressionContext) (Decimal, error) {
+		if len(context.wd.History.Eods) == 0 {
+			return Decimal{}, ErrNotEnoughHistory
+		}
+		return context.wd.History.Eods[0].Volume, nil
+	},
+	"reference": func(context *expressionContext) (Decimal, error) {
+		return context.getReference()
+	},
+	"change_ref": func(context *expressionContext) (Decimal, error) {
+		reference, err := context.getReference()
+		if err != nil {
+			return Decimal{}, err
+		}
+		lastClose, err := context.getClose(0)
+		if err != nil {
+			return Decimal{}, err
+		}
+		if reference.IsZero() {
+			return Decimal{}, ErrExpressionDivideByZero
+		}
+		return getPercentChange(reference, lastClose), nil
+	},
+	"threshold": func(context *expressionContext) (Decimal, error) {
+		return context.wd.Watch.AlertThreshold.Decimal, nil
+	},
+}
+
+type expressionFunction struct {
+	defaultPeriod int // 0 if the period is required
+	evaluate      func(context *expressionContext, period int) (Decimal, error)
+}
+
+var expressionFunctions = map[string]expressionFunction{
+	"sma": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		return getExpressionLatest(GetSma(context.series, period))
+	}},
+	"ema": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		return getExpressionLatest(GetEma(context.series, period))
+	}},
+	"rsi": {defaultPeriod: DefaultRsiPeriod, evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		return getExpressionLatest(GetRsi(context.series, period))
+	}},
+	"highest": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		return context.getExtreme(period, true)
+	}},
+	"lowest": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		return context.getExtreme(period, false)
+	}},
+	"change_pct": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		was, err := context.getClose(period)
+		if err != nil {
+			return Decimal{}, err
+		}
+		if was.IsZero() {
+			return Decimal{}, ErrExpressionDivideByZero
+		}
+		return getPercentChange(was, context.series[0].Value), nil
+	}},
+	"drawdown": {evaluate: func(context *expressionContext, period int) (Decimal, error) {
+		high, err := context.getExtreme(period, true)
+		if err != nil {
+			return Decimal{}, err
+		}
+		if high.IsZero() {
+			return Decimal{}, ErrExpressionDivideByZero
+		}
+		return getPercentChange(high, context.series[0].Value).Neg(), nil
+	}},
+}
+
+func getExpressionLatest(series TimeSeries) (Decimal, error) {
+	latest, ok := series.GetLatest()
+	if !ok {
+		return Decimal{}, ErrNotEnoughHistory
+	}
+	return latest, nil
+}
+
+func (context *expressionContext) getReference() (Decimal, error) {
+	if context.wd.Watch.AddedPriceBuy.isUnset() {
+		return Decimal{}, errors.New("watch has no reference price")
+	}
+	return context.wd.Watch.AddedPriceBuy.toPounds().Value.Decimal, nil
+}
+
+// getClose is the close daysAgo trading days before the last
+func (context *expressionContext) getClose(daysAgo int) (Decimal, error) {
+	if daysAgo < 0 {
+		return Decimal{}, fmt.Errorf("%v days ago is in the future", daysAgo)
+	}
+	if daysAgo >= len(context.series) {
+		return Decimal{}, ErrNotEnoughHistory
+	}
+	return context.series[daysAgo].Value, nil
+}
+
+// getExtreme is the highest or lowest close of the last period days
+func (context *expressionContext) getExtreme(period int, isHighest bool) (Decimal, error) {
+	if period <= 0 {
+		return Decimal{}, fmt.Errorf("period %v has to be positive", period)
+	}
+	if period > len(context.series) {
+		return Decimal{}, ErrNotEnoughHistory
+	}
+
+	extreme := context.series[0].Value
+	for _, point := range context.series[:period] {
+		if (isHighest && point.Value.GreaterThan(extreme)) || (!isHighest && point.Value.LessThan(extreme)) {
+			extreme = point.Value
+		}
+	}
+	return extreme, nil
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/shopspring/decimal"
+)
+
+func getExpressionWatchDetail(closes ...float64) *WatchDetail {
+	return &WatchDetail{
+		Stock: &Stock{StockId: "iag", Description: "IAG"},
+		Watch: Watch{
+			StockId:        "iag",
+			WatchType:      WatchTypeExpression,
+			AddedPriceBuy:  FromPounds("100"),
+			AlertThreshold: DecimalExt{NewFromInt(5)},
+		},
+		History: getBacktestHistory(closes...),
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	invalid := map[string]string{
+		"close":              "is a number not a condition",
+		"close < ":           "position 9: unexpected \"end\"",
+		"close < sma(x)":     "period has to be a whole number",
+		"close < sma(2.5)":   "period has to be a whole number",
+		"close < sma()":      "takes one period",
+		"close < sma(0)":     "period has to be a whole number",
+		"close < sma(10001)": "can't be more than 10000 days",
+
+		"highest(18446744073709551615) > 1":   "can't be more than 10000 days",
+		"change_pct(9223372036854775808) > 1": "can't be more than 10000 days",
+		"price > 1":                           "unknown name \"price\"",
+		"close > median(3)":                   "unknown function \"median\"",
+		"close > 1 and 2":                     "and needs a condition either side",
+		"not close":                           "not needs a condition",
+		"(close > 1) + 1 > 2":                 "+ needs a number either side",
+		"close > 1 )":                         "position 11: unexpected \")\"",
+		"close # 1":                           "position 7: unexpected \"#\"",
+	}
+
+	for source, expected := range invalid {
+		_, err := ParseExpression(source)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%v error expected %v actual %v", source, expected, err)
+		}
+	}
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	wd := getExpressionWatchDetail(100, 110, 120, 105, 96)
+
+	expected := map[string]bool{
+		"close < sma(3)":                               true,
+		"close < sma(200)":                             false,
+		"drawdown(3) > 19%":                            true,
+		"drawdown(3) >= 20% and drawdown(3) < 21%":     true,
+		"change_pct(1) <= -5":                          true,
+		"change_pct(4) == -4%":                         true,
+		"change_ref < -threshold or close > reference": false,
+		"not (lowest(5) > 100)":                        true,
+		"highest(5) - lowest(5) == 24":                 true,
+		"previous_close / 105 * 2 == 1 + 1":            true,
+		"CLOSE == 96":                                  true,
+	}
+
+	for source, matched := range expected {
+		expression, err := ParseExpression(source)
+		if err != nil {
+			t.Errorf("%v parse error %v", source, err)
+			continue
+		}
+
+		actual, err := expression.Evaluate(wd)
+		if source == "close < sma(200)" {
+			if !errors.Is(err, ErrNotEnoughHistory) {
+				t.Errorf("%v error expected %v actual %v", source, ErrNotEnoughHistory, err)
+			}
+			continue
+		}
+		if err != nil || actual != matched {
+			t.Errorf("%v expected %v actual %v error %v", source, matched, actual, err)
+		}
+	}
+}
+
+func TestEvaluateExpressionWatch(t *testing.T) {
+	wd := getExpressionWatchDetail(100, 104, 98)
+
+	wd.Watch.Expression = "change_pct(1) <= -5%"
+	alerts := wd.Evaluate()
+	if len(alerts) != 1 || alerts[0].Severity != AlertSeverityWarning {
+		t.Fatalf("alerts expected %v actual %v", 1, alerts)
+	}
+	if !strings.Contains(alerts[0].Message, "matched change_pct(1) <= -5%") {
+		t.Errorf("message expected to contain the expression actual %v", alerts[0].Message)
+	}
+
+	wd.Watch.Expression = "change_pct(5) <= -5%"
+	if alerts := wd.Evaluate(); len(alerts) != 0 {
+		t.Errorf("alerts without enough history expected %v actual %v", 0, len(alerts))
+	}
+
+	wd.Watch.Expression = "close <"
+	if alerts := wd.Evaluate(); len(alerts) != 0 {
+		t.Errorf("alerts for a bad expression expected %v actual %v", 0, len(alerts))
+	}
+}
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"fmt"
+	. "github.com/shopspring/decimal"
+	"strings"
+	"sync"
+)
+
+type RoundingMode int
+
+const (
+	RoundingHalfUp RoundingMode = iota // half away from zero, what Decimal.Round does
+	RoundingBankers
+)
+
+type Locale struct {
+	ThousandsSeparator string
+	DecimalSeparator   string
+}
+
+var (
+	LocalePlain  = Locale{ThousandsSeparator: "", DecimalSeparator: "."}
+	LocaleUk     = Locale{ThousandsSeparator: ",", DecimalSeparator: "."}
+	LocaleEurope = Locale{ThousandsSeparator: ".", DecimalSeparator: ","}
+)
+
+type NumberFormat struct {
+	Precision    int32 // places rounded to
+	MinPrecision int32 // trailing zeros are trimmed down to this many places
+}
+
+type CurrencyFormat struct {
+	NumberFormat
+	Symbol       string // £, $ or p
+	SymbolSuffix bool   // symbol goes after the amount e.g. 96.44p
+	ShowCode     bool   // append the currency code e.g. 217 GBP
+}
+
+type PercentFormat struct {
+	NumberFormat
+	Signed bool // +3.03% rather than 3.03%
+	Space  bool // 3.03 % rather than 3.03%
+}
+
+type Formatter struct {
+	Locale     Locale
+	Rounding   RoundingMode
+	Currencies map[string]CurrencyFormat
+	Fallback   CurrencyFormat // for currencies not in Currencies
+	Percent    PercentFormat
+	Units      NumberFormat
+}
+
+var (
+	formatter      = NewDisplayFormatter()
+	formatterMutex sync.RWMutex
+)
+
+// SetFormatter changes the formatting used by all the Get*Desc methods, the default is NewDisplayFormatter
+func SetFormatter(f Formatter) {
+	formatterMutex.Lock()
+	defer formatterMutex.Unlock()
+	formatter = f
+}
+
+func GetFormatter() Formatter {
+	formatterMutex.RLock()
+	defer formatterMutex.RUnlock()
+	return formatter
+}
+
+// NewLegacyFormatter matches the original descriptions, 3dp with the currency code e.g. "0.964 GBP" and "3.026 %".
+// Set it with SetFormatter to keep output compared against older golden files
+func NewLegacyFormatter() Formatter {
+	legacy := NumberFormat{Precision: 3, MinPrecision: 0}
+
+	return Formatter{
+		Locale:     LocalePlain,
+		Rounding:   RoundingHalfUp,
+		Currencies: map[string]CurrencyFormat{},
+		Fallback:   CurrencyFormat{NumberFormat: legacy, ShowCode: true},
+		Percent:    PercentFormat{NumberFormat: legacy, Space: true},
+		Units:      legacy,
+	}
+}
+
+// NewDisplayFormatter is for user facing output e.g. "£1,234.56", "$10.00", "96.44p" and "+3.03%"
+func NewDisplayFormatter() Formatter {
+	cash := NumberFormat{Precision: 2, MinPrecision: 2}
+
+	return Formatter{
+		Locale:   LocaleUk,
+		Rounding: RoundingHalfUp,
+		Currencies: map[string]CurrencyFormat{
+			CURRENCY_GBP: {NumberFormat: cash, Symbol: "£"},
+			CURRENCY_USD: {NumberFormat: cash, Symbol: "$"},
+			CURRENCY_EUR: {NumberFormat: cash, Symbol: "€"},
+			CURRENCY_GBX: {NumberFormat: NumberFormat{Precision: 4, MinPrecision: 2}, Symbol: "p", SymbolSuffix: true},
+		},
+		Fallback: CurrencyFormat{NumberFormat: cash, ShowCode: true},
+		Percent:  PercentFormat{NumberFormat: cash, Signed: true},
+		Units:    NumberFormat{Precision: 4, MinPrecision: 0},
+	}
+}
+
+func (f Formatter) getCurrencyFormat(currency string) CurrencyFormat {
+	if currencyFormat, ok := f.Currencies[currency]; ok {
+		return currencyFormat
+	}
+	return f.Fallback
+}
+
+func (f Formatter) FormatMoney(m Money) string {
+	currencyFormat := f.getCurrencyFormat(m.Currency)
+
+	value := m.Value.Decimal
+	sign := ""
+	if value.IsNegative() {
+		sign = "-"
+		value = value.Abs()
+	}
+
+	number := f.FormatNumber(value, currencyFormat.NumberFormat)
+	if strings.Trim(number, "0"+f.Locale.DecimalSeparator+f.Locale.ThousandsSeparator) == "" {
+		// don't show -0.00 once rounded
+		sign = ""
+	}
+
+	var desc string
+	if currencyFormat.SymbolSuffix {
+		desc = sign + number + currencyFormat.Symbol
+	} else {
+		desc = sign + currencyFormat.Symbol + number
+	}
+
+	if currencyFormat.ShowCode {
+		desc = fmt.Sprintf("%v %v", desc, m.Currency)
+	}
+	return desc
+}
+
+// FormatPence shows a sterling amount in pence using the GBX format, other currencies are unchanged
+func (f Formatter) FormatPence(m Money) string {
+	if m.Currency != CURRENCY_GBP {
+		return f.FormatMoney(m)
+	}
+
+	pence := m.ToSubunits()
+	pence.Currency = CURRENCY_GBX
+	return f.FormatMoney(pence)
+}
+
+func (f Formatter) FormatPercent(percent Decimal) string {
+	desc := f.FormatNumber(percent, f.Percent.NumberFormat)
+	if f.Percent.Signed && percent.Round(f.Percent.Precision).IsPositive() {
+		desc = "+" + desc
+	}
+
+	if f.Percent.Space {
+		return desc + " %"
+	}
+	return desc + "%"
+}
+
+func (f Formatter) FormatUnits(units Decimal) string {
+	return f.FormatNumber(units, f.Units)
+}
+
+func (f Formatter) round(value Decimal, places int32) Decimal {
+	if f.Rounding == RoundingBankers {
+		return value.RoundBank(places)
+	}
+	return value.Round(places)
+}
+
+// FormatNumber rounds to the format's precision and applies the locale separators
+func (f Formatter) FormatNumber(value Decimal, format NumberFormat) string {
+	rounded := f.round(value, format.Precision)
+	str := rounded.StringFixed(format.Precision)
+
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign = "-"
+		str = str[1:]
+	}
+
+	integerPart := str
+	fractionPart := ""
+	if ix := strings.Index(str, "."); ix >= 0 {
+		integerPart = str[:ix]
+		fractionPart = str[ix+1:]
+	}
+
+	for int32(len(fractionPart)) > format.MinPrecision && strings.HasSuffix(fractionPart, "0") {
+		fractionPart = fractionPart[:len(fractionPart)-1]
+	}
+
+	retVal := sign + groupThousands(integerPart, f.Locale.ThousandsSeparator)
+	if len(fractionPart) > 0 {
+		retVal += f.Locale.DecimalSeparator + fractionPart
+	}
+	return retVal
+}
+
+func groupThousands(digits string, separator string) string {
+	if len(separator) == 0 || len(digits) <= 3 {
+		return digits
+	}
+
+	var builder strings.Builder
+	lead := len(digits) % 3
+	if lead > 0 {
+		builder.WriteString(digits[:lead])
+	}
+
+	for ix := lead; ix < len(digits); ix += 3 {
+		if builder.Len() > 0 {
+			builder.WriteString(separator)
+		}
+		builder.WriteString(digits[ix : ix+3])
+	}
+	return builder.String()
+}
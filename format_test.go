@@ -0,0 +1,56 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+)
+
+func TestFormatterLegacy(t *testing.T) {
+	f := NewLegacyFormatter()
+
+	testFormat(t, f.FormatMoney(FromPounds("0.9644")), "0.964 GBP")
+	testFormat(t, f.FormatMoney(FromPounds("217")), "217 GBP")
+	testFormat(t, f.FormatPercent(NewFromFloat(-3.5555)), "-3.556 %")
+}
+
+func TestFormatterDisplay(t *testing.T) {
+	f := NewDisplayFormatter()
+
+	testFormat(t, f.FormatMoney(FromPounds("1234.565")), "£1,234.57")
+	testFormat(t, f.FormatMoney(FromPounds("-1234567.5")), "-£1,234,567.50")
+	testFormat(t, f.FormatMoney(Money{Currency: CURRENCY_USD, Value: DecimalExt{NewFromInt(10)}}), "$10.00")
+	testFormat(t, f.FormatPence(FromPounds("0.96445")), "96.445p")
+	testFormat(t, f.FormatPence(FromPounds("0.9")), "90.00p")
+	testFormat(t, f.FormatPercent(NewFromFloat(3.0258)), "+3.03%")
+	testFormat(t, f.FormatPercent(NewFromFloat(-3.0258)), "-3.03%")
+	testFormat(t, f.FormatUnits(NewFromFloat(1520.5)), "1,520.5")
+
+	f.Rounding = RoundingBankers
+	testFormat(t, f.FormatMoney(FromPounds("2.345")), "£2.34")
+	f.Rounding = RoundingHalfUp
+	testFormat(t, f.FormatMoney(FromPounds("2.345")), "£2.35")
+
+	f.Locale = LocaleEurope
+	testFormat(t, f.FormatMoney(Money{Currency: CURRENCY_EUR, Value: DecimalExt{NewFromFloat(1234.5)}}), "€1.234,50")
+}
+
+func TestFormatterDefaultIsDisplay(t *testing.T) {
+	pounds := FromPounds("1234.5")
+	testFormat(t, pounds.GetDesc(), "£1,234.50")
+	testFormat(t, GetPercentDesc(NewFromFloat(3.0258)), "+3.03%")
+}
+
+// replaceFormatter sets the formatter for a test, the returned func puts the previous one back
+func replaceFormatter(f Formatter) func() {
+	saved := GetFormatter()
+	SetFormatter(f)
+	return func() {
+		SetFormatter(saved)
+	}
+}
+
+func testFormat(t *testing.T, actual string, expected string) {
+	if actual != expected {
+		t.Errorf("Format expected %v actual %v", expected, actual)
+	}
+}
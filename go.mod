@@ -10,4 +10,5 @@ require (
 	go.mongodb.org/mongo-driver v1.4.4
 	golang.org/x/net v0.0.0-20201010224723-4f7140c49acb
 	google.golang.org/genproto v0.0.0-20201030142918-24207fddd1c3
+	gopkg.in/yaml.v2 v2.2.8
 )
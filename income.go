@@ -0,0 +1,281 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+// UK tax years run from 6 April to 5 April
+const (
+	TaxYearStartMonth = time.April
+	TaxYearStartDay   = 6
+)
+
+// GetTaxYear is the calendar year the tax year containing date started in e.g. 2020 for 2020/21
+func GetTaxYear(date time.Time) int {
+	start := GetTaxYearStart(date.Year())
+	if date.Before(start) {
+		return date.Year() - 1
+	}
+	return date.Year()
+}
+
+func GetTaxYearStart(taxYear int) time.Time {
+	return time.Date(taxYear, TaxYearStartMonth, TaxYearStartDay, 0, 0, 0, 0, time.UTC)
+}
+
+// GetTaxYearEnd is the start of the following tax year, so the range is [start, end)
+func GetTaxYearEnd(taxYear int) time.Time {
+	return GetTaxYearStart(taxYear + 1)
+}
+
+func GetTaxYearDesc(taxYear int) string {
+	return fmt.Sprintf("%d/%02d", taxYear, (taxYear+1)%100)
+}
+
+func IsAccountTaxFree(accountId int) bool {
+	return accountId == AccountIdIsa
+}
+
+type IncomeEntry struct {
+	StockId   string
+	AccountId int
+	DtPaid    time.Time
+	Amount    Money
+	Type      string
+}
+
+// IncomeLedger is the dividends and distributions paid by one holding, oldest first
+type IncomeLedger struct {
+	StockId string
+	Entries []IncomeEntry
+}
+
+// getIncomeDtPaid is when income is paid for every income type, settlement if known else the trade date
+func getIncomeDtPaid(transaction Transaction) (time.Time, error) {
+	dtPaid, err := ParseDt(transaction.DtSettlement)
+	if err != nil {
+		dtPaid, err = ParseDt(transaction.DtTrade)
+	}
+	return dtPaid, err
+}
+
+func getIncomeEntry(transaction Transaction) (IncomeEntry, bool) {
+	if transaction.Ignore || !transaction.IsDividend() {
+		return IncomeEntry{}, false
+	}
+
+	dtPaid, err := getIncomeDtPaid(transaction)
+	if err != nil {
+		GetLogger().Warning("Could not parse income transaction date", "transactionId", transaction.TransactionId, "dtTrade", transaction.DtTrade, "error", err)
+		return IncomeEntry{}, false
+	}
+
+	return IncomeEntry{
+		StockId:   transaction.StockId,
+		AccountId: transaction.AccountId,
+		DtPaid:    dtPaid,
+		Amount:    transaction.ValueQuoted,
+		Type:      transaction.GetTransactionType(),
+	}, true
+}
+
+// BuildIncomeLedgers picks the dividends out of the transactions, keyed on StockId
+func BuildIncomeLedgers(transactions []Transaction) map[string]*IncomeLedger {
+	ledgers := map[string]*IncomeLedger{}
+	for _, transaction := range transactions {
+		entry, ok := getIncomeEntry(transaction)
+		if !ok {
+			continue
+		}
+
+		ledger, ok := ledgers[entry.StockId]
+		if !ok {
+			ledger = &IncomeLedger{StockId: entry.StockId}
+			ledgers[entry.StockId] = ledger
+		}
+		ledger.Entries = append(ledger.Entries, entry)
+	}
+
+	for _, ledger := range ledgers {
+		entries := ledger.Entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].DtPaid.Before(entries[j].DtPaid)
+		})
+	}
+	return ledgers
+}
+
+// GetIncomeLedger is the ledger for a holding from its own transactions
+func (holding Holding) GetIncomeLedger() IncomeLedger {
+	ledger := IncomeLedger{StockId: holding.StockId}
+	if built, ok := BuildIncomeLedgers(holding.Transactions)[holding.StockId]; ok {
+		ledger.Entries = built.Entries
+	}
+	return ledger
+}
+
+// GetIncome totals the entries paid in [from, to) in GBP
+func (ledger IncomeLedger) GetIncome(from time.Time, to time.Time) (Money, error) {
+	bag := NewMoneyBag()
+	for _, entry := range ledger.Entries {
+		if !entry.DtPaid.Before(from) && entry.DtPaid.Before(to) {
+			bag.Add(entry.Amount)
+		}
+	}
+	return bag.Total(CURRENCY_GBP)
+}
+
+// GetTrailingIncome is the income paid in the 12 months up to and including asOf
+func (ledger IncomeLedger) GetTrailingIncome(asOf time.Time) (Money, error) {
+	to := asOf.AddDate(0, 0, 1)
+	return ledger.GetIncome(to.AddDate(-1, 0, 0), to)
+}
+
+// GetYieldOnCost is the trailing 12 month income as a percent of what the current lots cost
+func (holding Holding) GetYieldOnCost(asOf time.Time) (Decimal, error) {
+	cost := holding.GetValueTotalBought()
+	if cost.IsZero() {
+		return NewFromInt(0), nil
+	}
+
+	income, err := holding.GetIncomeLedger().GetTrailingIncome(asOf)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return income.Value.Div(cost).Mul(NewFromInt(100)), nil
+}
+
+// GetCurrentYield is the trailing 12 month income as a percent of the holding valued at the stock's sell price
+func (holding Holding) GetCurrentYield(stock *Stock, asOf time.Time) (Decimal, error) {
+	value := stock.PriceSell.Mul(holding.GetUnitsTotal())
+	value, err := value.toPoundsStrict()
+	if err != nil {
+		return Decimal{}, err
+	}
+	if value.Value.IsZero() {
+		return NewFromInt(0), nil
+	}
+
+	income, err := holding.GetIncomeLedger().GetTrailingIncome(asOf)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return income.Value.Div(value.Value.Decimal).Mul(NewFromInt(100)), nil
+}
+
+type IncomeReport struct {
+	TaxYear  int
+	Accounts []IncomeAccountReport
+}
+
+// IncomeAccountReport splits an account's income for the tax return, ISA income is tax free
+type IncomeAccountReport struct {
+	AccountId int
+	Name      string
+	TaxFree   bool
+	Dividends Money
+	Interest  Money
+	Total     Money
+	Entries   []IncomeEntry
+}
+
+func (report IncomeReport) GetTaxYearDesc() string {
+	return GetTaxYearDesc(report.TaxYear)
+}
+
+// GetTaxable is the income from accounts that aren't tax free
+func (report IncomeReport) GetTaxable() (Money, error) {
+	bag := NewMoneyBag()
+	for _, account := range report.Accounts {
+		if !account.TaxFree {
+			bag.Add(account.Total)
+		}
+	}
+	return bag.Total(CURRENCY_GBP)
+}
+
+// BuildIncomeReport totals the dividends and interest paid in the tax year per account, amounts are in GBP
+func BuildIncomeReport(transactions []Transaction, taxYear int) (IncomeReport, error) {
+	from := GetTaxYearStart(taxYear)
+	to := GetTaxYearEnd(taxYear)
+
+	type accountTotals struct {
+		dividends MoneyBag
+		interest  MoneyBag
+		entries   []IncomeEntry
+	}
+	totalsByAccount := map[int]*accountTotals{}
+	getTotals := func(accountId int) *accountTotals {
+		totals, ok := totalsByAccount[accountId]
+		if !ok {
+			totals = &accountTotals{dividends: NewMoneyBag(), interest: NewMoneyBag()}
+			totalsByAccount[accountId] = totals
+		}
+		return totals
+	}
+
+	for _, transaction := range transactions {
+		if transaction.Ignore {
+			continue
+		}
+
+		if transaction.GetTransactionType() == TransactionTypeInterest {
+			dtPaid, err := getIncomeDtPaid(transaction)
+			if err == nil && !dtPaid.Before(from) && dtPaid.Before(to) {
+				getTotals(transaction.AccountId).interest.Add(transaction.ValueQuoted)
+			}
+			continue
+		}
+
+		entry, ok := getIncomeEntry(transaction)
+		if !ok || entry.DtPaid.Before(from) || !entry.DtPaid.Before(to) {
+			continue
+		}
+		totals := getTotals(entry.AccountId)
+		totals.dividends.Add(entry.Amount)
+		totals.entries = append(totals.entries, entry)
+	}
+
+	var accountIds []int
+	for accountId := range totalsByAccount {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Ints(accountIds)
+
+	report := IncomeReport{TaxYear: taxYear}
+	for _, accountId := range accountIds {
+		totals := totalsByAccount[accountId]
+		dividends, err := totals.dividends.Total(CURRENCY_GBP)
+		if err != nil {
+			return IncomeReport{}, err
+		}
+		interest, err := totals.interest.Total(CURRENCY_GBP)
+		if err != nil {
+			return IncomeReport{}, err
+		}
+		total, err := dividends.AddStrict(interest)
+		if err != nil {
+			return IncomeReport{}, err
+		}
+
+		entries := totals.entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].DtPaid.Before(entries[j].DtPaid)
+		})
+
+		report.Accounts = append(report.Accounts, IncomeAccountReport{
+			AccountId: accountId,
+			Name:      GetAccountName(accountId),
+			TaxFree:   IsAccountTaxFree(accountId),
+			Dividends: dividends,
+			Interest:  interest,
+			Total:     total,
+			Entries:   entries,
+		})
+	}
+	return report, nil
+}
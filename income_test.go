@@ -0,0 +1,130 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func getIncomeTestTransactions() []Transaction {
+	return []Transaction{
+		{StockId: "vusa", DtTrade: "2020-01-10 00:00:00", Units: DecimalExt{NewFromInt(10)}, ValueQuoted: FromPounds("-500"), AccountId: AccountIdIsa},
+		{StockId: "vusa", DtTrade: "2020-03-30 00:00:00", Reference: "Div", Description: "VUSA Dividend", ValueQuoted: FromPounds("3"), AccountId: AccountIdIsa},
+		{StockId: "vusa", DtTrade: "2020-06-30 00:00:00", Reference: "Div", Description: "VUSA Dividend", ValueQuoted: FromPounds("2"), AccountId: AccountIdIsa},
+		{StockId: "vusa", DtTrade: "2021-01-02 00:00:00", Description: "VUSA Distribution", ValueQuoted: FromPounds("3"), AccountId: AccountIdIsa},
+		{StockId: "iag", DtTrade: "2020-07-01 00:00:00", Description: "IAG Dividend", ValueQuoted: FromPounds("10"), AccountId: AccountIdShare},
+		{DtTrade: "2020-08-01 00:00:00", Reference: "Interest", ValueQuoted: FromPounds("0.5"), AccountId: AccountIdShare},
+		{StockId: "iag", DtTrade: "2020-09-01 00:00:00", Description: "IAG Dividend", ValueQuoted: FromPounds("99"), AccountId: AccountIdShare, Ignore: true},
+	}
+}
+
+func TestGetTransactionType(t *testing.T) {
+	transactions := getIncomeTestTransactions()
+
+	expected := []string{"", TransactionTypeDividend, TransactionTypeDividend, TransactionTypeDistribution, TransactionTypeDividend, TransactionTypeInterest}
+	for ix, expectedType := range expected {
+		if actual := transactions[ix].GetTransactionType(); actual != expectedType {
+			t.Errorf("Transaction %v type expected %v actual %v", ix, expectedType, actual)
+		}
+	}
+}
+
+func TestGetTaxYear(t *testing.T) {
+	if actual := GetTaxYear(time.Date(2021, 4, 5, 23, 0, 0, 0, time.UTC)); actual != 2020 {
+		t.Errorf("Tax year expected %v actual %v", 2020, actual)
+	}
+	if actual := GetTaxYear(time.Date(2021, 4, 6, 0, 0, 0, 0, time.UTC)); actual != 2021 {
+		t.Errorf("Tax year expected %v actual %v", 2021, actual)
+	}
+	if actual := GetTaxYearDesc(2099); actual != "2099/00" {
+		t.Errorf("Tax year desc expected %v actual %v", "2099/00", actual)
+	}
+}
+
+func TestHoldingYield(t *testing.T) {
+	holding := Holding{
+		StockId:      "vusa",
+		Lots:         []Lot{{StockId: "vusa", PriceBought: NewFromInt(50), Units: NewFromInt(10)}},
+		Transactions: getIncomeTestTransactions()[:4],
+	}
+	asOf := time.Date(2021, 3, 30, 0, 0, 0, 0, time.UTC)
+
+	// the March 2020 dividend is exactly a year old and drops out
+	income, err := holding.GetIncomeLedger().GetTrailingIncome(asOf)
+	if err != nil || !income.Value.Equal(NewFromInt(5)) {
+		t.Errorf("Trailing income expected %v actual %v", 5, income.GetDesc())
+	}
+
+	yieldOnCost, err := holding.GetYieldOnCost(asOf)
+	if err != nil || !yieldOnCost.Equal(NewFromInt(1)) {
+		t.Errorf("Yield on cost expected %v actual %v", 1, yieldOnCost)
+	}
+
+	stock := &Stock{PriceSell: FromPounds("25")}
+	currentYield, err := holding.GetCurrentYield(stock, asOf)
+	if err != nil || !currentYield.Equal(NewFromInt(2)) {
+		t.Errorf("Current yield expected %v actual %v", 2, currentYield)
+	}
+}
+
+func TestBuildIncomeReport(t *testing.T) {
+	report, err := BuildIncomeReport(getIncomeTestTransactions(), 2020)
+	CheckError(err)
+
+	if len(report.Accounts) != 2 {
+		t.Fatalf("Accounts expected %v actual %v", 2, len(report.Accounts))
+	}
+
+	isa := report.Accounts[0]
+	if !isa.TaxFree || !isa.Dividends.Value.Equal(NewFromInt(5)) || len(isa.Entries) != 2 {
+		t.Errorf("ISA dividends expected 5 tax free actual %v %v", isa.Dividends.GetDesc(), isa.TaxFree)
+	}
+
+	share := report.Accounts[1]
+	if share.TaxFree || !share.Dividends.Value.Equal(NewFromInt(10)) || !share.Interest.Value.Equal(NewFromFloat(0.5)) {
+		t.Errorf("Share expected dividends 10 interest 0.5 actual %v %v", share.Dividends.GetDesc(), share.Interest.GetDesc())
+	}
+
+	if taxable, err := report.GetTaxable(); err != nil || !taxable.Value.Equal(NewFromFloat(10.5)) {
+		t.Errorf("Taxable expected %v actual %v", 10.5, taxable.GetDesc())
+	}
+}
+
+func TestBuildIncomeReportDatesInterestLikeDividends(t *testing.T) {
+	// traded in 2020/21 but paid in 2021/22, both types land in the year paid
+	transactions := []Transaction{
+		{DtTrade: "2021-04-05 00:00:00", DtSettlement: "2021-04-07 00:00:00", Reference: "Interest", ValueQuoted: FromPounds("0.5"), AccountId: AccountIdShare},
+		{StockId: "iag", DtTrade: "2021-04-05 00:00:00", DtSettlement: "2021-04-07 00:00:00", Description: "IAG Dividend", ValueQuoted: FromPounds("10"), AccountId: AccountIdShare},
+	}
+
+	report, err := BuildIncomeReport(transactions, 2020)
+	CheckError(err)
+	if len(report.Accounts) != 0 {
+		t.Errorf("2020/21 expected no income actual %v", report.Accounts)
+	}
+
+	report, err = BuildIncomeReport(transactions, 2021)
+	CheckError(err)
+	if len(report.Accounts) != 1 || !report.Accounts[0].Interest.Value.Equal(NewFromFloat(0.5)) || !report.Accounts[0].Dividends.Value.Equal(NewFromInt(10)) {
+		t.Errorf("2021/22 expected dividends 10 interest 0.5 actual %v", report.Accounts)
+	}
+}
+
+func TestReplayedHoldingYield(t *testing.T) {
+	holdings, err := ReplayHoldings(getIncomeTestTransactions(), nil)
+	if err != nil {
+		t.Fatalf("Replay expected no error actual %v", err)
+	}
+	holding := holdings["vusa"]
+	asOf := time.Date(2021, 3, 30, 0, 0, 0, 0, time.UTC)
+
+	if units := holding.GetUnitsTotal(); !units.Equal(NewFromInt(10)) {
+		t.Errorf("Units expected dividends not to change the lots actual %v", units)
+	}
+	if yieldOnCost, err := holding.GetYieldOnCost(asOf); err != nil || !yieldOnCost.Equal(NewFromInt(1)) {
+		t.Errorf("Yield on cost expected %v actual %v", 1, yieldOnCost)
+	}
+	if currentYield, err := holding.GetCurrentYield(&Stock{PriceSell: FromPounds("25")}, asOf); err != nil || !currentYield.Equal(NewFromInt(2)) {
+		t.Errorf("Current yield expected %v actual %v", 2, currentYield)
+	}
+}
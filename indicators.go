@@ -0,0 +1,261 @@
+package common
+
+import (
+	"math"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const (
+	DefaultRsiPeriod       = 14
+	DefaultAtrPeriod       = 14
+	DefaultBollingerPeriod = 20
+	DefaultBollingerWidth  = 2
+	DefaultMacdFast        = 12
+	DefaultMacdSlow        = 26
+	DefaultMacdSignal      = 9
+)
+
+// Indicators take and return newest first series like PriceHistory. The output has a point for each date the
+// indicator is defined on, so the oldest period-1 dates are missing, use ByDate to line series up
+
+// ByDate keys the values on the day of each point
+func (series TimeSeries) ByDate() map[time.Time]Decimal {
+	values := make(map[time.Time]Decimal, len(series))
+	for _, point := range series {
+		values[truncateToDay(point.Date)] = point.Value
+	}
+	return values
+}
+
+// GetLatest is the newest value
+func (series TimeSeries) GetLatest() (Decimal, bool) {
+	if len(series) == 0 {
+		return Decimal{}, false
+	}
+	return series[0].Value, true
+}
+
+// getOldestFirst is the values as float64s in date order, which the calculations run in
+func (series TimeSeries) getOldestFirst() ([]time.Time, []float64) {
+	dates := make([]time.Time, len(series))
+	values := make([]float64, len(series))
+	for ix, point := range series {
+		oldestIx := len(series) - 1 - ix
+		dates[oldestIx] = point.Date
+		values[oldestIx], _ = point.Value.Float64()
+	}
+	return dates, values
+}
+
+// toSeries turns oldest first values back into a newest first series, leaving out the first skip values
+func toSeries(dates []time.Time, values []float64, skip int) TimeSeries {
+	series := TimeSeries{}
+	for ix := len(values) - 1; ix >= skip && ix >= 0; ix-- {
+		series = append(series, TimePoint{Date: dates[ix], Value: NewFromFloat(values[ix])})
+	}
+	return series
+}
+
+func getSmaValues(values []float64, period int) []float64 {
+	sma := make([]float64, len(values))
+	sum := 0.0
+	for ix, value := range values {
+		sum += value
+		if ix >= period {
+			sum -= values[ix-period]
+		}
+		if ix >= period-1 {
+			sma[ix] = sum / float64(period)
+		}
+	}
+	return sma
+}
+
+// getEmaValues is seeded with the simple average of the first period values
+func getEmaValues(values []float64, period int) []float64 {
+	ema := make([]float64, len(values))
+	if len(values) < period {
+		return ema
+	}
+
+	alpha := 2 / float64(period+1)
+	ema[period-1] = getSmaValues(values[:period], period)[period-1]
+	for ix := period; ix < len(values); ix++ {
+		ema[ix] = alpha*values[ix] + (1-alpha)*ema[ix-1]
+	}
+	return ema
+}
+
+// getWilderValues is Wilder's smoothing used by RSI and ATR, seeded with the simple average
+func getWilderValues(values []float64, period int, start int) []float64 {
+	smoothed := make([]float64, len(values))
+	if len(values)-start < period {
+		return smoothed
+	}
+
+	first := start + period - 1
+	smoothed[first] = getMean(values[start : first+1])
+	for ix := first + 1; ix < len(values); ix++ {
+		smoothed[ix] = (smoothed[ix-1]*float64(period-1) + values[ix]) / float64(period)
+	}
+	return smoothed
+}
+
+func GetSma(series TimeSeries, period int) TimeSeries {
+	dates, values := series.getOldestFirst()
+	if period <= 0 || len(values) < period {
+		return TimeSeries{}
+	}
+	return toSeries(dates, getSmaValues(values, period), period-1)
+}
+
+func GetEma(series TimeSeries, period int) TimeSeries {
+	dates, values := series.getOldestFirst()
+	if period <= 0 || len(values) < period {
+		return TimeSeries{}
+	}
+	return toSeries(dates, getEmaValues(values, period), period-1)
+}
+
+// GetRsi is Wilder's relative strength index, 0 to 100
+func GetRsi(series TimeSeries, period int) TimeSeries {
+	dates, values := series.getOldestFirst()
+	if period <= 0 || len(values) <= period {
+		return TimeSeries{}
+	}
+
+	gains := make([]float64, len(values))
+	losses := make([]float64, len(values))
+	for ix := 1; ix < len(values); ix++ {
+		change := values[ix] - values[ix-1]
+		if change > 0 {
+			gains[ix] = change
+		} else {
+			losses[ix] = -change
+		}
+	}
+
+	averageGains := getWilderValues(gains, period, 1)
+	averageLosses := getWilderValues(losses, period, 1)
+
+	rsi := make([]float64, len(values))
+	for ix := period; ix < len(values); ix++ {
+		if averageLosses[ix] == 0 {
+			rsi[ix] = 100
+			continue
+		}
+		relativeStrength := averageGains[ix] / averageLosses[ix]
+		rsi[ix] = 100 - 100/(1+relativeStrength)
+	}
+	return toSeries(dates, rsi, period)
+}
+
+type Macd struct {
+	Macd      TimeSeries // fast EMA less slow EMA
+	Signal    TimeSeries // EMA of Macd
+	Histogram TimeSeries // Macd less Signal
+}
+
+func GetMacd(series TimeSeries, fast int, slow int, signal int) Macd {
+	dates, values := series.getOldestFirst()
+	if fast <= 0 || slow <= fast || signal <= 0 || len(values) < slow+signal-1 {
+		return Macd{}
+	}
+
+	fastEma := getEmaValues(values, fast)
+	slowEma := getEmaValues(values, slow)
+
+	macd := make([]float64, len(values))
+	for ix := slow - 1; ix < len(values); ix++ {
+		macd[ix] = fastEma[ix] - slowEma[ix]
+	}
+
+	signalEma := make([]float64, len(values))
+	copy(signalEma[slow-1:], getEmaValues(macd[slow-1:], signal))
+
+	histogram := make([]float64, len(values))
+	for ix := range values {
+		histogram[ix] = macd[ix] - signalEma[ix]
+	}
+
+	signalStart := slow + signal - 2
+	return Macd{
+		Macd:      toSeries(dates, macd, slow-1),
+		Signal:    toSeries(dates, signalEma, signalStart),
+		Histogram: toSeries(dates, histogram, signalStart),
+	}
+}
+
+type BollingerBands struct {
+	Middle TimeSeries
+	Upper  TimeSeries
+	Lower  TimeSeries
+}
+
+// GetBollingerBands is the simple average with bands width population standard deviations either side
+func GetBollingerBands(series TimeSeries, period int, width float64) BollingerBands {
+	dates, values := series.getOldestFirst()
+	if period <= 0 || len(values) < period {
+		return BollingerBands{}
+	}
+
+	middle := getSmaValues(values, period)
+	upper := make([]float64, len(values))
+	lower := make([]float64, len(values))
+	for ix := period - 1; ix < len(values); ix++ {
+		sumSquares := 0.0
+		for _, value := range values[ix-period+1 : ix+1] {
+			sumSquares += (value - middle[ix]) * (value - middle[ix])
+		}
+		deviation := math.Sqrt(sumSquares / float64(period))
+		upper[ix] = middle[ix] + width*deviation
+		lower[ix] = middle[ix] - width*deviation
+	}
+
+	return BollingerBands{
+		Middle: toSeries(dates, middle, period-1),
+		Upper:  toSeries(dates, upper, period-1),
+		Lower:  toSeries(dates, lower, period-1),
+	}
+}
+
+// getPoundsRange is the high, low and close in pounds like ToTimeSeries, the high and low are converted at the rate
+// that gave the close. Without pounds populated they stay as quoted
+func (eod EodMarketStack) getPoundsRange() (float64, float64, float64) {
+	high, low, close := eod.PriceHigh, eod.PriceLow, eod.PriceClose
+	if !eod.PriceClosePounds.Value.IsZero() && !eod.PriceClose.IsZero() {
+		rate := eod.PriceClosePounds.Value.Div(eod.PriceClose)
+		high, low, close = high.Mul(rate), low.Mul(rate), eod.PriceClosePounds.Value.Decimal
+	}
+
+	highFloat, _ := high.Float64()
+	lowFloat, _ := low.Float64()
+	closeFloat, _ := close.Float64()
+	return highFloat, lowFloat, closeFloat
+}
+
+// GetAtr is Wilder's average true range in pounds like the other indicators, it needs the high and low so works on
+// the EODs
+func (history PriceHistory) GetAtr(period int) TimeSeries {
+	count := len(history.Eods)
+	if period <= 0 || count <= period {
+		return TimeSeries{}
+	}
+
+	dates := make([]time.Time, count)
+	trueRanges := make([]float64, count)
+	for ix := 1; ix < count; ix++ {
+		eod := history.Eods[count-1-ix]
+		previous := history.Eods[count-ix]
+
+		high, low, _ := eod.getPoundsRange()
+		_, _, previousClose := previous.getPoundsRange()
+
+		dates[ix] = eod.Date.Time
+		trueRanges[ix] = math.Max(high-low, math.Max(math.Abs(high-previousClose), math.Abs(low-previousClose)))
+	}
+
+	return toSeries(dates, getWilderValues(trueRanges, period, 1), period)
+}
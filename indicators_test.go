@@ -0,0 +1,62 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+// expected values are from a separate calculation over the closes in examples/iag.json
+
+func checkIndicator(t *testing.T, name string, series TimeSeries, expectedLength int, expectedLatest float64) {
+	if len(series) != expectedLength {
+		t.Errorf("%v length expected %v actual %v", name, expectedLength, len(series))
+	}
+
+	latest, ok := series.GetLatest()
+	actual, _ := latest.Float64()
+	if !ok || math.Abs(actual-expectedLatest) > 1e-9 {
+		t.Errorf("%v expected %v actual %v", name, expectedLatest, actual)
+	}
+}
+
+func TestIndicatorsIag(t *testing.T) {
+	wd := getWatchDetailUk()
+	closes := wd.History.ToTimeSeries()
+
+	checkIndicator(t, "SMA", GetSma(closes, 20), 213, 0.99332)
+	checkIndicator(t, "EMA", GetEma(closes, 12), 221, 0.9847668479183378)
+	checkIndicator(t, "RSI", GetRsi(closes, DefaultRsiPeriod), 218, 40.98897950076955)
+
+	macd := GetMacd(closes, DefaultMacdFast, DefaultMacdSlow, DefaultMacdSignal)
+	checkIndicator(t, "MACD", macd.Macd, 207, -0.07990139186285661)
+	checkIndicator(t, "MACD signal", macd.Signal, 199, -0.099564041388491)
+	checkIndicator(t, "MACD histogram", macd.Histogram, 199, 0.019662649525634388)
+
+	bands := GetBollingerBands(closes, DefaultBollingerPeriod, DefaultBollingerWidth)
+	checkIndicator(t, "Bollinger upper", bands.Upper, 213, 1.0919358932424181)
+	checkIndicator(t, "Bollinger lower", bands.Lower, 213, 0.894704106757582)
+
+	checkIndicator(t, "ATR", wd.History.GetAtr(DefaultAtrPeriod), 218, 0.09776651298552215)
+}
+
+func TestIndicatorsAligned(t *testing.T) {
+	wd := getWatchDetailUk()
+	closes := wd.History.ToTimeSeries()
+
+	sma := GetSma(closes, 20)
+	if !sma[0].Date.Equal(closes[0].Date) || !sma[len(sma)-1].Date.Equal(closes[len(sma)-1].Date) {
+		t.Errorf("SMA dates expected to match the newest closes")
+	}
+
+	byDate := GetRsi(closes, DefaultRsiPeriod).ByDate()
+	if _, ok := byDate[truncateToDay(closes[0].Date)]; !ok {
+		t.Errorf("RSI expected a value on the latest date")
+	}
+	if _, ok := byDate[truncateToDay(closes[len(closes)-1].Date)]; ok {
+		t.Errorf("RSI expected no value on the first date")
+	}
+
+	if short := GetSma(closes[:5], 20); len(short) != 0 {
+		t.Errorf("SMA of a short series expected empty actual %v", len(short))
+	}
+}
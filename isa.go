@@ -0,0 +1,174 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/shopspring/decimal"
+)
+
+var IsaAllowanceDefault = NewFromInt(20000)
+
+// IsaAllowances overrides the default for tax years with a different limit, keyed on GetTaxYear
+var IsaAllowances = map[int]Decimal{
+	2015: NewFromInt(15240),
+	2016: NewFromInt(15240),
+}
+
+// IsaQualifyingTypes are the transaction types that are new subscriptions, transfers in from another ISA aren't
+var IsaQualifyingTypes = []string{TransactionTypeInputCard, TransactionTypeInputDirectDebit, TransactionTypeInputBankTransfer}
+
+func GetIsaAllowanceLimit(taxYear int) Money {
+	limit, ok := IsaAllowances[taxYear]
+	if !ok {
+		limit = IsaAllowanceDefault
+	}
+	return Money{Currency: CURRENCY_GBP, Value: DecimalExt{limit}}
+}
+
+type IsaAllowance struct {
+	TaxYear    int
+	Limit      Money
+	Subscribed Money
+	Deposits   []Transaction
+}
+
+func (allowance IsaAllowance) GetRemaining() (Money, error) {
+	return allowance.Limit.SubStrict(allowance.Subscribed)
+}
+
+func (allowance IsaAllowance) IsExceeded() bool {
+	return allowance.Subscribed.Value.GreaterThan(allowance.Limit.Value.Decimal)
+}
+
+func (allowance IsaAllowance) String() string {
+	remaining, err := allowance.GetRemaining()
+	if err != nil {
+		return fmt.Sprintf("ISA %v subscribed %v of %v, %v", GetTaxYearDesc(allowance.TaxYear),
+			allowance.Subscribed.GetDesc(), allowance.Limit.GetDesc(), err)
+	}
+	return fmt.Sprintf("ISA %v subscribed %v of %v, remaining %v", GetTaxYearDesc(allowance.TaxYear),
+		allowance.Subscribed.GetDesc(), allowance.Limit.GetDesc(), remaining.GetDesc())
+}
+
+// IsIsaSubscription is true for money paid into the ISA that uses up allowance
+func (transaction Transaction) IsIsaSubscription() bool {
+	if transaction.Ignore || transaction.AccountId != AccountIdIsa || !transaction.ValueQuoted.Value.IsPositive() {
+		return false
+	}
+
+	transactionType := transaction.GetTransactionType()
+	for _, qualifyingType := range IsaQualifyingTypes {
+		if transactionType == qualifyingType {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIsaAllowances totals the subscriptions per tax year, keyed on GetTaxYear
+func GetIsaAllowances(transactions []Transaction) (map[int]*IsaAllowance, error) {
+	allowances := map[int]*IsaAllowance{}
+	for _, transaction := range transactions {
+		if !transaction.IsIsaSubscription() {
+			continue
+		}
+
+		dt, err := ParseDt(transaction.DtTrade)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %v date %v: %w", transaction.TransactionId, transaction.DtTrade, err)
+		}
+		taxYear := GetTaxYear(dt)
+
+		allowance, ok := allowances[taxYear]
+		if !ok {
+			allowance = newIsaAllowance(taxYear)
+			allowances[taxYear] = allowance
+		}
+		subscribed, err := allowance.Subscribed.AddStrict(transaction.ValueQuoted.toPounds())
+		if err != nil {
+			return nil, fmt.Errorf("transaction %v: %w", transaction.TransactionId, err)
+		}
+		allowance.Subscribed = subscribed
+		allowance.Deposits = append(allowance.Deposits, transaction)
+	}
+	return allowances, nil
+}
+
+func newIsaAllowance(taxYear int) *IsaAllowance {
+	return &IsaAllowance{
+		TaxYear:    taxYear,
+		Limit:      GetIsaAllowanceLimit(taxYear),
+		Subscribed: FromPounds("0"),
+	}
+}
+
+// GetIsaAllowance is the allowance used in one tax year, with nothing subscribed if there are no deposits
+func GetIsaAllowance(transactions []Transaction, taxYear int) (IsaAllowance, error) {
+	allowances, err := GetIsaAllowances(transactions)
+	if err != nil {
+		return IsaAllowance{}, err
+	}
+	if allowance, ok := allowances[taxYear]; ok {
+		return *allowance, nil
+	}
+	return *newIsaAllowance(taxYear), nil
+}
+
+// CheckIsaDeposit returns an alert if adding deposit to the existing transactions goes over that year's allowance
+func CheckIsaDeposit(transactions []Transaction, deposit Transaction) (*Alert, error) {
+	if !deposit.IsIsaSubscription() {
+		return nil, nil
+	}
+
+	dt, err := ParseDt(deposit.DtTrade)
+	if err != nil {
+		return nil, fmt.Errorf("deposit date %v: %w", deposit.DtTrade, err)
+	}
+
+	allowance, err := GetIsaAllowance(transactions, GetTaxYear(dt))
+	if err != nil {
+		return nil, err
+	}
+
+	amount := deposit.ValueQuoted.toPounds()
+	remaining, err := allowance.GetRemaining()
+	if err != nil {
+		return nil, err
+	}
+	if amount.Value.LessThanOrEqual(remaining.Value.Decimal) {
+		return nil, nil
+	}
+
+	return &Alert{
+		Message: fmt.Sprintf("ISA deposit of %v exceeds the %v allowance, %v remaining", amount.GetDesc(),
+			GetTaxYearDesc(allowance.TaxYear), remaining.GetDesc()),
+		Severity: AlertSeverityCritical,
+	}, nil
+}
+
+// GetIsaAllowanceAlerts warns about every tax year already over the allowance, oldest first
+func GetIsaAllowanceAlerts(transactions []Transaction) ([]Alert, error) {
+	allowances, err := GetIsaAllowances(transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	var taxYears []int
+	for taxYear, allowance := range allowances {
+		if allowance.IsExceeded() {
+			taxYears = append(taxYears, taxYear)
+		}
+	}
+	sort.Ints(taxYears)
+
+	var alerts []Alert
+	for _, taxYear := range taxYears {
+		allowance := allowances[taxYear]
+		alerts = append(alerts, Alert{
+			Message:  fmt.Sprintf("ISA allowance for %v exceeded, subscribed %v of %v", GetTaxYearDesc(taxYear), allowance.Subscribed.GetDesc(), allowance.Limit.GetDesc()),
+			Severity: AlertSeverityCritical,
+		})
+	}
+	return alerts, nil
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+)
+
+func getIsaDeposit(dtTrade string, amount string) Transaction {
+	return Transaction{DtTrade: dtTrade, Reference: "Card Web", ValueQuoted: FromPounds(amount), AccountId: AccountIdIsa}
+}
+
+func TestGetIsaAllowance(t *testing.T) {
+	transactions := []Transaction{
+		getIsaDeposit("2020-04-05 00:00:00", "5000"),
+		getIsaDeposit("2020-04-06 00:00:00", "15000"),
+		getIsaDeposit("2021-01-10 00:00:00", "2000"),
+		{DtTrade: "2020-05-01 00:00:00", Reference: "Card Web", ValueQuoted: FromPounds("3000"), AccountId: AccountIdShare},
+		{DtTrade: "2020-06-01 00:00:00", Reference: "Interest", ValueQuoted: FromPounds("1"), AccountId: AccountIdIsa},
+	}
+
+	allowance, err := GetIsaAllowance(transactions, 2020)
+	if err != nil {
+		t.Fatalf("Allowance expected no error actual %v", err)
+	}
+	remaining, err := allowance.GetRemaining()
+	if err != nil || !allowance.Subscribed.Value.Equal(NewFromInt(17000)) || !remaining.Value.Equal(NewFromInt(3000)) {
+		t.Errorf("2020/21 expected 17000 subscribed 3000 remaining actual %v", allowance)
+	}
+
+	previous, _ := GetIsaAllowance(transactions, 2019)
+	if !previous.Subscribed.Value.Equal(NewFromInt(5000)) {
+		t.Errorf("2019/20 expected 5000 subscribed actual %v", previous)
+	}
+
+	alert, err := CheckIsaDeposit(transactions, getIsaDeposit("2021-04-05 00:00:00", "3000"))
+	if err != nil || alert != nil {
+		t.Errorf("Deposit up to the allowance expected no alert actual %v %v", alert, err)
+	}
+
+	alert, _ = CheckIsaDeposit(transactions, getIsaDeposit("2021-04-05 00:00:00", "3000.01"))
+	if alert == nil || alert.GetSeverity() != AlertSeverityCritical {
+		t.Errorf("Deposit over the allowance expected critical alert actual %v", alert)
+	}
+
+	alerts, _ := GetIsaAllowanceAlerts(append(transactions, getIsaDeposit("2021-02-01 00:00:00", "4000")))
+	if len(alerts) != 1 {
+		t.Errorf("Exceeded years expected %v actual %v", 1, alerts)
+	}
+}
+
+func TestIsaSubscriptionMatchesWholeReference(t *testing.T) {
+	for _, reference := range []string{"DD", "DD 0042", "dd0042", "Card Web 1234"} {
+		transaction := Transaction{DtTrade: "2020-05-01 00:00:00", Reference: reference, ValueQuoted: FromPounds("100"), AccountId: AccountIdIsa}
+		if !transaction.IsIsaSubscription() {
+			t.Errorf("Reference %v expected a subscription, type %v", reference, transaction.GetTransactionType())
+		}
+	}
+
+	for _, reference := range []string{"DDTRANSFER", "Ddx1", "Card Webber"} {
+		transaction := Transaction{DtTrade: "2020-05-01 00:00:00", Reference: reference, ValueQuoted: FromPounds("100"), AccountId: AccountIdIsa}
+		if transaction.IsIsaSubscription() {
+			t.Errorf("Reference %v expected not a subscription, type %v", reference, transaction.GetTransactionType())
+		}
+	}
+}
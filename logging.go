@@ -0,0 +1,228 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+const redacted = "[REDACTED]"
+
+// minimum length of a registered secret, shorter values would redact ordinary words and numbers
+const minimumSecretLength = 4
+
+// Severity is the Cloud Logging severity name for the level
+func (level LogLevel) Severity() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "DEFAULT"
+	}
+}
+
+// Logger takes a message plus alternating key/value pairs e.g. Info("Got stocks", "count", 12)
+type Logger interface {
+	Debug(message string, keyValues ...interface{})
+	Info(message string, keyValues ...interface{})
+	Warning(message string, keyValues ...interface{})
+	Error(message string, keyValues ...interface{})
+	With(keyValues ...interface{}) Logger
+}
+
+// JsonLogger writes one JSON object per line, which Cloud Logging parses into a structured entry with severity.
+// The level is shared with the loggers made by With and can be changed while logging
+type JsonLogger struct {
+	Writer   io.Writer
+	Redactor *Redactor
+
+	level  *int32
+	mutex  *sync.Mutex
+	fields []interface{}
+}
+
+func NewJsonLogger(writer io.Writer, level LogLevel) *JsonLogger {
+	levelValue := int32(level)
+	return &JsonLogger{
+		Writer:   writer,
+		Redactor: defaultRedactor,
+		level:    &levelValue,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (l *JsonLogger) GetLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(l.level))
+}
+
+func (l *JsonLogger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *JsonLogger) Debug(message string, keyValues ...interface{}) {
+	l.log(LevelDebug, message, keyValues)
+}
+
+func (l *JsonLogger) Info(message string, keyValues ...interface{}) {
+	l.log(LevelInfo, message, keyValues)
+}
+
+func (l *JsonLogger) Warning(message string, keyValues ...interface{}) {
+	l.log(LevelWarning, message, keyValues)
+}
+
+func (l *JsonLogger) Error(message string, keyValues ...interface{}) {
+	l.log(LevelError, message, keyValues)
+}
+
+func (l *JsonLogger) With(keyValues ...interface{}) Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), keyValues...)
+	return &child
+}
+
+func (l *JsonLogger) log(level LogLevel, message string, keyValues []interface{}) {
+	if level < l.GetLevel() {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	addLogFields(entry, l.fields, l.Redactor)
+	addLogFields(entry, keyValues, l.Redactor)
+
+	entry["severity"] = level.Severity()
+	entry["message"] = l.Redactor.Redact(message)
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"severity":"ERROR","message":%q}`, "Failed to encode log entry: "+err.Error()))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = l.Writer.Write(append(line, '\n'))
+}
+
+func addLogFields(entry map[string]interface{}, keyValues []interface{}, redactor *Redactor) {
+	for ix := 0; ix < len(keyValues); ix += 2 {
+		key := fmt.Sprint(keyValues[ix])
+		if ix+1 == len(keyValues) {
+			entry[key] = "(missing value)"
+			break
+		}
+		entry[key] = toLogValue(keyValues[ix+1], redactor)
+	}
+}
+
+// toLogValue keeps numbers and bools as they are and redacts everything that ends up as text
+func toLogValue(value interface{}, redactor *Redactor) interface{} {
+	switch typed := value.(type) {
+	case nil, bool, int, int32, int64, float32, float64:
+		return typed
+	case string:
+		return redactor.Redact(typed)
+	case error:
+		return redactor.Redact(typed.Error())
+	case fmt.Stringer:
+		return redactor.Redact(typed.String())
+	default:
+		// structs are kept as nested JSON, the redacted text is still valid JSON as the marker has no quotes
+		marshaled, err := json.Marshal(typed)
+		if err != nil {
+			return redactor.Redact(fmt.Sprint(typed))
+		}
+		return json.RawMessage(redactor.Redact(string(marshaled)))
+	}
+}
+
+// Redactor removes registered secret values and credential query parameters from log output
+type Redactor struct {
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+var credentialParameter = regexp.MustCompile(`(?i)\b((?:access_key|api_key|apikey|token|password)=)[^&\s"']+`)
+
+var defaultRedactor = &Redactor{}
+
+// RegisterSecretValue makes every logger redact value, secrets are registered as they are loaded
+func RegisterSecretValue(value string) {
+	defaultRedactor.AddSecret(value)
+}
+
+func (redactor *Redactor) AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minimumSecretLength {
+		return
+	}
+
+	redactor.mutex.Lock()
+	defer redactor.mutex.Unlock()
+
+	for _, existing := range redactor.secrets {
+		if existing == value {
+			return
+		}
+	}
+	redactor.secrets = append(redactor.secrets, value)
+	// longest first so a secret containing another is removed whole
+	sort.Slice(redactor.secrets, func(i, j int) bool {
+		return len(redactor.secrets[i]) > len(redactor.secrets[j])
+	})
+}
+
+func (redactor *Redactor) Redact(message string) string {
+	if redactor == nil {
+		return message
+	}
+
+	redactor.mutex.RLock()
+	for _, secret := range redactor.secrets {
+		message = strings.Replace(message, secret, redacted, -1)
+	}
+	redactor.mutex.RUnlock()
+
+	return credentialParameter.ReplaceAllString(message, "${1}"+redacted)
+}
+
+var defaultLogger = NewJsonLogger(os.Stdout, LevelInfo)
+
+var logger Logger = defaultLogger
+
+func GetLogger() Logger {
+	return logger
+}
+
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// configureLogging turns on debug output for the default logger from the loaded config
+func configureLogging(cfg *Config) {
+	if cfg.Debug {
+		defaultLogger.SetLevel(LevelDebug)
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestJsonLoggerRedactsSecrets(t *testing.T) {
+	redactor := &Redactor{}
+	redactor.AddSecret("s3cr3t-password")
+
+	buf := new(bytes.Buffer)
+	logger := NewJsonLogger(buf, LevelInfo)
+	logger.Redactor = redactor
+
+	logger.Debug("not written at info level")
+	logger.With("stock", "TSLA").Warning("Fetching http://api.marketstack.com/v1/eod?symbols=TSLA&access_key=abcdef123456&limit=5",
+		"password", "s3cr3t-password",
+		"count", 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line actual %v", lines)
+	}
+
+	var entry map[string]interface{}
+	CheckError(json.Unmarshal([]byte(lines[0]), &entry))
+
+	if entry["severity"] != "WARNING" || entry["stock"] != "TSLA" || entry["count"] != float64(3) {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+
+	expectedMessage := "Fetching http://api.marketstack.com/v1/eod?symbols=TSLA&access_key=[REDACTED]&limit=5"
+	if entry["message"] != expectedMessage {
+		t.Errorf("Expected message %v actual %v", expectedMessage, entry["message"])
+	}
+	if entry["password"] != redacted {
+		t.Errorf("Expected registered secret redacted actual %v", entry["password"])
+	}
+}
+
+func TestJsonLoggerSetLevelWhileLogging(t *testing.T) {
+	logger := NewJsonLogger(ioutil.Discard, LevelInfo)
+	child := logger.With("stock", "TSLA")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			child.Debug("racing the level change")
+		}
+		done <- true
+	}()
+	logger.SetLevel(LevelDebug)
+	<-done
+
+	if level := child.(*JsonLogger).GetLevel(); level != LevelDebug {
+		t.Errorf("Child level expected %v actual %v", LevelDebug, level)
+	}
+}
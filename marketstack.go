@@ -23,15 +23,17 @@ type RequestEndOfDay struct {
 }
 
 func (request *RequestEndOfDay) GetUrl() string {
+	return request.GetUrlConfig(GetConfig())
+}
+
+func (request *RequestEndOfDay) GetUrlConfig(cfg *Config) string {
 	symbols := strings.Join(request.Symbols, ",")
 	dateFromStr := request.DateFrom.Format(TimeFormatRequest)
 	dateToStr := request.DateTo.Format(TimeFormatRequest)
 
-	token := GetSecret(EnvSecretTokenMarketStack)
-
 	return fmt.Sprintf("http://api.marketstack.com/v1/eod?symbols=%v&access_key=%v&date_from=%v&date_to=%v&limit=%v",
 		symbols,
-		token,
+		cfg.TokenMarketStack,
 		dateFromStr,
 		dateToStr,
 		request.Limit)
@@ -54,7 +56,7 @@ func (resp *ResponseMarketStack) PopulateUsablePrice(stock *Stock) {
 
 func (resp *ResponseMarketStack) GetExchange() string {
 	if len(resp.Data) == 0 {
-		Log("No EODs on ResponseMarketData")
+		GetLogger().Warning("No EODs on ResponseMarketStack")
 		return ""
 	}
 
@@ -72,8 +74,8 @@ func QueryEndOfDayMarketStack(client HttpSource, request RequestEndOfDay) Respon
 
 	url := request.GetUrl()
 
-	log := fmt.Sprintf("QueryEndOfDayMarketStack price history for %v from URL: %v", request.Symbols, url)
-	Log(log)
+	log := GetLogger().With("symbols", request.Symbols)
+	log.Info("QueryEndOfDayMarketStack price history", "url", url)
 
 	response, err := client.HttpGet(url)
 	CheckError(err)
@@ -88,8 +90,7 @@ func QueryEndOfDayMarketStack(client HttpSource, request RequestEndOfDay) Respon
 	responseData, err := ioutil.ReadAll(response.Body)
 	CheckError(err)
 
-	responseString := string(responseData)
-	Log(responseString)
+	log.Debug("MarketStack EOD response", "body", string(responseData))
 
 	var retval ResponseMarketStack
 	err = json.Unmarshal(responseData, &retval)
@@ -98,36 +99,118 @@ func QueryEndOfDayMarketStack(client HttpSource, request RequestEndOfDay) Respon
 	return retval
 }
 
+type ResponseTickerMarketStack struct {
+	Name          string                   `json:"name"`
+	Symbol        string                   `json:"symbol"`
+	PriceCurrency string                   `json:"price_currency"` // the line's own quote currency, GBp for pence
+	StockExchange StockExchangeMarketStack `json:"stock_exchange"`
+}
+
+type StockExchangeMarketStack struct {
+	Name     string              `json:"name"`
+	Acronym  string              `json:"acronym"`
+	Mic      string              `json:"mic"`
+	Country  string              `json:"country"`
+	Currency CurrencyMarketStack `json:"currency"`
+}
+
+type CurrencyMarketStack struct {
+	Code   string `json:"code"`
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
+}
+
+// GetQuoteCurrency is the currency the ticker's prices are in.
+// MarketStack reports the LSE as GBP at exchange level whether a line is quoted in pence, GBP or USD, so the ticker's
+// price currency decides. Without one the LSE falls back to the exchange default of pence
+func (ticker *ResponseTickerMarketStack) GetQuoteCurrency() string {
+	code := ticker.PriceCurrency
+
+	switch {
+	case code == "GBp" || strings.ToUpper(code) == CURRENCY_GBX:
+		return CURRENCY_GBX
+	case len(code) > 0:
+		return strings.ToUpper(code)
+	case len(ticker.StockExchange.Currency.Code) == 0 || ticker.StockExchange.Mic == ExchangeLondon:
+		return GetDefaultQuoteCurrency(ticker.StockExchange.Mic)
+	default:
+		return strings.ToUpper(ticker.StockExchange.Currency.Code)
+	}
+}
+
+func getTickerUrl(symbol string, token string) string {
+	return fmt.Sprintf("http://api.marketstack.com/v1/tickers/%v?access_key=%v", symbol, token)
+}
+
+func QueryTickerMarketStack(client HttpSource, symbol string) ResponseTickerMarketStack {
+	url := getTickerUrl(symbol, GetConfig().TokenMarketStack)
+
+	response, err := client.HttpGet(url)
+	CheckError(err)
+
+	defer response.Body.Close()
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	CheckError(err)
+
+	var retval ResponseTickerMarketStack
+	err = json.Unmarshal(responseData, &retval)
+	CheckError(err)
+
+	return retval
+}
+
+// PopulateQuoteCurrency looks up the quote currency from MarketStack ticker metadata if it isn't already set
+func (stock *Stock) PopulateQuoteCurrency(client HttpSource) {
+	if len(stock.QuoteCurrency) > 0 || stock.IsSourceHl() {
+		return
+	}
+
+	ticker := QueryTickerMarketStack(client, stock.Symbol)
+	stock.QuoteCurrency = ticker.GetQuoteCurrency()
+	if len(stock.Exchange) == 0 {
+		stock.Exchange = ticker.StockExchange.Mic
+	}
+}
+
 func (eod *EodMarketStack) GetPriceCloseDesc() string {
 	return eod.PriceClosePounds.GetDesc()
 }
 
 type PriceHistory struct {
 	Eods []EodMarketStack
+	AppliedActions []string // ApplyCorporateActions keys for the actions already in the closes
 }
 
 type EodMarketStack struct {
 	Date             timeMarketStack `json:"date"`
+	PriceOpen	Decimal	`json:"open"`
+	PriceHigh	Decimal	`json:"high"`
+	PriceLow	Decimal	`json:"low"`
 	PriceClose	Decimal	`json:"close"`
+	PriceAdjClose Decimal `json:"adj_close"` // close adjusted for later splits and dividends
+	Volume	Decimal	`json:"volume"`
 	Exchange string `json:"exchange"`
 	PriceClosePounds Money         `json:"-"`
 }
 
 func (eod *EodMarketStack) Dump() {
-	LogDebug(eod.Date.Format("06 Jan 02") + " " + eod.PriceClosePounds.GetDesc())
+	GetLogger().Debug("EOD", "date", eod.Date.Format("06 Jan 02"), "close", eod.PriceClosePounds.GetDesc())
 }
 
 func (eod *EodMarketStack) PopulateUsablePrice(stock *Stock) {
-	if strings.Contains(stock.Exchange, ExchangeUsa) {
-		usd := Money{
-			Currency: CURRENCY_USD,
-			Value:    DecimalExt{ eod.PriceClose},
-		}
-		eod.PriceClosePounds = usd.toPounds()
+	CheckError(eod.populateUsablePrice(stock))
+}
 
-	} else {
-		eod.PriceClosePounds =  FromPence(eod.PriceClose.String())
+// populateUsablePrice returns the error when the quote currency can't be converted rather than panicking
+func (eod *EodMarketStack) populateUsablePrice(stock *Stock) error {
+	quoted := FromQuote(eod.PriceClose, stock.GetQuoteCurrency())
+	pounds, err := quoted.toPoundsStrict()
+	if err != nil {
+		return err
 	}
+	eod.PriceClosePounds = pounds
+	return nil
 }
 
 type timeMarketStack struct {
@@ -136,10 +219,16 @@ type timeMarketStack struct {
 
 const TimeFormatMarketStack = "2006-01-02T03:04:05+0000"
 
+// UnmarshalJSON also reads RFC 3339, which is how the time marshals back out e.g. from the API
 func (t *timeMarketStack) UnmarshalJSON(buf []byte) error {
-	tt, err := time.Parse(TimeFormatMarketStack, strings.Trim(string(buf), `"`))
+	value := strings.Trim(string(buf), `"`)
+	tt, err := time.Parse(TimeFormatMarketStack, value)
 	if err != nil {
-		return err
+		var errRfc error
+		tt, errRfc = time.Parse(time.RFC3339, value)
+		if errRfc != nil {
+			return err
+		}
 	}
 	t.Time = tt
 	return nil
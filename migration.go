@@ -0,0 +1,464 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	. "github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the MySQL schema only ever held sterling amounts, in pounds
+const LegacyCurrency = CURRENCY_GBP
+
+const (
+	queryLegacyStocks       = "SELECT StockId, Description, HlName, HlUrlOverride, Symbol FROM stock"
+	queryLegacyWatches      = "SELECT WatchId, StockId, DtReference, AddedPriceBuy, AddedPriceSell, AlertThreshold, Notes, DtAdded, WatchType, DtStop FROM watch"
+	queryLegacyTransactions = "SELECT TransactionId, StockId, DtTrade, DtSettlement, UnitPrice, Units, ValueQuoted, `Ignore`, Description, Reference, AccountId FROM `transaction`"
+)
+
+// LegacyMigration copies the MySQL stock, watch and transaction tables into Mongo.
+// Documents are matched on their legacy id so running it again updates rather than duplicates,
+// and only the migrated fields are written so anything added on the Mongo side is kept
+type LegacyMigration struct {
+	Source *sql.DB
+	Target *mongo.Database
+}
+
+type MigrationReport struct {
+	Tables []MigrationTableReport
+}
+
+type MigrationTableReport struct {
+	Table           string
+	RowsSource      int
+	DocumentsTarget int64
+	Inserted        int
+	Updated         int
+	Mismatches      []string
+}
+
+func (report MigrationReport) IsVerified() bool {
+	for _, table := range report.Tables {
+		if !table.IsVerified() {
+			return false
+		}
+	}
+	return true
+}
+
+func (table MigrationTableReport) IsVerified() bool {
+	return int64(table.RowsSource) == table.DocumentsTarget && len(table.Mismatches) == 0
+}
+
+func (report MigrationReport) String() string {
+	var builder strings.Builder
+	for _, table := range report.Tables {
+		builder.WriteString(fmt.Sprintf("%v: %v rows in MySQL, %v documents in Mongo, %v inserted, %v updated, %v mismatches\n",
+			table.Table,
+			table.RowsSource,
+			table.DocumentsTarget,
+			table.Inserted,
+			table.Updated,
+			len(table.Mismatches)))
+
+		for _, mismatch := range table.Mismatches {
+			builder.WriteString("  " + mismatch + "\n")
+		}
+	}
+	return builder.String()
+}
+
+// MigrateLegacy opens MySQL through ConnectDb and Mongo through ConnectDbMongo and runs the migration
+func MigrateLegacy() (MigrationReport, error) {
+	sqlDb := ConnectDb()
+	defer sqlDb.Close()
+
+	dbClient, mongoDb := ConnectDbMongo()
+	defer DisconnectMongoDb(dbClient)
+
+	migration := LegacyMigration{
+		Source: sqlDb,
+		Target: mongoDb,
+	}
+
+	report, err := migration.Run(context.TODO())
+	GetLogger().Info("Legacy migration finished", "verified", report.IsVerified(), "report", report.String())
+	return report, err
+}
+
+func (migration *LegacyMigration) Run(ctx context.Context) (MigrationReport, error) {
+	var report MigrationReport
+
+	stocks, err := readLegacyStocks(migration.Source)
+	if err != nil {
+		return report, err
+	}
+	stockReport, err := migration.migrateStocks(ctx, stocks)
+	if err != nil {
+		return report, err
+	}
+
+	stockIds, err := migration.getStockIdsByLegacyId(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	watches, err := readLegacyWatches(migration.Source)
+	if err != nil {
+		return report, err
+	}
+	watchReport, err := migration.migrateWatches(ctx, watches, stockIds)
+	if err != nil {
+		return report, err
+	}
+
+	transactions, err := readLegacyTransactions(migration.Source)
+	if err != nil {
+		return report, err
+	}
+	transactionReport, err := migration.migrateTransactions(ctx, transactions, stockIds)
+	if err != nil {
+		return report, err
+	}
+
+	report.Tables = []MigrationTableReport{stockReport, watchReport, transactionReport}
+
+	err = migration.verify(ctx, &report, stocks, watches, transactions)
+	return report, err
+}
+
+func readLegacyStocks(db *sql.DB) ([]Stock, error) {
+	rows, err := db.Query(queryLegacyStocks)
+	if err != nil {
+		return nil, fmt.Errorf("query legacy stocks: %w", err)
+	}
+	defer rows.Close()
+
+	var stocks []Stock
+	for rows.Next() {
+		var stock Stock
+		var description, hlName, hlUrlOverride, symbol sql.NullString
+		err = rows.Scan(&stock.StockIdLegacy, &description, &hlName, &hlUrlOverride, &symbol)
+		if err != nil {
+			return nil, fmt.Errorf("scan legacy stock: %w", err)
+		}
+
+		stock.Description = description.String
+		stock.HlName = hlName.String
+		stock.HlUrlOverride = hlUrlOverride.String
+		stock.Symbol = symbol.String
+		stocks = append(stocks, stock)
+	}
+	return stocks, rows.Err()
+}
+
+func readLegacyWatches(db *sql.DB) ([]Watch, error) {
+	rows, err := db.Query(queryLegacyWatches)
+	if err != nil {
+		return nil, fmt.Errorf("query legacy watches: %w", err)
+	}
+	defer rows.Close()
+
+	var watches []Watch
+	for rows.Next() {
+		var watch Watch
+		var dtReference, notes, dtAdded, dtStop sql.NullString
+		var priceBuy, priceSell, threshold NullDecimal
+		var watchType sql.NullInt64
+		err = rows.Scan(&watch.WatchIdLegacy, &watch.StockIdLegacy, &dtReference, &priceBuy, &priceSell, &threshold, &notes, &dtAdded, &watchType, &dtStop)
+		if err != nil {
+			return nil, fmt.Errorf("scan legacy watch: %w", err)
+		}
+
+		watch.DtReference = dtReference.String
+		watch.AddedPriceBuy = fromLegacyMoney(priceBuy)
+		watch.AddedPriceSell = fromLegacyMoney(priceSell)
+		watch.AlertThreshold = DecimalExt{fromLegacyDecimal(threshold)}
+		watch.Notes = notes.String
+		watch.DtAdded = dtAdded.String
+		watch.WatchType = int(watchType.Int64)
+		watch.DtStop = dtStop.String
+		watches = append(watches, watch)
+	}
+	return watches, rows.Err()
+}
+
+func readLegacyTransactions(db *sql.DB) ([]Transaction, error) {
+	rows, err := db.Query(queryLegacyTransactions)
+	if err != nil {
+		return nil, fmt.Errorf("query legacy transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var transactions []Transaction
+	for rows.Next() {
+		var transaction Transaction
+		var stockId, accountId sql.NullInt64
+		var dtTrade, dtSettlement, description, reference sql.NullString
+		var unitPrice, units, valueQuoted NullDecimal
+		var ignore sql.NullBool
+		err = rows.Scan(&transaction.TransactionIdLegacy, &stockId, &dtTrade, &dtSettlement, &unitPrice, &units, &valueQuoted, &ignore, &description, &reference, &accountId)
+		if err != nil {
+			return nil, fmt.Errorf("scan legacy transaction: %w", err)
+		}
+
+		transaction.StockIdLegacy = int(stockId.Int64)
+		transaction.DtTrade = dtTrade.String
+		transaction.DtSettlement = dtSettlement.String
+		transaction.UnitPrice = fromLegacyMoney(unitPrice)
+		transaction.Units = DecimalExt{fromLegacyDecimal(units)}
+		transaction.ValueQuoted = fromLegacyMoney(valueQuoted)
+		transaction.Ignore = ignore.Bool
+		transaction.Description = description.String
+		transaction.Reference = reference.String
+		transaction.AccountId = int(accountId.Int64)
+		transactions = append(transactions, transaction)
+	}
+	return transactions, rows.Err()
+}
+
+func fromLegacyDecimal(value NullDecimal) Decimal {
+	if !value.Valid {
+		return NewFromInt(0)
+	}
+	return value.Decimal
+}
+
+func fromLegacyMoney(value NullDecimal) Money {
+	return Money{
+		Currency: LegacyCurrency,
+		Value:    DecimalExt{fromLegacyDecimal(value)},
+	}
+}
+
+func upsertLegacy(ctx context.Context, collection *mongo.Collection, legacyIdField string, legacyId int, fields bson.M, tableReport *MigrationTableReport) error {
+	filter := bson.M{legacyIdField: legacyId}
+	update := bson.M{"$set": fields}
+
+	result, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("upsert %v %v: %w", legacyIdField, legacyId, err)
+	}
+
+	tableReport.addUpsert(result)
+	return nil
+}
+
+// addUpsert counts a row as inserted the first time it is migrated and updated on every run after
+func (table *MigrationTableReport) addUpsert(result *mongo.UpdateResult) {
+	if result.UpsertedCount > 0 {
+		table.Inserted++
+	} else {
+		table.Updated++
+	}
+}
+
+func (migration *LegacyMigration) migrateStocks(ctx context.Context, stocks []Stock) (MigrationTableReport, error) {
+	tableReport := MigrationTableReport{Table: CollectionStock, RowsSource: len(stocks)}
+	collection := migration.Target.Collection(CollectionStock)
+
+	for _, stock := range stocks {
+		fields := bson.M{
+			"description":   stock.Description,
+			"hlname":        stock.HlName,
+			"UrlOverride":   stock.HlUrlOverride,
+			"symbol":        stock.Symbol,
+			"stockidlegacy": stock.StockIdLegacy,
+		}
+
+		err := upsertLegacy(ctx, collection, "stockidlegacy", stock.StockIdLegacy, fields, &tableReport)
+		if err != nil {
+			return tableReport, err
+		}
+	}
+	return tableReport, nil
+}
+
+func (migration *LegacyMigration) getStockIdsByLegacyId(ctx context.Context) (map[int]string, error) {
+	documents, err := findLegacyDocuments(ctx, migration.Target.Collection(CollectionStock), "stockidlegacy")
+	if err != nil {
+		return nil, err
+	}
+
+	stockIds := map[int]string{}
+	for legacyId, raw := range documents {
+		var stock Stock
+		if err = bson.UnmarshalWithRegistry(BsonRegistry, raw, &stock); err != nil {
+			return nil, err
+		}
+		stockIds[legacyId] = stock.StockId
+	}
+	return stockIds, nil
+}
+
+func (migration *LegacyMigration) migrateWatches(ctx context.Context, watches []Watch, stockIds map[int]string) (MigrationTableReport, error) {
+	tableReport := MigrationTableReport{Table: CollectionWatch, RowsSource: len(watches)}
+	collection := migration.Target.Collection(CollectionWatch)
+
+	for _, watch := range watches {
+		stockId, ok := stockIds[watch.StockIdLegacy]
+		if !ok {
+			tableReport.addMismatch("watch %v references unknown stock %v", watch.WatchIdLegacy, watch.StockIdLegacy)
+		}
+
+		fields := bson.M{
+			"stockid":        stockId,
+			"dtreference":    watch.DtReference,
+			"addedpricebuy":  watch.AddedPriceBuy,
+			"addedpricesell": watch.AddedPriceSell,
+			"alertthreshold": watch.AlertThreshold,
+			"notes":          watch.Notes,
+			"dtadded":        watch.DtAdded,
+			"watchtype":      watch.WatchType,
+			"dtstop":         watch.DtStop,
+			"stockidlegacy":  watch.StockIdLegacy,
+			"watchidlegacy":  watch.WatchIdLegacy,
+		}
+
+		err := upsertLegacy(ctx, collection, "watchidlegacy", watch.WatchIdLegacy, fields, &tableReport)
+		if err != nil {
+			return tableReport, err
+		}
+	}
+	return tableReport, nil
+}
+
+func (migration *LegacyMigration) migrateTransactions(ctx context.Context, transactions []Transaction, stockIds map[int]string) (MigrationTableReport, error) {
+	tableReport := MigrationTableReport{Table: CollectionTransaction, RowsSource: len(transactions)}
+	collection := migration.Target.Collection(CollectionTransaction)
+
+	for _, transaction := range transactions {
+		// fees, interest and deposits have no stock
+		stockId := ""
+		if transaction.StockIdLegacy != 0 {
+			var ok bool
+			stockId, ok = stockIds[transaction.StockIdLegacy]
+			if !ok {
+				tableReport.addMismatch("transaction %v references unknown stock %v", transaction.TransactionIdLegacy, transaction.StockIdLegacy)
+			}
+		}
+
+		fields := bson.M{
+			"stockid":             stockId,
+			"dttrade":             transaction.DtTrade,
+			"dtsettlement":        transaction.DtSettlement,
+			"unitprice":           transaction.UnitPrice,
+			"units":               transaction.Units,
+			"valuequoted":         transaction.ValueQuoted,
+			"ignore":              transaction.Ignore,
+			"description":         transaction.Description,
+			"reference":           transaction.Reference,
+			"accountid":           transaction.AccountId,
+			"transactionidlegacy": transaction.TransactionIdLegacy,
+			"stockidlegacy":       transaction.StockIdLegacy,
+		}
+
+		err := upsertLegacy(ctx, collection, "transactionidlegacy", transaction.TransactionIdLegacy, fields, &tableReport)
+		if err != nil {
+			return tableReport, err
+		}
+	}
+	return tableReport, nil
+}
+
+// findLegacyDocuments returns every migrated document keyed on its legacy id
+func findLegacyDocuments(ctx context.Context, collection *mongo.Collection, legacyIdField string) (map[int]bson.Raw, error) {
+	cursor, err := collection.Find(ctx, bson.M{legacyIdField: bson.M{"$gt": 0}})
+	if err != nil {
+		return nil, fmt.Errorf("find migrated %v: %w", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	documents := map[int]bson.Raw{}
+	for cursor.Next(ctx) {
+		var legacyId int
+		if err = cursor.Current.Lookup(legacyIdField).Unmarshal(&legacyId); err != nil {
+			return nil, err
+		}
+		documents[legacyId] = append(bson.Raw{}, cursor.Current...)
+	}
+	return documents, cursor.Err()
+}
+
+func (migration *LegacyMigration) verify(ctx context.Context, report *MigrationReport, stocks []Stock, watches []Watch, transactions []Transaction) error {
+	stockReport := &report.Tables[0]
+	stockDocs, err := findLegacyDocuments(ctx, migration.Target.Collection(CollectionStock), "stockidlegacy")
+	if err != nil {
+		return err
+	}
+	stockReport.DocumentsTarget = int64(len(stockDocs))
+
+	for _, stock := range stocks {
+		var migrated Stock
+		found, err := decodeLegacyDocument(stockDocs, stock.StockIdLegacy, &migrated)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			stockReport.addMismatch("stock %v missing from Mongo", stock.StockIdLegacy)
+		} else if migrated.Symbol != stock.Symbol || migrated.Description != stock.Description || migrated.HlName != stock.HlName {
+			stockReport.addMismatch("stock %v differs, MySQL %v %v Mongo %v %v", stock.StockIdLegacy, stock.Symbol, stock.GetDisplayName(), migrated.Symbol, migrated.GetDisplayName())
+		}
+	}
+
+	watchReport := &report.Tables[1]
+	watchDocs, err := findLegacyDocuments(ctx, migration.Target.Collection(CollectionWatch), "watchidlegacy")
+	if err != nil {
+		return err
+	}
+	watchReport.DocumentsTarget = int64(len(watchDocs))
+
+	for _, watch := range watches {
+		var migrated Watch
+		found, err := decodeLegacyDocument(watchDocs, watch.WatchIdLegacy, &migrated)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			watchReport.addMismatch("watch %v missing from Mongo", watch.WatchIdLegacy)
+		} else if !migrated.AddedPriceBuy.Value.Equal(watch.AddedPriceBuy.Value.Decimal) || !migrated.AlertThreshold.Equal(watch.AlertThreshold.Decimal) || migrated.StockIdLegacy != watch.StockIdLegacy {
+			watchReport.addMismatch("watch %v differs, MySQL %v %v Mongo %v %v", watch.WatchIdLegacy, watch.AddedPriceBuy.GetDesc(), watch.AlertThreshold, migrated.AddedPriceBuy.GetDesc(), migrated.AlertThreshold)
+		}
+	}
+
+	transactionReport := &report.Tables[2]
+	transactionDocs, err := findLegacyDocuments(ctx, migration.Target.Collection(CollectionTransaction), "transactionidlegacy")
+	if err != nil {
+		return err
+	}
+	transactionReport.DocumentsTarget = int64(len(transactionDocs))
+
+	for _, transaction := range transactions {
+		var migrated Transaction
+		found, err := decodeLegacyDocument(transactionDocs, transaction.TransactionIdLegacy, &migrated)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			transactionReport.addMismatch("transaction %v missing from Mongo", transaction.TransactionIdLegacy)
+		} else if !migrated.ValueQuoted.Value.Equal(transaction.ValueQuoted.Value.Decimal) || !migrated.Units.Equal(transaction.Units.Decimal) || migrated.AccountId != transaction.AccountId {
+			transactionReport.addMismatch("transaction %v differs, MySQL %v x %v Mongo %v x %v", transaction.TransactionIdLegacy, transaction.Units, transaction.ValueQuoted.GetDesc(), migrated.Units, migrated.ValueQuoted.GetDesc())
+		}
+	}
+	return nil
+}
+
+func decodeLegacyDocument(documents map[int]bson.Raw, legacyId int, target interface{}) (bool, error) {
+	raw, ok := documents[legacyId]
+	if !ok {
+		return false, nil
+	}
+	return true, bson.UnmarshalWithRegistry(BsonRegistry, raw, target)
+}
+
+func (table *MigrationTableReport) addMismatch(format string, args ...interface{}) {
+	table.Mismatches = append(table.Mismatches, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"testing"
+)
+
+func TestFromLegacyMoney(t *testing.T) {
+	money := fromLegacyMoney(NullDecimal{Decimal: NewFromFloat(1.234), Valid: true})
+	if money.Currency != CURRENCY_GBP || !money.Value.Equal(NewFromFloat(1.234)) {
+		t.Errorf("Legacy money expected 1.234 GBP actual %v", money.GetDesc())
+	}
+
+	// NULL columns migrate as zero rather than failing the row
+	money = fromLegacyMoney(NullDecimal{})
+	if money.Currency != CURRENCY_GBP || !money.Value.IsZero() {
+		t.Errorf("Legacy NULL money expected 0 GBP actual %v", money.GetDesc())
+	}
+
+	if value := fromLegacyDecimal(NullDecimal{}); !value.IsZero() {
+		t.Errorf("Legacy NULL decimal expected 0 actual %v", value)
+	}
+	if value := fromLegacyDecimal(NullDecimal{Decimal: NewFromInt(-5), Valid: true}); !value.Equal(NewFromInt(-5)) {
+		t.Errorf("Legacy decimal expected -5 actual %v", value)
+	}
+}
+
+func TestMigrationReportIsVerified(t *testing.T) {
+	report := MigrationReport{Tables: []MigrationTableReport{
+		{Table: CollectionStock, RowsSource: 2, DocumentsTarget: 2, Inserted: 2},
+		{Table: CollectionWatch, RowsSource: 1, DocumentsTarget: 1, Updated: 1},
+	}}
+	if !report.IsVerified() {
+		t.Errorf("Report expected verified actual\n%v", report)
+	}
+
+	expected := "stock: 2 rows in MySQL, 2 documents in Mongo, 2 inserted, 0 updated, 0 mismatches\n"
+	if actual := report.String(); !strings.HasPrefix(actual, expected) {
+		t.Errorf("Report expected to start %v actual\n%v", expected, actual)
+	}
+
+	report.Tables[1].DocumentsTarget = 2
+	if report.IsVerified() {
+		t.Errorf("Report with an extra document expected not verified")
+	}
+
+	report.Tables[1].DocumentsTarget = 1
+	report.Tables[1].addMismatch("watch %v missing from Mongo", 7)
+	if report.IsVerified() {
+		t.Errorf("Report with a mismatch expected not verified")
+	}
+	if actual := report.String(); !strings.Contains(actual, "1 mismatches\n  watch 7 missing from Mongo\n") {
+		t.Errorf("Report expected to list the mismatch actual\n%v", actual)
+	}
+}
+
+func TestMigrationRerunCountsUpdates(t *testing.T) {
+	first := MigrationTableReport{Table: CollectionStock, RowsSource: 2}
+	first.addUpsert(&mongo.UpdateResult{UpsertedCount: 1, UpsertedID: "a"})
+	first.addUpsert(&mongo.UpdateResult{UpsertedCount: 1, UpsertedID: "b"})
+	if first.Inserted != 2 || first.Updated != 0 {
+		t.Errorf("First run expected 2 inserted 0 updated actual %v %v", first.Inserted, first.Updated)
+	}
+
+	// the second run matches the documents the first inserted, unchanged rows still count as updated
+	second := MigrationTableReport{Table: CollectionStock, RowsSource: 2}
+	second.addUpsert(&mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1})
+	second.addUpsert(&mongo.UpdateResult{MatchedCount: 1})
+	if second.Inserted != 0 || second.Updated != 2 {
+		t.Errorf("Second run expected 0 inserted 2 updated actual %v %v", second.Inserted, second.Updated)
+	}
+}
+
+func TestDecodeLegacyDocument(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"StockIdLegacy": 3, "Description": "IAG"})
+	CheckError(err)
+	documents := map[int]bson.Raw{3: raw}
+
+	var stock Stock
+	found, err := decodeLegacyDocument(documents, 3, &stock)
+	if !found || err != nil || stock.Description != "IAG" {
+		t.Errorf("Legacy document expected IAG actual %v %v %v", found, err, stock)
+	}
+
+	if found, err = decodeLegacyDocument(documents, 4, &stock); found || err != nil {
+		t.Errorf("Missing legacy document expected not found actual %v %v", found, err)
+	}
+}
@@ -2,33 +2,65 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	. "github.com/shopspring/decimal"
-	"go.mongodb.org/mongo-driver/bson"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 )
 
 const (
 	CURRENCY_GBP = "GBP"
 	CURRENCY_USD = "USD"
+	CURRENCY_EUR = "EUR"
+	CURRENCY_GBX = "GBX" // pence sterling, only ever a quote currency, Money is always held in GBP
 )
 
-var currencyConverter = make(map[string]Decimal)
+// currencyConverter caches the rates fetched so far for the process, read and written under currencyConverterMutex
+var (
+	currencyConverter      = make(map[string]Decimal)
+	currencyConverterMutex sync.RWMutex
+)
+
+// StrictCurrencyChecks makes the legacy Add, Sub and Div panic on mismatched currencies rather than just logging.
+// They stay lenient for the legacy callers, everything else uses AddStrict, SubStrict and DivStrict
+var StrictCurrencyChecks = false
+
+var ErrCurrencyMismatch = errors.New("currency mismatch")
 
 type Money struct {
 	Currency string
 	Value DecimalExt // always in units e.g pound, dollar not pence, cent
 }
 
-func cacheConversion(from string, to string) {
-	key := getConversionKey(from, to)
-	conversion := GetConversionValue(from, to)
-	currencyConverter[key] = conversion
+// getConversion is the cached rate, a rate not cached yet is fetched and cached both ways.
+// Two callers missing at once both fetch, which is harmless, rather than holding the lock over the request
+func getConversion(from string, to string) (Decimal, error) {
+	currencyConverterMutex.RLock()
+	conversion, contains := currencyConverter[getConversionKey(from, to)]
+	currencyConverterMutex.RUnlock()
+	if contains {
+		return conversion, nil
+	}
+
+	conversion, err := getConversionValueConfig(GetConfig(), from, to)
+	if err != nil {
+		return Decimal{}, err
+	}
+	cacheConversion(from, to, conversion)
+	return conversion, nil
+}
+
+func cacheConversion(from string, to string, conversion Decimal) {
+	currencyConverterMutex.Lock()
+	defer currencyConverterMutex.Unlock()
 
+	currencyConverter[getConversionKey(from, to)] = conversion
 	//and put reverse in too
-	reverseKey := getConversionKey(to, from)
-	currencyConverter[reverseKey] = NewFromInt(1).Div(conversion)
+	currencyConverter[getConversionKey(to, from)] = NewFromInt(1).Div(conversion)
 }
 
 func (from Money) toPounds() Money {
@@ -36,24 +68,30 @@ func (from Money) toPounds() Money {
 }
 
 func (from Money) toCurrency(toCurrency string) Money {
-	if from.Currency == toCurrency {
-		return from
-	}
+	converted, err := from.toCurrencyStrict(toCurrency)
+	CheckError(err)
+	return converted
+}
 
-	key := getConversionKey(from.Currency, toCurrency)
+func (from Money) toPoundsStrict() (Money, error) {
+	return from.toCurrencyStrict(CURRENCY_GBP)
+}
 
-	if _, contains := currencyConverter[key]; !contains {
-		cacheConversion(from.Currency, toCurrency)
+// toCurrencyStrict returns the error when the rate can't be fetched rather than panicking
+func (from Money) toCurrencyStrict(toCurrency string) (Money, error) {
+	if from.Currency == toCurrency {
+		return from, nil
 	}
 
-	conversion := currencyConverter[key]
-
-	targetValue := from.Value.Mul(conversion)
+	conversion, err := getConversion(from.Currency, toCurrency)
+	if err != nil {
+		return Money{}, err
+	}
 
 	return Money{
 		Currency: toCurrency,
-		Value:    DecimalExt{targetValue},
-	}
+		Value:    DecimalExt{from.Value.Mul(conversion)},
+	}, nil
 }
 
 func (this Money) Add(other Money) Money {
@@ -68,9 +106,151 @@ func (this Money) Add(other Money) Money {
 
 func checkCurrency(this Money, other Money) {
 	if this.Currency != other.Currency {
+		if StrictCurrencyChecks {
+			CheckError(checkCurrencyStrict(this, other))
+		}
 		//panic("Incompatible currencies " + this.Currency + " " + other.Currency)
-		Log("Incompatible currencies " + this.String() + " " + other.String())
+		GetLogger().Warning("Incompatible currencies", "this", this.String(), "other", other.String())
+	}
+}
+
+// checkCurrencyStrict allows an unset zero value on either side so sums can start from Money{}
+func checkCurrencyStrict(this Money, other Money) error {
+	if this.Currency == other.Currency || this.isUnset() || other.isUnset() {
+		return nil
+	}
+	return fmt.Errorf("%w: %v and %v", ErrCurrencyMismatch, this.String(), other.String())
+}
+
+func (m Money) isUnset() bool {
+	return len(m.Currency) == 0 && m.Value.IsZero()
+}
+
+func getResultCurrency(this Money, other Money) string {
+	if this.isUnset() {
+		return other.Currency
+	}
+	return this.Currency
+}
+
+// AddStrict adds other, returning ErrCurrencyMismatch rather than combining different currencies
+func (this Money) AddStrict(other Money) (Money, error) {
+	if err := checkCurrencyStrict(this, other); err != nil {
+		return Money{}, err
+	}
+
+	return Money{
+		Currency: getResultCurrency(this, other),
+		Value:    DecimalExt{this.Value.Add(other.Value.Decimal)},
+	}, nil
+}
+
+func (this Money) SubStrict(other Money) (Money, error) {
+	if err := checkCurrencyStrict(this, other); err != nil {
+		return Money{}, err
+	}
+
+	return Money{
+		Currency: getResultCurrency(this, other),
+		Value:    DecimalExt{this.Value.Sub(other.Value.Decimal)},
+	}, nil
+}
+
+func (this Money) DivStrict(other Money) (Decimal, error) {
+	if err := checkCurrencyStrict(this, other); err != nil {
+		return Decimal{}, err
+	}
+	if other.Value.IsZero() {
+		return Decimal{}, errors.New("division by zero " + other.String())
+	}
+
+	return this.Value.Div(other.Value.Decimal), nil
+}
+
+// MoneyBag holds amounts in several currencies without converting between them until totalled
+type MoneyBag struct {
+	amounts map[string]Decimal
+}
+
+func NewMoneyBag(amounts ...Money) MoneyBag {
+	bag := MoneyBag{amounts: map[string]Decimal{}}
+	for _, amount := range amounts {
+		bag.Add(amount)
+	}
+	return bag
+}
+
+func (bag *MoneyBag) Add(amount Money) {
+	if amount.isUnset() {
+		return
+	}
+	if bag.amounts == nil {
+		bag.amounts = map[string]Decimal{}
+	}
+
+	current, ok := bag.amounts[amount.Currency]
+	if !ok {
+		current = NewFromInt(0)
+	}
+	bag.amounts[amount.Currency] = current.Add(amount.Value.Decimal)
+}
+
+func (bag *MoneyBag) AddBag(other MoneyBag) {
+	for _, currency := range other.Currencies() {
+		bag.Add(other.Get(currency))
+	}
+}
+
+func (bag MoneyBag) Get(currency string) Money {
+	value, ok := bag.amounts[currency]
+	if !ok {
+		value = NewFromInt(0)
+	}
+
+	return Money{
+		Currency: currency,
+		Value:    DecimalExt{value},
+	}
+}
+
+func (bag MoneyBag) Currencies() []string {
+	currencies := make([]string, 0, len(bag.amounts))
+	for currency := range bag.amounts {
+		currencies = append(currencies, currency)
 	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+func (bag MoneyBag) IsEmpty() bool {
+	return len(bag.amounts) == 0
+}
+
+// Total converts every amount into reportingCurrency through the cached exchange rates and sums them, an error
+// when a rate can't be fetched
+func (bag MoneyBag) Total(reportingCurrency string) (Money, error) {
+	total := Money{
+		Currency: reportingCurrency,
+		Value:    DecimalExt{NewFromInt(0)},
+	}
+
+	for _, currency := range bag.Currencies() {
+		converted, err := bag.Get(currency).toCurrencyStrict(reportingCurrency)
+		if err != nil {
+			return Money{}, err
+		}
+		total.Value = DecimalExt{total.Value.Add(converted.Value.Decimal)}
+	}
+	return total, nil
+}
+
+func (bag MoneyBag) String() string {
+	descs := make([]string, 0, len(bag.amounts))
+	for _, currency := range bag.Currencies() {
+		amount := bag.Get(currency)
+		descs = append(descs, amount.GetDesc())
+	}
+	return fmt.Sprint(descs)
 }
 
 func getConversionKey(from string, to string) string {
@@ -92,71 +272,74 @@ func getLastWorkingDay() time.Time {
 }
 
 func GetConversionValue(from string, to string) Decimal {
+	return GetConversionValueConfig(GetConfig(), from, to)
+}
+
+func GetConversionValueConfig(cfg *Config, from string, to string) Decimal {
+	conversion, err := getConversionValueConfig(cfg, from, to)
+	CheckError(err)
+	return conversion
+}
+
+func getConversionValueConfig(cfg *Config, from string, to string) (Decimal, error) {
 	//weekdayStr := getLastWorkingDay().Format("2006-01-02")
 
 	url := "http://api.exchangeratesapi.io/v1/latest?" +
-		"access_key=" + GetSecret(EnvSecretRateApiKey) +
+		"access_key=" + cfg.RateApiKey +
 		"&symbols=" + from + "," + to
 
-	Log(url)
+	GetLogger().Debug("Getting conversion rate", "from", from, "to", to, "url", url)
 
 	response, err := http.Get(url)
-	CheckError(err)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("conversion %v to %v: %w", from, to, err)
+	}
 
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return Decimal{}, fmt.Errorf("conversion %v to %v: status %v", from, to, response.StatusCode)
+	}
+
 	responseData, err := ioutil.ReadAll(response.Body)
-	CheckError(err)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("conversion %v to %v: %w", from, to, err)
+	}
 
-	return parseRateFromResponse(responseData, from, to)
+	return parseRate(responseData, from, to)
 }
 
 func parseRateFromResponse(responseData []byte, from string, to string) Decimal {
-	responseString := string(responseData)
-	Log(responseString)
-
-	var retval map[string]interface{}
-	err := json.Unmarshal(responseData, &retval)
+	conversion, err := parseRate(responseData, from, to)
 	CheckError(err)
-
-	//conversion := retval["rates"].(map[string]interface{})[weekdayStr].(map[string]interface{})[to].(float64)
-
-	conversionFromEuros := retval["rates"].(map[string]interface{})
-	fromInEuros := conversionFromEuros[from].(float64)
-	toInEuros := conversionFromEuros[to].(float64)
-
-	conversion := toInEuros / fromInEuros
-
-	return NewFromFloat(conversion)
+	return conversion
 }
 
+// parseRate is the rate from the rates against the euro, an error when either currency is missing
+func parseRate(responseData []byte, from string, to string) (Decimal, error) {
+	GetLogger().Debug("Conversion rate response", "from", from, "to", to, "body", string(responseData))
 
-func (w Money) MarshalBSON() ([]byte, error) {
-	intermediate := make(map[string]string)
-	intermediate["value"] = w.Value.String()
-	intermediate["currency"] = w.Currency
-
-	return bson.Marshal(intermediate)
-}
+	var retval struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.Unmarshal(responseData, &retval); err != nil {
+		return Decimal{}, fmt.Errorf("conversion %v to %v: %w", from, to, err)
+	}
 
-// SetBSON implements bson.Setter.
-func (w *Money) UnmarshalBSON(raw []byte) error {
+	//conversion := retval["rates"].(map[string]interface{})[weekdayStr].(map[string]interface{})[to].(float64)
 
-	var decoded map[string]string
-	bsonErr := bson.Unmarshal(raw, &decoded)
-	if bsonErr != nil {
-		return bsonErr
+	fromInEuros := retval.Rates[from]
+	toInEuros := retval.Rates[to]
+	if fromInEuros <= 0 || toInEuros <= 0 {
+		return Decimal{}, fmt.Errorf("conversion %v to %v: no rate in the response", from, to)
 	}
 
-	pounds, err := NewFromString(decoded["value"])
-	CheckError(err)
-	currency := decoded["currency"]
+	conversion := toInEuros / fromInEuros
 
-	w.Currency = currency
-	w.Value = DecimalExt{pounds}
-	return nil
+	return NewFromFloat(conversion), nil
 }
 
+
 func FromCents(centsStr string) Money {
 	cents, err := NewFromString(centsStr)
 	CheckError(err)
@@ -177,6 +360,18 @@ func FromPence(penceStr string) Money {
 	}
 }
 
+// FromQuote converts a price quoted by an exchange into Money, pence quotes become pounds
+func FromQuote(price Decimal, quoteCurrency string) Money {
+	if quoteCurrency == CURRENCY_GBX {
+		return FromPence(price.String())
+	}
+
+	return Money{
+		Currency: quoteCurrency,
+		Value:    DecimalExt{price},
+	}
+}
+
 func (m Money) ToSubunits() Money {
 	return Money{
 		Currency: m.Currency,
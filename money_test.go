@@ -0,0 +1,180 @@
+package common
+
+import (
+	"errors"
+	. "github.com/shopspring/decimal"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestMoneyStrictArithmetic(t *testing.T) {
+	pounds := FromPounds("10.50")
+	morePounds := FromPounds("2.25")
+	dollars := Money{
+		Currency: CURRENCY_USD,
+		Value:    DecimalExt{NewFromInt(3)},
+	}
+
+	sum, err := pounds.AddStrict(morePounds)
+	if err != nil || sum.Currency != CURRENCY_GBP || !sum.Value.Equal(NewFromFloat(12.75)) {
+		t.Errorf("Expected 12.75 GBP actual %v error %v", sum.GetDesc(), err)
+	}
+
+	difference, err := pounds.SubStrict(morePounds)
+	if err != nil || !difference.Value.Equal(NewFromFloat(8.25)) {
+		t.Errorf("Expected 8.25 GBP actual %v error %v", difference.GetDesc(), err)
+	}
+
+	if _, err = pounds.AddStrict(dollars); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Expected currency mismatch adding GBP to USD, got %v", err)
+	}
+
+	if _, err = pounds.DivStrict(dollars); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Expected currency mismatch dividing GBP by USD, got %v", err)
+	}
+
+	fromZero, err := Money{}.AddStrict(dollars)
+	if err != nil || fromZero.Currency != CURRENCY_USD {
+		t.Errorf("Expected unset money to take currency of other, got %v error %v", fromZero.GetDesc(), err)
+	}
+}
+
+func TestMoneyBagTotal(t *testing.T) {
+	rate, _ := NewFromString("0.5")
+	defer replaceConversions(map[string]Decimal{getConversionKey(CURRENCY_USD, CURRENCY_GBP): rate})()
+
+	bag := NewMoneyBag(FromPounds("100"), FromPounds("50"))
+	bag.Add(Money{
+		Currency: CURRENCY_USD,
+		Value:    DecimalExt{NewFromInt(30)},
+	})
+
+	if currencies := bag.Currencies(); len(currencies) != 2 {
+		t.Errorf("Expected 2 currencies actual %v", currencies)
+	}
+
+	gbp := bag.Get(CURRENCY_GBP)
+	if !gbp.Value.Equal(NewFromInt(150)) {
+		t.Errorf("Expected 150 GBP actual %v", gbp.GetDesc())
+	}
+
+	total, err := bag.Total(CURRENCY_GBP)
+	if err != nil || total.Currency != CURRENCY_GBP || !total.Value.Equal(NewFromInt(165)) {
+		t.Errorf("Expected total 165 GBP actual %v error %v", total.GetDesc(), err)
+	}
+}
+
+// replaceConversions sets the cached rates for a test, the returned func puts the previous cache back
+func replaceConversions(rates map[string]Decimal) func() {
+	currencyConverterMutex.Lock()
+	defer currencyConverterMutex.Unlock()
+
+	saved := currencyConverter
+	currencyConverter = map[string]Decimal{}
+	for key, rate := range rates {
+		currencyConverter[key] = rate
+	}
+	return func() {
+		currencyConverterMutex.Lock()
+		defer currencyConverterMutex.Unlock()
+		currencyConverter = saved
+	}
+}
+
+// replaceConfig sets the package config for a test, the returned func puts the previous one back
+func replaceConfig(cfg *Config) func() {
+	configMutex.Lock()
+	saved := config
+	configMutex.Unlock()
+
+	SetConfig(cfg)
+	return func() {
+		SetConfig(saved)
+	}
+}
+
+// rateTransport answers every request with the example exchange rates, or with status when it isn't 200
+type rateTransport struct {
+	status int
+}
+
+func (transport rateTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	if transport.status != http.StatusOK {
+		recorder.WriteHeader(transport.status)
+		return recorder.Result(), nil
+	}
+
+	data, err := ioutil.ReadFile("examples/exchangeratesapiresponse.json")
+	if err != nil {
+		return nil, err
+	}
+	recorder.Write(data)
+	return recorder.Result(), nil
+}
+
+// replaceTransport sends the package's HTTP requests through transport until the returned func is called
+func replaceTransport(transport http.RoundTripper) func() {
+	saved := http.DefaultTransport
+	http.DefaultTransport = transport
+	return func() {
+		http.DefaultTransport = saved
+	}
+}
+
+func TestConversionConcurrent(t *testing.T) {
+	defer replaceConversions(nil)()
+	defer replaceConfig(&Config{RateApiKey: "test-key"})()
+	defer replaceTransport(rateTransport{status: http.StatusOK})()
+
+	dollars := Money{Currency: CURRENCY_USD, Value: DecimalExt{NewFromInt(1)}}
+	var wait sync.WaitGroup
+	results := make([]Money, 20)
+	errs := make([]error, len(results))
+	for ix := range results {
+		wait.Add(1)
+		go func(ix int) {
+			defer wait.Done()
+			results[ix], errs[ix] = dollars.toPoundsStrict()
+		}(ix)
+	}
+	wait.Wait()
+
+	for ix, result := range results {
+		if errs[ix] != nil || result.Currency != CURRENCY_GBP || result.Value.String() != "0.7294744891099758" {
+			t.Errorf("Conversion expected 0.7294744891099758 GBP actual %v error %v", result.GetDesc(), errs[ix])
+		}
+	}
+}
+
+func TestConversionFailureIsAnError(t *testing.T) {
+	defer replaceConversions(nil)()
+	defer replaceConfig(&Config{RateApiKey: "test-key"})()
+	defer replaceTransport(rateTransport{status: http.StatusInternalServerError})()
+
+	dollars := Money{Currency: CURRENCY_USD, Value: DecimalExt{NewFromInt(1)}}
+	if _, err := dollars.toPoundsStrict(); err == nil {
+		t.Errorf("Conversion expected an error when the rate can't be fetched")
+	}
+
+	currencyConverterMutex.RLock()
+	cached := len(currencyConverter)
+	currencyConverterMutex.RUnlock()
+	if cached != 0 {
+		t.Errorf("Conversion expected nothing cached after a failure actual %v", cached)
+	}
+}
+
+func TestMoneyBagTotalConversionFailure(t *testing.T) {
+	defer replaceConversions(nil)()
+	defer replaceConfig(&Config{RateApiKey: "test-key"})()
+	defer replaceTransport(rateTransport{status: http.StatusInternalServerError})()
+
+	bag := NewMoneyBag(FromPounds("100"), Money{Currency: CURRENCY_USD, Value: DecimalExt{NewFromInt(30)}})
+	if _, err := bag.Total(CURRENCY_GBP); err == nil {
+		t.Errorf("Total expected an error when the rate can't be fetched")
+	}
+}
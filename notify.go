@@ -0,0 +1,302 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChatStyleSlack    = "slack"
+	ChatStyleTelegram = "telegram"
+
+	HeaderWebhookSignature = "X-Tracker-Signature"
+	HeaderWebhookTimestamp = "X-Tracker-Timestamp"
+)
+
+type Notification struct {
+	UserId    string
+	Subject   string
+	PlainText string
+	Html      string
+	Alerts    []Alert
+}
+
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// EmailNotifier goes through the existing email queue, Pub/Sub or the local URL_EMAIL_QUEUE
+type EmailNotifier struct {
+	Config     *Config
+	SenderName string
+}
+
+func (notifier *EmailNotifier) Notify(notification Notification) error {
+	email := MessageSendEmail{
+		Html:       notification.Html,
+		PlainText:  notification.PlainText,
+		SenderName: notifier.SenderName,
+		Subject:    notification.Subject,
+	}
+
+	cfg := notifier.Config
+	if cfg == nil {
+		cfg = GetConfig()
+	}
+	return sendEmail(cfg, email)
+}
+
+// WebhookNotifier posts the notification as JSON signed with HMAC-SHA256 over "<timestamp>.<body>"
+type WebhookNotifier struct {
+	Url    string
+	Secret string
+	Client *http.Client
+}
+
+type webhookPayload struct {
+	UserId    string
+	Subject   string
+	PlainText string
+	Alerts    []Alert
+}
+
+func (notifier *WebhookNotifier) Notify(notification Notification) error {
+	body, err := json.Marshal(webhookPayload{
+		UserId:    notification.UserId,
+		Subject:   notification.Subject,
+		PlainText: notification.PlainText,
+		Alerts:    notification.Alerts,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	headers := map[string]string{
+		HeaderWebhookTimestamp: timestamp,
+		HeaderWebhookSignature: SignWebhookPayload(notifier.Secret, timestamp, body),
+	}
+	return postJson(notifier.Client, notifier.Url, body, headers)
+}
+
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature is for receivers, comparing in constant time
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string) bool {
+	expected := SignWebhookPayload(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// ChatNotifier posts a text message to a Slack incoming webhook or the Telegram sendMessage url
+type ChatNotifier struct {
+	Url    string
+	Style  string
+	ChatId string // telegram only
+	Client *http.Client
+}
+
+func (notifier *ChatNotifier) Notify(notification Notification) error {
+	text := notification.Subject
+	if len(notification.PlainText) > 0 {
+		text += "\n\n" + notification.PlainText
+	}
+
+	var payload interface{}
+	switch notifier.Style {
+	case ChatStyleSlack:
+		payload = map[string]interface{}{
+			"text": text,
+		}
+	case ChatStyleTelegram:
+		payload = map[string]interface{}{
+			"chat_id":                  notifier.ChatId,
+			"text":                     text,
+			"disable_web_page_preview": true,
+		}
+	default:
+		return fmt.Errorf("unknown chat style %v", notifier.Style)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postJson(notifier.Client, notifier.Url, body, nil)
+}
+
+// FileNotifier appends each notification as a line of JSON, for local runs and tests
+type FileNotifier struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+func (notifier *FileNotifier) Notify(notification Notification) error {
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	file, err := os.OpenFile(notifier.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func postJson(client *http.Client, url string, body []byte, headers map[string]string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := ioutil.ReadAll(response.Body)
+	GetLogger().Debug("Posted JSON", "url", url, "status", response.Status, "body", string(responseBody))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("post to %v failed with %v", GetRedactedUrl(url), response.Status)
+	}
+	return nil
+}
+
+// GetRedactedUrl is for error messages, which aren't passed through the logger's redaction
+func GetRedactedUrl(url string) string {
+	return defaultRedactor.Redact(url)
+}
+
+// NotificationRoute sends a user's alerts at or above MinSeverity to the named channel, an empty UserId matches everyone
+type NotificationRoute struct {
+	UserId      string
+	MinSeverity int
+	Channel     string
+}
+
+func (route NotificationRoute) matches(userId string, alert Alert) bool {
+	if len(route.UserId) > 0 && route.UserId != userId {
+		return false
+	}
+	return alert.GetSeverity() >= route.MinSeverity
+}
+
+type NotificationRouter struct {
+	Channels map[string]Notifier
+	Routes   []NotificationRoute
+}
+
+// NotifyError collects the failures of every channel, the other channels are still notified
+type NotifyError struct {
+	Failures map[string]error
+}
+
+func (err *NotifyError) Error() string {
+	var descs []string
+	for channel, failure := range err.Failures {
+		descs = append(descs, channel+": "+failure.Error())
+	}
+	return "notify failed for " + strings.Join(descs, "; ")
+}
+
+// Dispatch sends each channel one notification containing only the alerts routed to it, rendered as the alert email.
+// If the email can't be rendered the alerts still go out as plain text
+func (router *NotificationRouter) Dispatch(userId string, subject string, alerts []Alert) error {
+	var channelOrder []string
+	alertsByChannel := map[string][]Alert{}
+
+	for _, alert := range alerts {
+		routedTo := map[string]bool{}
+		for _, route := range router.Routes {
+			if !route.matches(userId, alert) || routedTo[route.Channel] {
+				continue
+			}
+			routedTo[route.Channel] = true
+
+			if _, seen := alertsByChannel[route.Channel]; !seen {
+				channelOrder = append(channelOrder, route.Channel)
+			}
+			alertsByChannel[route.Channel] = append(alertsByChannel[route.Channel], alert)
+		}
+	}
+
+	failures := map[string]error{}
+	for _, channel := range channelOrder {
+		notifier, ok := router.Channels[channel]
+		if !ok {
+			failures[channel] = fmt.Errorf("no notifier for channel %v", channel)
+			continue
+		}
+
+		channelAlerts := alertsByChannel[channel]
+		notification := Notification{
+			UserId:    userId,
+			Subject:   subject,
+			PlainText: GetAlertsPlainText(channelAlerts),
+			Alerts:    channelAlerts,
+		}
+
+		email, err := RenderAlertEmail(subject, channelAlerts, nil)
+		if err != nil {
+			GetLogger().Warning("Sending notification as plain text", "channel", channel, "error", err)
+		} else {
+			notification.PlainText = email.PlainText
+			notification.Html = email.Html
+		}
+
+		if err := notifier.Notify(notification); err != nil {
+			GetLogger().Error("Notification failed", "channel", channel, "userId", userId, "error", err)
+			failures[channel] = err
+		}
+	}
+
+	if len(failures) > 0 {
+		return &NotifyError{Failures: failures}
+	}
+	return nil
+}
+
+func GetAlertsPlainText(alerts []Alert) string {
+	var lines []string
+	for _, alert := range alerts {
+		line := alert.Message
+		if alert.Stock != nil {
+			line = alert.Stock.GetDisplayName() + ": " + line
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebhookNotifierSigns(t *testing.T) {
+	secret := "webhook-secret"
+	verified := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		verified = VerifyWebhookSignature(secret, r.Header.Get(HeaderWebhookTimestamp), body, r.Header.Get(HeaderWebhookSignature))
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{Url: server.URL, Secret: secret}
+	err := notifier.Notify(Notification{UserId: "user1", Subject: "Alerts"})
+	if err != nil {
+		t.Errorf("Webhook expected no error actual %v", err)
+	}
+	if !verified {
+		t.Errorf("Webhook signature expected verified")
+	}
+
+	if VerifyWebhookSignature("other", "1", []byte("{}"), SignWebhookPayload(secret, "1", []byte("{}"))) {
+		t.Errorf("Webhook signature with wrong secret expected not verified")
+	}
+}
+
+func TestWebhookNotifierFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{Url: server.URL}
+	if err := notifier.Notify(Notification{}); err == nil {
+		t.Errorf("Webhook expected error for 500")
+	}
+}
+
+func TestChatNotifierPayload(t *testing.T) {
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	notifier := &ChatNotifier{Url: server.URL, Style: ChatStyleTelegram, ChatId: "42"}
+	err := notifier.Notify(Notification{Subject: "Alerts", PlainText: "VUSA: below target"})
+	if err != nil {
+		t.Errorf("Chat expected no error actual %v", err)
+	}
+
+	expected := "Alerts\n\nVUSA: below target"
+	if payload["chat_id"] != "42" || payload["text"] != expected {
+		t.Errorf("Telegram payload expected %v actual %v", expected, payload)
+	}
+}
+
+func TestNotificationRouterDispatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	CheckError(err)
+	defer os.RemoveAll(dir)
+
+	allPath := filepath.Join(dir, "all.jsonl")
+	criticalPath := filepath.Join(dir, "critical.jsonl")
+
+	router := &NotificationRouter{
+		Channels: map[string]Notifier{
+			"all":      &FileNotifier{Path: allPath},
+			"critical": &FileNotifier{Path: criticalPath},
+		},
+		Routes: []NotificationRoute{
+			{UserId: "user1", MinSeverity: AlertSeverityInfo, Channel: "all"},
+			{MinSeverity: AlertSeverityCritical, Channel: "critical"},
+		},
+	}
+
+	alerts := []Alert{
+		{Message: "info"},
+		{Message: "critical", Severity: AlertSeverityCritical},
+	}
+
+	err = router.Dispatch("user1", "Alerts", alerts)
+	if err != nil {
+		t.Errorf("Dispatch expected no error actual %v", err)
+	}
+	err = router.Dispatch("user2", "Alerts", alerts)
+	if err != nil {
+		t.Errorf("Dispatch expected no error actual %v", err)
+	}
+
+	all, _ := ioutil.ReadFile(allPath)
+	if lines := strings.Count(string(all), "\n"); lines != 1 {
+		t.Errorf("All channel notifications expected %v actual %v", 1, lines)
+	}
+
+	critical, _ := ioutil.ReadFile(criticalPath)
+	if lines := strings.Count(string(critical), "\n"); lines != 2 {
+		t.Errorf("Critical channel notifications expected %v actual %v", 2, lines)
+	}
+	if !strings.Contains(string(critical), `"Html":"\u003c`) {
+		t.Errorf("Critical channel expected the HTML email actual %v", string(critical))
+	}
+	if strings.Contains(string(critical), `"info"`) {
+		t.Errorf("Critical channel expected no info alerts actual %v", string(critical))
+	}
+
+	router.Routes = append(router.Routes, NotificationRoute{Channel: "missing"})
+	if err = router.Dispatch("user1", "Alerts", alerts); err == nil {
+		t.Errorf("Dispatch to missing channel expected error")
+	}
+}
+
+func TestNotificationsOmitPriceUrl(t *testing.T) {
+	stock := &Stock{StockId: "tsla", Symbol: "TSLA", Url: "http://api.marketstack.com/v1/eod?symbols=TSLA&access_key=secret-token"}
+	notification := Notification{UserId: "user1", Subject: "Alerts", Alerts: []Alert{{Stock: stock, Message: "moved"}}}
+
+	var posted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posted = string(body)
+	}))
+	defer server.Close()
+
+	if err := (&WebhookNotifier{Url: server.URL}).Notify(notification); err != nil {
+		t.Fatalf("Webhook expected no error actual %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "notify")
+	CheckError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.jsonl")
+	if err = (&FileNotifier{Path: path}).Notify(notification); err != nil {
+		t.Fatalf("File expected no error actual %v", err)
+	}
+	written, _ := ioutil.ReadFile(path)
+
+	for name, payload := range map[string]string{"webhook": posted, "file": string(written)} {
+		if !strings.Contains(payload, "tsla") {
+			t.Errorf("%v payload expected the alert actual %v", name, payload)
+		}
+		if strings.Contains(payload, "access_key") || strings.Contains(payload, "secret-token") {
+			t.Errorf("%v payload expected no price url actual %v", name, payload)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/shopspring/decimal"
+)
+
+// RebalanceTarget is the weights for the stocks (AllocationByStock) or the asset classes (AllocationByAssetClass).
+// Asset class weights are spread over the stocks already held in that class in proportion to their value
+type RebalanceTarget struct {
+	Dimension string
+	Weights   TargetAllocation
+}
+
+type RebalanceInput struct {
+	Valuation     PortfolioValuation // valued with cash, see ValuePortfolio
+	Holdings      []Holding
+	Stocks        map[string]*Stock // with PriceBuy and PriceSell
+	Target        RebalanceTarget
+	AvailableCash Money // new money to invest, paid into the ISA
+	MinTradeValue Money
+}
+
+type RebalanceOrder struct {
+	StockId       string
+	Name          string
+	AccountId     int
+	IsBuy         bool
+	Units         Decimal
+	Price         Money
+	Value         Money
+	EstimatedGain Money // capital gain of a share account sell at average cost
+}
+
+type RebalancePlan struct {
+	Orders        []RebalanceOrder
+	CashBefore    Money
+	CashAfter     Money
+	EstimatedGain Money // total gain triggered in the share account
+}
+
+func (order RebalanceOrder) String() string {
+	action := "Sell"
+	if order.IsBuy {
+		action = "Buy"
+	}
+	return fmt.Sprintf("%v %v %v in %v at %v = %v", action, GetFormatter().FormatUnits(order.Units), order.Name,
+		GetAccountName(order.AccountId), GetFormatter().FormatMoney(order.Price), GetFormatter().FormatMoney(order.Value))
+}
+
+// rebalanceAccountOrder is the order accounts are traded in, the ISA first as it has no capital gains
+func rebalanceAccountOrder(accountIds []int) []int {
+	sort.Slice(accountIds, func(i, j int) bool {
+		rankI, rankJ := getRebalanceAccountRank(accountIds[i]), getRebalanceAccountRank(accountIds[j])
+		if rankI != rankJ {
+			return rankI < rankJ
+		}
+		return accountIds[i] < accountIds[j]
+	})
+	return accountIds
+}
+
+func getRebalanceAccountRank(accountId int) int {
+	switch accountId {
+	case AccountIdIsa:
+		return 0
+	case AccountIdShare:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// PlanRebalance sells the overweight stocks at PriceSell then buys the underweight ones at PriceBuy with the cash,
+// largest gap first, in whole units and skipping trades under MinTradeValue
+func PlanRebalance(input RebalanceInput) (RebalancePlan, error) {
+	target := input.Target
+	if target.Dimension != AllocationByStock && target.Dimension != AllocationByAssetClass {
+		return RebalancePlan{}, fmt.Errorf("cannot rebalance by %v", target.Dimension)
+	}
+	if err := target.Weights.Validate(); err != nil {
+		return RebalancePlan{}, err
+	}
+
+	currentValues := map[string]Decimal{}
+	cash := map[int]Decimal{}
+	for _, account := range input.Valuation.Accounts {
+		for _, position := range account.Positions {
+			if position.IsCash {
+				cash[account.AccountId] = cash[account.AccountId].Add(position.Value.Value.Decimal)
+				continue
+			}
+			currentValues[position.StockId] = currentValues[position.StockId].Add(position.Value.Value.Decimal)
+		}
+	}
+
+	availableCash := getRebalancePounds(input.AvailableCash)
+	cash[AccountIdIsa] = cash[AccountIdIsa].Add(availableCash)
+	total := input.Valuation.Value.Value.Add(availableCash)
+
+	targetValues, err := getRebalanceTargetValues(input, currentValues, total)
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+
+	plan := RebalancePlan{
+		CashBefore:    FromPounds("0"),
+		EstimatedGain: FromPounds("0"),
+	}
+	for _, value := range cash {
+		plan.CashBefore.Value = DecimalExt{plan.CashBefore.Value.Add(value)}
+	}
+
+	minTrade := getRebalancePounds(input.MinTradeValue)
+	lotsByStock := map[string][]Lot{}
+	for _, holding := range input.Holdings {
+		lotsByStock[holding.StockId] = append(lotsByStock[holding.StockId], holding.Lots...)
+	}
+
+	var stockIds []string
+	for stockId := range targetValues {
+		stockIds = append(stockIds, stockId)
+	}
+	sort.Strings(stockIds)
+
+	for _, stockId := range stockIds {
+		gap := targetValues[stockId].Sub(currentValues[stockId])
+		if !gap.IsNegative() {
+			continue
+		}
+		orders := planRebalanceSells(stockId, input.Stocks[stockId], lotsByStock[stockId], gap.Neg(), targetValues[stockId].IsZero(), minTrade)
+		for _, order := range orders {
+			cash[order.AccountId] = cash[order.AccountId].Add(order.Value.Value.Decimal)
+			estimatedGain, err := plan.EstimatedGain.AddStrict(order.EstimatedGain)
+			if err != nil {
+				return RebalancePlan{}, err
+			}
+			plan.EstimatedGain = estimatedGain
+			plan.Orders = append(plan.Orders, order)
+		}
+	}
+
+	sort.SliceStable(stockIds, func(i, j int) bool {
+		gapI := targetValues[stockIds[i]].Sub(currentValues[stockIds[i]])
+		gapJ := targetValues[stockIds[j]].Sub(currentValues[stockIds[j]])
+		return gapI.GreaterThan(gapJ)
+	})
+
+	var cashAccountIds []int
+	for accountId := range cash {
+		cashAccountIds = append(cashAccountIds, accountId)
+	}
+	cashAccountIds = rebalanceAccountOrder(cashAccountIds)
+
+	for _, stockId := range stockIds {
+		gap := targetValues[stockId].Sub(currentValues[stockId])
+		if !gap.IsPositive() {
+			continue
+		}
+
+		stock := input.Stocks[stockId]
+		price := stock.PriceBuy.toPounds()
+		for _, accountId := range cashAccountIds {
+			spend := Min(gap, cash[accountId])
+			units := spend.Div(price.Value.Decimal).Floor()
+			value := price.Mul(units)
+			if !units.IsPositive() || value.Value.LessThan(minTrade) {
+				continue
+			}
+
+			plan.Orders = append(plan.Orders, RebalanceOrder{
+				StockId:       stockId,
+				Name:          stock.GetDisplayName(),
+				AccountId:     accountId,
+				IsBuy:         true,
+				Units:         units,
+				Price:         price,
+				Value:         value,
+				EstimatedGain: FromPounds("0"),
+			})
+			cash[accountId] = cash[accountId].Sub(value.Value.Decimal)
+			gap = gap.Sub(value.Value.Decimal)
+		}
+	}
+
+	plan.CashAfter = FromPounds("0")
+	for _, value := range cash {
+		plan.CashAfter.Value = DecimalExt{plan.CashAfter.Value.Add(value)}
+	}
+	return plan, nil
+}
+
+// getRebalancePounds treats an unset amount as zero rather than converting from no currency
+func getRebalancePounds(amount Money) Decimal {
+	if amount.isUnset() {
+		return NewFromInt(0)
+	}
+	return amount.toPounds().Value.Decimal
+}
+
+// getRebalanceTargetValues is the GBP value wanted in each stock, held stocks without a weight are sold
+func getRebalanceTargetValues(input RebalanceInput, currentValues map[string]Decimal, total Decimal) (map[string]Decimal, error) {
+	targetValues := map[string]Decimal{}
+	for stockId := range currentValues {
+		targetValues[stockId] = NewFromInt(0)
+	}
+
+	getWeightValue := func(percent Decimal) Decimal {
+		return total.Mul(percent).Div(NewFromInt(100))
+	}
+
+	if input.Target.Dimension == AllocationByStock {
+		for stockId, percent := range input.Target.Weights {
+			if stockId == CashStockId {
+				continue
+			}
+			targetValues[stockId] = getWeightValue(percent)
+		}
+	} else {
+		classValues := map[string]Decimal{}
+		for stockId, value := range currentValues {
+			stock, ok := input.Stocks[stockId]
+			if !ok {
+				return nil, fmt.Errorf("no stock for held %v", stockId)
+			}
+			key := stock.GetAllocationKey(AllocationByAssetClass)
+			classValues[key] = classValues[key].Add(value)
+		}
+
+		for stockId, value := range currentValues {
+			key := input.Stocks[stockId].GetAllocationKey(AllocationByAssetClass)
+			percent, ok := input.Target.Weights[key]
+			if ok && classValues[key].IsPositive() {
+				targetValues[stockId] = getWeightValue(percent).Mul(value).Div(classValues[key])
+			}
+		}
+
+		for key, percent := range input.Target.Weights {
+			if key != AssetClassCash && percent.IsPositive() && classValues[key].IsZero() {
+				GetLogger().Warning("No holding to buy for target asset class", "assetClass", key, "percent", percent)
+			}
+		}
+	}
+
+	for stockId := range targetValues {
+		stock, ok := input.Stocks[stockId]
+		if !ok || stock.PriceBuy.Value.IsZero() || stock.PriceSell.Value.IsZero() {
+			return nil, fmt.Errorf("no buy and sell price for %v", stockId)
+		}
+	}
+	return targetValues, nil
+}
+
+// planRebalanceSells sells value of the stock, from the ISA lots first, everything if sellAll
+func planRebalanceSells(stockId string, stock *Stock, lots []Lot, value Decimal, sellAll bool, minTrade Decimal) []RebalanceOrder {
+	price := stock.PriceSell.toPounds()
+	unitsToSell := value.Div(price.Value.Decimal).Floor()
+
+	lotsByAccount := map[int][]Lot{}
+	var accountIds []int
+	for _, lot := range lots {
+		accountId := lot.Transaction.AccountId
+		if _, ok := lotsByAccount[accountId]; !ok {
+			accountIds = append(accountIds, accountId)
+		}
+		lotsByAccount[accountId] = append(lotsByAccount[accountId], lot)
+	}
+
+	var orders []RebalanceOrder
+	for _, accountId := range rebalanceAccountOrder(accountIds) {
+		accountHolding := Holding{StockId: stockId, Lots: lotsByAccount[accountId]}
+		held := accountHolding.GetUnitsTotal()
+
+		units := Min(held, unitsToSell)
+		if sellAll {
+			units = held
+		}
+		orderValue := price.Mul(units)
+		if !units.IsPositive() || orderValue.Value.LessThan(minTrade) {
+			continue
+		}
+
+		order := RebalanceOrder{
+			StockId:       stockId,
+			Name:          stock.GetDisplayName(),
+			AccountId:     accountId,
+			Units:         units,
+			Price:         price,
+			Value:         orderValue,
+			EstimatedGain: FromPounds("0"),
+		}
+		if accountId == AccountIdShare {
+			gainPerUnit := price.Value.Sub(accountHolding.GetPriceAverageBought())
+			order.EstimatedGain = Money{Currency: CURRENCY_GBP, Value: DecimalExt{gainPerUnit.Mul(units)}}
+		}
+
+		orders = append(orders, order)
+		unitsToSell = unitsToSell.Sub(units)
+		if !sellAll && !unitsToSell.IsPositive() {
+			break
+		}
+	}
+	return orders
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func getRebalanceTestInput(isaUnits int64, shareUnits int64) RebalanceInput {
+	stocks := map[string]*Stock{
+		"vusa": {StockId: "vusa", Description: "VUSA", AssetClass: AssetClassEquity, PriceBuy: FromPounds("61"), PriceSell: FromPounds("60")},
+		"igls": {StockId: "igls", Description: "IGLS", AssetClass: AssetClassBond, PriceBuy: FromPounds("101"), PriceSell: FromPounds("100")},
+	}
+
+	lot := func(stockId string, units int64, priceBought int64, accountId int) Lot {
+		return Lot{StockId: stockId, Units: NewFromInt(units), PriceBought: NewFromInt(priceBought), Transaction: Transaction{AccountId: accountId}}
+	}
+	holdings := []Holding{
+		{StockId: "vusa", Lots: []Lot{lot("vusa", isaUnits, 50, AccountIdIsa), lot("vusa", shareUnits, 40, AccountIdShare)}},
+		{StockId: "igls", Lots: []Lot{lot("igls", 3, 90, AccountIdShare)}},
+	}
+	cash := map[int]*CashLedger{
+		AccountIdIsa: {AccountId: AccountIdIsa, Entries: []CashEntry{{Balance: FromPounds("300")}}},
+	}
+
+	valuation, err := ValuePortfolio(time.Now(), holdings, stocks, cash)
+	CheckError(err)
+
+	return RebalanceInput{
+		Valuation:     valuation,
+		Holdings:      holdings,
+		Stocks:        stocks,
+		MinTradeValue: FromPounds("50"),
+	}
+}
+
+func TestPlanRebalanceByStock(t *testing.T) {
+	input := getRebalanceTestInput(10, 5)
+	input.Target = RebalanceTarget{
+		Dimension: AllocationByStock,
+		Weights:   TargetAllocation{"vusa": NewFromInt(40), "igls": NewFromInt(60)},
+	}
+
+	plan, err := PlanRebalance(input)
+	if err != nil {
+		t.Fatalf("Plan expected no error actual %v", err)
+	}
+	if len(plan.Orders) != 2 {
+		t.Fatalf("Orders expected %v actual %v", 2, plan.Orders)
+	}
+
+	sell := plan.Orders[0]
+	if sell.IsBuy || sell.AccountId != AccountIdIsa || !sell.Units.Equal(NewFromInt(5)) {
+		t.Errorf("Sell expected 5 vusa from the ISA actual %v", sell)
+	}
+	buy := plan.Orders[1]
+	if !buy.IsBuy || buy.StockId != "igls" || !buy.Units.Equal(NewFromInt(5)) || !buy.Value.Value.Equal(NewFromInt(505)) {
+		t.Errorf("Buy expected 5 igls at 101 actual %v", buy)
+	}
+	if !plan.EstimatedGain.Value.IsZero() || !plan.CashAfter.Value.Equal(NewFromInt(95)) {
+		t.Errorf("Expected no gain and 95 cash actual %v %v", plan.EstimatedGain.GetDesc(), plan.CashAfter.GetDesc())
+	}
+}
+
+func TestPlanRebalanceByAssetClass(t *testing.T) {
+	input := getRebalanceTestInput(2, 13)
+	input.Target = RebalanceTarget{
+		Dimension: AllocationByAssetClass,
+		Weights:   TargetAllocation{AssetClassEquity: NewFromInt(20), AssetClassBond: NewFromInt(80)},
+	}
+
+	plan, err := PlanRebalance(input)
+	if err != nil {
+		t.Fatalf("Plan expected no error actual %v", err)
+	}
+	if len(plan.Orders) != 4 {
+		t.Fatalf("Orders expected %v actual %v", 4, plan.Orders)
+	}
+
+	if plan.Orders[0].AccountId != AccountIdIsa || !plan.Orders[0].Units.Equal(NewFromInt(2)) {
+		t.Errorf("First sell expected the 2 ISA units actual %v", plan.Orders[0])
+	}
+	if plan.Orders[1].AccountId != AccountIdShare || !plan.Orders[1].Units.Equal(NewFromInt(8)) {
+		t.Errorf("Second sell expected 8 share account units actual %v", plan.Orders[1])
+	}
+	if !plan.EstimatedGain.Value.Equal(NewFromInt(160)) {
+		t.Errorf("Gain expected %v actual %v", 160, plan.EstimatedGain.GetDesc())
+	}
+	if !plan.CashAfter.Value.Equal(NewFromInt(92)) {
+		t.Errorf("Cash after expected %v actual %v", 92, plan.CashAfter.GetDesc())
+	}
+}
+
+func TestPlanRebalanceMinTrade(t *testing.T) {
+	input := getRebalanceTestInput(10, 5)
+	input.MinTradeValue = FromPounds("1000")
+	input.Target = RebalanceTarget{
+		Dimension: AllocationByStock,
+		Weights:   TargetAllocation{"vusa": NewFromInt(40), "igls": NewFromInt(60)},
+	}
+
+	plan, _ := PlanRebalance(input)
+	if len(plan.Orders) != 0 {
+		t.Errorf("Orders under the minimum expected none actual %v", plan.Orders)
+	}
+}
@@ -0,0 +1,496 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CollectionPriceHistory = "pricehistory"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Repository is the store behind the API and tools, Mongo in the cloud and memory locally.
+// Gets return ErrNotFound for an unknown id, saves assign the id when it is empty
+type Repository interface {
+	GetStocks(ctx context.Context) (map[string]*Stock, error)
+	GetStock(ctx context.Context, stockId string) (*Stock, error)
+	SaveStock(ctx context.Context, stock *Stock) error
+
+	GetWatches(ctx context.Context) ([]Watch, error)
+	GetWatch(ctx context.Context, watchId string) (Watch, error)
+	SaveWatch(ctx context.Context, watch *Watch) error
+	DeleteWatch(ctx context.Context, watchId string) error
+
+	GetTransactions(ctx context.Context) ([]Transaction, error)
+	SaveTransaction(ctx context.Context, transaction *Transaction) error
+
+	GetCorporateActions(ctx context.Context) ([]CorporateAction, error)
+
+	// GetPriceHistory is newest first, an empty history if none is stored
+	GetPriceHistory(ctx context.Context, stockId string) (PriceHistory, error)
+	SavePriceHistory(ctx context.Context, stockId string, history PriceHistory) error
+}
+
+// MemoryRepository keeps everything in maps, for running locally and tests
+type MemoryRepository struct {
+	mutex            sync.RWMutex
+	nextId           int
+	stocks           map[string]Stock
+	watches          map[string]Watch
+	transactions     []Transaction
+	corporateActions []CorporateAction
+	histories        map[string]PriceHistory
+}
+
+// MemorySnapshot is the JSON file a MemoryRepository can be loaded from
+type MemorySnapshot struct {
+	Stocks           []Stock
+	Watches          []Watch
+	Transactions     []Transaction
+	CorporateActions []CorporateAction
+	PriceHistories   map[string]PriceHistory // keyed on StockId
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		stocks:    map[string]Stock{},
+		watches:   map[string]Watch{},
+		histories: map[string]PriceHistory{},
+	}
+}
+
+func LoadMemoryRepository(filename string) (*MemoryRepository, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot MemorySnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	for _, action := range snapshot.CorporateActions {
+		if err = action.Validate(); err != nil {
+			return nil, fmt.Errorf("%v: %w", filename, err)
+		}
+	}
+	return NewMemoryRepositorySnapshot(snapshot), nil
+}
+
+func NewMemoryRepositorySnapshot(snapshot MemorySnapshot) *MemoryRepository {
+	repository := NewMemoryRepository()
+	ctx := context.Background()
+
+	for ix := range snapshot.Stocks {
+		_ = repository.SaveStock(ctx, &snapshot.Stocks[ix])
+	}
+	for ix := range snapshot.Watches {
+		_ = repository.SaveWatch(ctx, &snapshot.Watches[ix])
+	}
+	for ix := range snapshot.Transactions {
+		_ = repository.SaveTransaction(ctx, &snapshot.Transactions[ix])
+	}
+	repository.corporateActions = append(repository.corporateActions, snapshot.CorporateActions...)
+	for stockId, history := range snapshot.PriceHistories {
+		_ = repository.SavePriceHistory(ctx, stockId, history)
+	}
+	return repository
+}
+
+// GetSnapshot is everything held, in the form LoadMemoryRepository reads
+func (repository *MemoryRepository) GetSnapshot() MemorySnapshot {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	snapshot := MemorySnapshot{
+		Transactions:     append([]Transaction{}, repository.transactions...),
+		CorporateActions: append([]CorporateAction{}, repository.corporateActions...),
+		PriceHistories:   map[string]PriceHistory{},
+	}
+	for _, stock := range repository.stocks {
+		snapshot.Stocks = append(snapshot.Stocks, stock)
+	}
+	sort.Slice(snapshot.Stocks, func(i, j int) bool {
+		return snapshot.Stocks[i].StockId < snapshot.Stocks[j].StockId
+	})
+	for _, watch := range repository.watches {
+		snapshot.Watches = append(snapshot.Watches, watch)
+	}
+	sort.Slice(snapshot.Watches, func(i, j int) bool {
+		return snapshot.Watches[i].WatchId < snapshot.Watches[j].WatchId
+	})
+	for stockId, history := range repository.histories {
+		snapshot.PriceHistories[stockId] = history
+	}
+	return snapshot
+}
+
+// SaveSnapshot writes the repository to filename for LoadMemoryRepository
+func (repository *MemoryRepository) SaveSnapshot(filename string) error {
+	data, err := json.MarshalIndent(repository.GetSnapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// getId assigns the next id when id is empty, ids already used are skipped so loaded snapshots can be added to
+func (repository *MemoryRepository) getId(id string) string {
+	if len(id) > 0 {
+		if number, err := strconv.Atoi(id); err == nil && number > repository.nextId {
+			repository.nextId = number
+		}
+		return id
+	}
+
+	repository.nextId++
+	return strconv.Itoa(repository.nextId)
+}
+
+func (repository *MemoryRepository) GetStocks(ctx context.Context) (map[string]*Stock, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	stocks := map[string]*Stock{}
+	for stockId, stock := range repository.stocks {
+		copied := stock
+		stocks[stockId] = &copied
+	}
+	return stocks, nil
+}
+
+func (repository *MemoryRepository) GetStock(ctx context.Context, stockId string) (*Stock, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	stock, ok := repository.stocks[stockId]
+	if !ok {
+		return nil, fmt.Errorf("stock %v: %w", stockId, ErrNotFound)
+	}
+	return &stock, nil
+}
+
+func (repository *MemoryRepository) SaveStock(ctx context.Context, stock *Stock) error {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	stock.StockId = repository.getId(stock.StockId)
+	repository.stocks[stock.StockId] = *stock
+	return nil
+}
+
+func (repository *MemoryRepository) GetWatches(ctx context.Context) ([]Watch, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	watches := make([]Watch, 0, len(repository.watches))
+	for _, watch := range repository.watches {
+		watches = append(watches, watch)
+	}
+	sort.Slice(watches, func(i, j int) bool {
+		return watches[i].WatchId < watches[j].WatchId
+	})
+	return watches, nil
+}
+
+func (repository *MemoryRepository) GetWatch(ctx context.Context, watchId string) (Watch, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	watch, ok := repository.watches[watchId]
+	if !ok {
+		return Watch{}, fmt.Errorf("watch %v: %w", watchId, ErrNotFound)
+	}
+	return watch, nil
+}
+
+func (repository *MemoryRepository) SaveWatch(ctx context.Context, watch *Watch) error {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	watch.WatchId = repository.getId(watch.WatchId)
+	repository.watches[watch.WatchId] = *watch
+	return nil
+}
+
+func (repository *MemoryRepository) DeleteWatch(ctx context.Context, watchId string) error {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	if _, ok := repository.watches[watchId]; !ok {
+		return fmt.Errorf("watch %v: %w", watchId, ErrNotFound)
+	}
+	delete(repository.watches, watchId)
+	return nil
+}
+
+func (repository *MemoryRepository) GetTransactions(ctx context.Context) ([]Transaction, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	return append([]Transaction{}, repository.transactions...), nil
+}
+
+func (repository *MemoryRepository) SaveTransaction(ctx context.Context, transaction *Transaction) error {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	transaction.TransactionId = repository.getId(transaction.TransactionId)
+	for ix := range repository.transactions {
+		if repository.transactions[ix].TransactionId == transaction.TransactionId {
+			repository.transactions[ix] = *transaction
+			return nil
+		}
+	}
+	repository.transactions = append(repository.transactions, *transaction)
+	return nil
+}
+
+func (repository *MemoryRepository) GetCorporateActions(ctx context.Context) ([]CorporateAction, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	return append([]CorporateAction{}, repository.corporateActions...), nil
+}
+
+func (repository *MemoryRepository) GetPriceHistory(ctx context.Context, stockId string) (PriceHistory, error) {
+	repository.mutex.RLock()
+	defer repository.mutex.RUnlock()
+
+	return copyPriceHistory(repository.histories[stockId]), nil
+}
+
+func (repository *MemoryRepository) SavePriceHistory(ctx context.Context, stockId string, history PriceHistory) error {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	repository.histories[stockId] = copyPriceHistory(history)
+	return nil
+}
+
+// copyPriceHistory copies the whole history so neither side's slices are shared
+func copyPriceHistory(history PriceHistory) PriceHistory {
+	copied := history
+	copied.Eods = append([]EodMarketStack{}, history.Eods...)
+	copied.AppliedActions = append([]string{}, history.AppliedActions...)
+	return copied
+}
+
+// MongoRepository reads and writes the collections the cloud functions use
+type MongoRepository struct {
+	Db *mongo.Database
+}
+
+func NewMongoRepository(db *mongo.Database) *MongoRepository {
+	return &MongoRepository{Db: db}
+}
+
+// getDocumentId is the ObjectID for ids created by Mongo, the string for any set by hand
+func getDocumentId(id string) interface{} {
+	if objectId, err := primitive.ObjectIDFromHex(id); err == nil {
+		return objectId
+	}
+	return id
+}
+
+func getInsertedId(result *mongo.InsertOneResult) string {
+	return getDocumentIdString(result.InsertedID)
+}
+
+// getDocumentIdString reverses getDocumentId, giving the hex of an ObjectID or the id set by hand
+func getDocumentIdString(id interface{}) string {
+	if objectId, ok := id.(primitive.ObjectID); ok {
+		return objectId.Hex()
+	}
+	return fmt.Sprintf("%v", id)
+}
+
+func findAll(ctx context.Context, collection *mongo.Collection, filter interface{}, decode func(cursor *mongo.Cursor) error) error {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("find %v: %w", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		if err = decode(cursor); err != nil {
+			return fmt.Errorf("decode %v: %w", collection.Name(), err)
+		}
+	}
+	return cursor.Err()
+}
+
+func findOne(ctx context.Context, collection *mongo.Collection, id string, target interface{}) error {
+	err := collection.FindOne(ctx, bson.M{"_id": getDocumentId(id)}).Decode(target)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("%v %v: %w", collection.Name(), id, ErrNotFound)
+	}
+	return err
+}
+
+// replaceOrInsert inserts the document when id is empty and returns the new id
+func replaceOrInsert(ctx context.Context, collection *mongo.Collection, id string, document interface{}) (string, error) {
+	if len(id) == 0 {
+		result, err := collection.InsertOne(ctx, document)
+		if err != nil {
+			return "", fmt.Errorf("insert %v: %w", collection.Name(), err)
+		}
+		return getInsertedId(result), nil
+	}
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": getDocumentId(id)}, document, options.Replace().SetUpsert(true))
+	if err != nil {
+		return "", fmt.Errorf("replace %v %v: %w", collection.Name(), id, err)
+	}
+	return id, nil
+}
+
+func (repository *MongoRepository) GetStocks(ctx context.Context) (map[string]*Stock, error) {
+	stocks := map[string]*Stock{}
+	err := findAll(ctx, repository.Db.Collection(CollectionStock), bson.M{}, func(cursor *mongo.Cursor) error {
+		var stock Stock
+		if err := cursor.Decode(&stock); err != nil {
+			return err
+		}
+		stocks[stock.StockId] = &stock
+		return nil
+	})
+	return stocks, err
+}
+
+func (repository *MongoRepository) GetStock(ctx context.Context, stockId string) (*Stock, error) {
+	var stock Stock
+	if err := findOne(ctx, repository.Db.Collection(CollectionStock), stockId, &stock); err != nil {
+		return nil, err
+	}
+	return &stock, nil
+}
+
+func (repository *MongoRepository) SaveStock(ctx context.Context, stock *Stock) error {
+	document := *stock
+	document.StockId = ""
+
+	stockId, err := replaceOrInsert(ctx, repository.Db.Collection(CollectionStock), stock.StockId, document)
+	if err == nil {
+		stock.StockId = stockId
+	}
+	return err
+}
+
+func (repository *MongoRepository) GetWatches(ctx context.Context) ([]Watch, error) {
+	watches := []Watch{}
+	err := findAll(ctx, repository.Db.Collection(CollectionWatch), bson.M{}, func(cursor *mongo.Cursor) error {
+		var watch Watch
+		if err := cursor.Decode(&watch); err != nil {
+			return err
+		}
+		watches = append(watches, watch)
+		return nil
+	})
+	return watches, err
+}
+
+func (repository *MongoRepository) GetWatch(ctx context.Context, watchId string) (Watch, error) {
+	var watch Watch
+	err := findOne(ctx, repository.Db.Collection(CollectionWatch), watchId, &watch)
+	return watch, err
+}
+
+func (repository *MongoRepository) SaveWatch(ctx context.Context, watch *Watch) error {
+	document := *watch
+	document.WatchId = ""
+
+	watchId, err := replaceOrInsert(ctx, repository.Db.Collection(CollectionWatch), watch.WatchId, document)
+	if err == nil {
+		watch.WatchId = watchId
+	}
+	return err
+}
+
+func (repository *MongoRepository) DeleteWatch(ctx context.Context, watchId string) error {
+	collection := repository.Db.Collection(CollectionWatch)
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": getDocumentId(watchId)})
+	if err != nil {
+		return fmt.Errorf("delete %v %v: %w", collection.Name(), watchId, err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("%v %v: %w", collection.Name(), watchId, ErrNotFound)
+	}
+	return nil
+}
+
+// transactionDocument reads the _id the Transaction itself doesn't map
+type transactionDocument struct {
+	Id          interface{} `bson:"_id"`
+	Transaction `bson:",inline"`
+}
+
+func (repository *MongoRepository) GetTransactions(ctx context.Context) ([]Transaction, error) {
+	transactions := []Transaction{}
+	err := findAll(ctx, repository.Db.Collection(CollectionTransaction), bson.M{}, func(cursor *mongo.Cursor) error {
+		var document transactionDocument
+		if err := cursor.Decode(&document); err != nil {
+			return err
+		}
+		document.Transaction.TransactionId = getDocumentIdString(document.Id)
+		transactions = append(transactions, document.Transaction)
+		return nil
+	})
+	return transactions, err
+}
+
+func (repository *MongoRepository) SaveTransaction(ctx context.Context, transaction *Transaction) error {
+	transactionId, err := replaceOrInsert(ctx, repository.Db.Collection(CollectionTransaction), transaction.TransactionId, *transaction)
+	if err == nil {
+		transaction.TransactionId = transactionId
+	}
+	return err
+}
+
+func (repository *MongoRepository) GetCorporateActions(ctx context.Context) ([]CorporateAction, error) {
+	actions := []CorporateAction{}
+	err := findAll(ctx, repository.Db.Collection(CollectionCorporateAction), bson.M{}, func(cursor *mongo.Cursor) error {
+		var action CorporateAction
+		if err := cursor.Decode(&action); err != nil {
+			return err
+		}
+		actions = append(actions, action)
+		return nil
+	})
+	return actions, err
+}
+
+// priceHistoryDocument is one document per stock
+type priceHistoryDocument struct {
+	StockId        string `bson:"_id"`
+	Eods           []EodMarketStack
+	AppliedActions []string
+}
+
+func (repository *MongoRepository) GetPriceHistory(ctx context.Context, stockId string) (PriceHistory, error) {
+	var document priceHistoryDocument
+	err := repository.Db.Collection(CollectionPriceHistory).FindOne(ctx, bson.M{"_id": stockId}).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return PriceHistory{}, nil
+	}
+	return PriceHistory{Eods: document.Eods, AppliedActions: document.AppliedActions}, err
+}
+
+func (repository *MongoRepository) SavePriceHistory(ctx context.Context, stockId string, history PriceHistory) error {
+	document := priceHistoryDocument{StockId: stockId, Eods: history.Eods, AppliedActions: history.AppliedActions}
+	_, err := repository.Db.Collection(CollectionPriceHistory).ReplaceOne(ctx, bson.M{"_id": stockId}, document, options.Replace().SetUpsert(true))
+	return err
+}
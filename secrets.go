@@ -0,0 +1,254 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"golang.org/x/net/context"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+const (
+	EnvProjectId    = "GOOGLE_CLOUD_PROJECT"
+	EnvSecretSource = "SECRET_SOURCE"
+	EnvSecretsDir   = "SECRETS_DIR"
+
+	DefaultProjectId  = "investor-tracker"
+	DefaultSecretsDir = "/run/secrets"
+
+	SecretSourceEnv           = "env"
+	SecretSourceFile          = "file"
+	SecretSourceSecretManager = "secretmanager"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+type SecretProvider interface {
+	GetSecret(name string) (string, error)
+}
+
+// EnvSecretProvider reads the secret value straight from the environment variable of that name
+type EnvSecretProvider struct {
+}
+
+func (provider EnvSecretProvider) GetSecret(name string) (string, error) {
+	value, isSet := os.LookupEnv(name)
+	if !isSet {
+		return "", fmt.Errorf("%w: environment variable %v", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// FileSecretProvider reads mounted secrets, one file per secret e.g. /run/secrets/<name>
+type FileSecretProvider struct {
+	Dir string
+}
+
+func (provider FileSecretProvider) GetSecret(name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid secret name %v", name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(provider.Dir, name))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %v in %v", ErrSecretNotFound, name, provider.Dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("read secret %v: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// SecretManagerProvider reads the latest version of a Google Secret Manager secret, sharing one client
+type SecretManagerProvider struct {
+	ProjectId string
+
+	mutex  sync.Mutex
+	client *secretmanager.Client
+}
+
+func NewSecretManagerProvider(projectId string) *SecretManagerProvider {
+	return &SecretManagerProvider{ProjectId: projectId}
+}
+
+func (provider *SecretManagerProvider) getClient(ctx context.Context) (*secretmanager.Client, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.client == nil {
+		client, err := secretmanager.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("setup secret manager client: %w", err)
+		}
+		provider.client = client
+	}
+	return provider.client, nil
+}
+
+func (provider *SecretManagerProvider) GetSecret(name string) (string, error) {
+	ctx := context.Background()
+	client, err := provider.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	accessRequest := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%v/secrets/%v/versions/latest", provider.ProjectId, name),
+	}
+
+	result, err := client.AccessSecretVersion(ctx, accessRequest)
+	if err != nil {
+		return "", fmt.Errorf("access secret %v: %w", name, err)
+	}
+	return string(result.Payload.Data), nil
+}
+
+func (provider *SecretManagerProvider) Close() error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.client == nil {
+		return nil
+	}
+	err := provider.client.Close()
+	provider.client = nil
+	return err
+}
+
+// CachingSecretProvider remembers each secret after the first successful lookup
+type CachingSecretProvider struct {
+	Provider SecretProvider
+
+	mutex sync.Mutex
+	cache map[string]string
+}
+
+func NewCachingSecretProvider(provider SecretProvider) *CachingSecretProvider {
+	return &CachingSecretProvider{
+		Provider: provider,
+		cache:    map[string]string{},
+	}
+}
+
+func (provider *CachingSecretProvider) GetSecret(name string) (string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if value, ok := provider.cache[name]; ok {
+		return value, nil
+	}
+
+	value, err := provider.Provider.GetSecret(name)
+	if err != nil {
+		return "", err
+	}
+
+	if provider.cache == nil {
+		provider.cache = map[string]string{}
+	}
+	provider.cache[name] = value
+	RegisterSecretValue(value)
+	return value, nil
+}
+
+// NewSecretProvider picks the backend from the config, LOCAL defaults to the environment
+func NewSecretProvider(cfg *Config) (SecretProvider, error) {
+	var provider SecretProvider
+
+	switch cfg.GetSecretSource() {
+	case SecretSourceEnv:
+		provider = EnvSecretProvider{}
+	case SecretSourceFile:
+		provider = FileSecretProvider{Dir: cfg.SecretsDir}
+	case SecretSourceSecretManager:
+		provider = NewSecretManagerProvider(cfg.ProjectId)
+	default:
+		return nil, fmt.Errorf("unknown secret source %v", cfg.SecretSource)
+	}
+
+	return NewCachingSecretProvider(provider), nil
+}
+
+func (cfg *Config) GetSecretSource() string {
+	if len(cfg.SecretSource) > 0 {
+		return cfg.SecretSource
+	}
+	if cfg.Local {
+		return SecretSourceEnv
+	}
+	return SecretSourceSecretManager
+}
+
+// lookupSecret resolves one of the EnvSecret* settings through the provider. With the env source the secret is the
+// variable itself, otherwise the variable holds the name of the secret to read. A secret that isn't set means it
+// isn't configured
+func lookupSecret(cfg *Config, provider SecretProvider, envSecretName string) (string, error) {
+	if len(envSecretName) == 0 {
+		return "", nil
+	}
+
+	if cfg.GetSecretSource() == SecretSourceEnv {
+		value, err := provider.GetSecret(envSecretName)
+		if errors.Is(err, ErrSecretNotFound) {
+			return "", nil
+		}
+		return value, err
+	}
+
+	secretName := os.Getenv(envSecretName)
+	if len(secretName) == 0 {
+		return "", nil
+	}
+	return provider.GetSecret(secretName)
+}
+
+var (
+	defaultSecretProvider      SecretProvider
+	defaultSecretProviderMutex sync.Mutex
+)
+
+func getDefaultSecretProvider(cfg *Config) (SecretProvider, error) {
+	defaultSecretProviderMutex.Lock()
+	defer defaultSecretProviderMutex.Unlock()
+
+	if defaultSecretProvider != nil {
+		return defaultSecretProvider, nil
+	}
+
+	provider, err := NewSecretProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defaultSecretProvider = provider
+	return provider, nil
+}
+
+// getSecretProviderOverride is the provider set by SetSecretProvider or made by GetSecret, nil if neither has happened
+func getSecretProviderOverride() SecretProvider {
+	defaultSecretProviderMutex.Lock()
+	defer defaultSecretProviderMutex.Unlock()
+	return defaultSecretProvider
+}
+
+// SetSecretProvider replaces the provider used by GetSecret and LoadConfig
+func SetSecretProvider(provider SecretProvider) {
+	defaultSecretProviderMutex.Lock()
+	defer defaultSecretProviderMutex.Unlock()
+	defaultSecretProvider = provider
+}
+
+// LookupSecret is GetSecret returning the error
+func LookupSecret(envSecretName string) (string, error) {
+	cfg := GetConfig()
+	provider, err := getDefaultSecretProvider(cfg)
+	if err != nil {
+		return "", err
+	}
+	return lookupSecret(cfg, provider, envSecretName)
+}
@@ -0,0 +1,249 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+const TradingDaysPerYear = 252
+
+var ErrNotEnoughHistory = errors.New("not enough history")
+
+type TimePoint struct {
+	Date  time.Time
+	Value Decimal
+}
+
+// TimeSeries is newest first like PriceHistory
+type TimeSeries []TimePoint
+
+// ToTimeSeries uses the close in pounds when it has been populated, the quoted close otherwise
+func (history PriceHistory) ToTimeSeries() TimeSeries {
+	series := make(TimeSeries, 0, len(history.Eods))
+	for _, eod := range history.Eods {
+		value := eod.PriceClose
+		if !eod.PriceClosePounds.Value.IsZero() {
+			value = eod.PriceClosePounds.Value.Decimal
+		}
+		series = append(series, TimePoint{Date: eod.Date.Time, Value: value})
+	}
+	return series
+}
+
+// GetValuationSeries is the total value of each valuation, sorted newest first
+func GetValuationSeries(valuations []PortfolioValuation) TimeSeries {
+	series := make(TimeSeries, 0, len(valuations))
+	for _, valuation := range valuations {
+		series = append(series, TimePoint{Date: valuation.Date, Value: valuation.Value.Value.Decimal})
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Date.After(series[j].Date)
+	})
+	return series
+}
+
+// GetReturns is the simple return between each point and the one before it, oldest first, skipping zero values
+func (series TimeSeries) GetReturns() []float64 {
+	var returns []float64
+	for ix := len(series) - 1; ix > 0; ix-- {
+		was, _ := series[ix].Value.Float64()
+		is, _ := series[ix-1].Value.Float64()
+		if was == 0 {
+			continue
+		}
+		returns = append(returns, is/was-1)
+	}
+	return returns
+}
+
+// getReturnsByDate is GetReturns keyed on the day of the later point, for lining up two series
+func (series TimeSeries) getReturnsByDate() map[time.Time]float64 {
+	returns := map[time.Time]float64{}
+	for ix := len(series) - 1; ix > 0; ix-- {
+		was, _ := series[ix].Value.Float64()
+		is, _ := series[ix-1].Value.Float64()
+		if was == 0 {
+			continue
+		}
+		returns[truncateToDay(series[ix-1].Date)] = is/was - 1
+	}
+	return returns
+}
+
+func getMean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+// getStandardDeviation is the sample standard deviation
+func getStandardDeviation(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	mean := getMean(values)
+	sumSquares := 0.0
+	for _, value := range values {
+		sumSquares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(sumSquares / float64(len(values)-1))
+}
+
+// getDownsideDeviation only counts returns below the target
+func getDownsideDeviation(values []float64, target float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sumSquares := 0.0
+	for _, value := range values {
+		if value < target {
+			sumSquares += (value - target) * (value - target)
+		}
+	}
+	return math.Sqrt(sumSquares / float64(len(values)))
+}
+
+// GetVolatility is the annualised standard deviation of the returns
+func GetVolatility(returns []float64, periodsPerYear int) float64 {
+	return getStandardDeviation(returns) * math.Sqrt(float64(periodsPerYear))
+}
+
+// GetSharpe is the annualised excess return over riskFreeRate per unit of volatility
+func GetSharpe(returns []float64, riskFreeRate float64, periodsPerYear int) float64 {
+	deviation := getStandardDeviation(returns)
+	if deviation == 0 {
+		return 0
+	}
+	excess := getMean(returns) - riskFreeRate/float64(periodsPerYear)
+	return excess / deviation * math.Sqrt(float64(periodsPerYear))
+}
+
+// GetSortino is GetSharpe only penalising the returns below the risk free rate
+func GetSortino(returns []float64, riskFreeRate float64, periodsPerYear int) float64 {
+	periodRate := riskFreeRate / float64(periodsPerYear)
+	deviation := getDownsideDeviation(returns, periodRate)
+	if deviation == 0 {
+		return 0
+	}
+	return (getMean(returns) - periodRate) / deviation * math.Sqrt(float64(periodsPerYear))
+}
+
+type Drawdown struct {
+	Percent  Decimal // negative, -25 for a quarter lost
+	DtPeak   time.Time
+	DtTrough time.Time
+}
+
+// GetMaxDrawdown is the largest fall from a peak to a later trough
+func (series TimeSeries) GetMaxDrawdown() Drawdown {
+	drawdown := Drawdown{Percent: NewFromInt(0)}
+	if len(series) == 0 {
+		return drawdown
+	}
+
+	peak := series[len(series)-1]
+	for ix := len(series) - 1; ix >= 0; ix-- {
+		point := series[ix]
+		if point.Value.GreaterThan(peak.Value) {
+			peak = point
+			continue
+		}
+		if peak.Value.IsZero() {
+			continue
+		}
+
+		percent := getPercentChange(peak.Value, point.Value)
+		if percent.LessThan(drawdown.Percent) {
+			drawdown = Drawdown{Percent: percent, DtPeak: peak.Date, DtTrough: point.Date}
+		}
+	}
+	return drawdown
+}
+
+// GetBeta is the covariance of the returns with the benchmark's over the benchmark's variance, on the days both have
+func GetBeta(series TimeSeries, benchmark TimeSeries) (float64, error) {
+	returns := series.getReturnsByDate()
+	benchmarkReturns := benchmark.getReturnsByDate()
+
+	var paired, pairedBenchmark []float64
+	for date, value := range returns {
+		if benchmarkValue, ok := benchmarkReturns[date]; ok {
+			paired = append(paired, value)
+			pairedBenchmark = append(pairedBenchmark, benchmarkValue)
+		}
+	}
+	if len(paired) < 2 {
+		return 0, ErrNotEnoughHistory
+	}
+
+	mean := getMean(paired)
+	meanBenchmark := getMean(pairedBenchmark)
+	covariance, variance := 0.0, 0.0
+	for ix := range paired {
+		covariance += (paired[ix] - mean) * (pairedBenchmark[ix] - meanBenchmark)
+		variance += (pairedBenchmark[ix] - meanBenchmark) * (pairedBenchmark[ix] - meanBenchmark)
+	}
+	if variance == 0 {
+		return 0, errors.New("benchmark has no variance")
+	}
+	return covariance / variance, nil
+}
+
+type RiskOptions struct {
+	RiskFreeRate   float64 // annual, 0.01 for 1%
+	PeriodsPerYear int
+}
+
+func NewRiskOptions(cfg *Config) RiskOptions {
+	return RiskOptions{
+		RiskFreeRate:   cfg.RiskFreeRate,
+		PeriodsPerYear: TradingDaysPerYear,
+	}
+}
+
+// RiskStats has volatility and drawdown as percents and the ratios as they are
+type RiskStats struct {
+	Periods     int
+	Volatility  Decimal
+	MaxDrawdown Drawdown
+	Sharpe      Decimal
+	Sortino     Decimal
+	Beta        Decimal
+	HasBeta     bool
+}
+
+// GetRiskStats works for a stock's history or a valuation series, benchmark may be nil to skip beta
+func GetRiskStats(series TimeSeries, benchmark TimeSeries, options RiskOptions) (RiskStats, error) {
+	returns := series.GetReturns()
+	if len(returns) < 2 {
+		return RiskStats{}, ErrNotEnoughHistory
+	}
+
+	stats := RiskStats{
+		Periods:     len(returns),
+		Volatility:  NewFromFloat(GetVolatility(returns, options.PeriodsPerYear) * 100),
+		MaxDrawdown: series.GetMaxDrawdown(),
+		Sharpe:      NewFromFloat(GetSharpe(returns, options.RiskFreeRate, options.PeriodsPerYear)),
+		Sortino:     NewFromFloat(GetSortino(returns, options.RiskFreeRate, options.PeriodsPerYear)),
+	}
+
+	if len(benchmark) > 0 {
+		beta, err := GetBeta(series, benchmark)
+		if err != nil {
+			GetLogger().Warning("Could not get beta", "error", err)
+		} else {
+			stats.Beta = NewFromFloat(beta)
+			stats.HasBeta = true
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	. "github.com/shopspring/decimal"
+	"math"
+	"testing"
+	"time"
+)
+
+// getTestSeries takes the values oldest first on consecutive days and returns the series newest first
+func getTestSeries(values ...float64) TimeSeries {
+	start := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+	series := TimeSeries{}
+	for ix := len(values) - 1; ix >= 0; ix-- {
+		series = append(series, TimePoint{Date: start.AddDate(0, 0, ix), Value: NewFromFloat(values[ix])})
+	}
+	return series
+}
+
+func TestGetReturnsAndDrawdown(t *testing.T) {
+	series := getTestSeries(100, 110, 99, 120)
+
+	returns := series.GetReturns()
+	expected := []float64{0.1, -0.1, 120.0/99 - 1}
+	for ix := range expected {
+		if math.Abs(returns[ix]-expected[ix]) > 1e-9 {
+			t.Errorf("Return %v expected %v actual %v", ix, expected[ix], returns[ix])
+		}
+	}
+
+	drawdown := series.GetMaxDrawdown()
+	if !drawdown.Percent.Equal(NewFromInt(-10)) || drawdown.DtPeak.Day() != 5 || drawdown.DtTrough.Day() != 6 {
+		t.Errorf("Drawdown expected -10%% from 5th to 6th actual %v", drawdown)
+	}
+}
+
+func TestGetRiskStats(t *testing.T) {
+	benchmark := getTestSeries(100, 101, 100, 102, 101.5, 103)
+	benchmarkReturns := benchmark.GetReturns()
+
+	values := []float64{50}
+	for _, benchmarkReturn := range benchmarkReturns {
+		values = append(values, values[len(values)-1]*(1+2*benchmarkReturn))
+	}
+	series := getTestSeries(values...)
+
+	stats, err := GetRiskStats(series, benchmark, RiskOptions{RiskFreeRate: 0.01, PeriodsPerYear: TradingDaysPerYear})
+	if err != nil {
+		t.Fatalf("Stats expected no error actual %v", err)
+	}
+
+	beta, _ := stats.Beta.Float64()
+	if !stats.HasBeta || math.Abs(beta-2) > 1e-6 {
+		t.Errorf("Beta expected %v actual %v", 2, beta)
+	}
+
+	volatility, _ := stats.Volatility.Float64()
+	benchmarkVolatility := GetVolatility(benchmarkReturns, TradingDaysPerYear) * 100
+	if math.Abs(volatility-2*benchmarkVolatility) > 1e-6 {
+		t.Errorf("Volatility expected %v actual %v", 2*benchmarkVolatility, volatility)
+	}
+
+	if !stats.Sharpe.IsPositive() || !stats.Sortino.GreaterThan(stats.Sharpe) {
+		t.Errorf("Expected positive Sharpe below Sortino actual %v %v", stats.Sharpe, stats.Sortino)
+	}
+
+	if _, err = GetRiskStats(getTestSeries(1, 2), nil, RiskOptions{PeriodsPerYear: TradingDaysPerYear}); err != ErrNotEnoughHistory {
+		t.Errorf("Short series expected %v actual %v", ErrNotEnoughHistory, err)
+	}
+}
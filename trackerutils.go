@@ -5,48 +5,45 @@ import (
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"net/http"
-	"net/url"
-	"os"
-	"strconv"
 )
 
+// CheckApiKeyRequest panics unless the request has a key with the scope its method needs, see CheckApiKey.
+//
+// Deprecated: the panic becomes a 500, use CheckApiKeyResponse or Authenticator.Middleware to answer 401 or 403
 func CheckApiKeyRequest(request *http.Request) {
+	CheckError(CheckApiKey(request))
+}
 
-	method := request.Method
-
-	var apiKeys []string
-	if method == "GET" {
-		queryValues, err := url.ParseQuery(request.URL.RawQuery)
-		CheckError(err)
-
-		apiKeys = queryValues["api_key"]
-	} else if (method == "POST") {
-		request.ParseForm()
-		apiKeys = request.Form["api_key"]
-	} else {
-		panic(fmt.Sprintf("Unknown method %v", method))
-	}
-	if len(apiKeys) != 1 {
-		panic("Expected 1 apikey, got " + strconv.Itoa(len(apiKeys)))
-	}
-	apiKey := apiKeys[0]
-	checkApiKey(apiKey)
+// CheckApiKey authorizes the request against the configured keys, the error never includes the key presented.
+// It still takes the api_key query or form value for the cloud functions that send it
+func CheckApiKey(request *http.Request) error {
+	auth := NewAuthenticator(GetConfig())
+	auth.AllowQueryKey = true
+	_, err := auth.Authorize(request, GetRequiredScope(request.Method))
+	return err
 }
 
-func checkApiKey(apiKey string) {
-	secret := GetSecret(EnvSecretMyApiKey)
-	if secret != apiKey || len(apiKey) == 0 {
-		panic(fmt.Sprintf("Invalid api key [%v]", apiKey))
+// CheckApiKeyResponse is CheckApiKey for a cloud function, it writes the 401 or 403 and returns false when refused
+func CheckApiKeyResponse(writer http.ResponseWriter, request *http.Request) bool {
+	if err := CheckApiKey(request); err != nil {
+		WriteApiKeyError(writer, request, err)
+		return false
 	}
+	return true
 }
 
 func GetStocksReference(db *mongo.Database) map[string]*Stock {
-	Log("Getting stocks reference data...")
+	return GetStocksReferenceConfig(GetConfig(), db)
+}
+
+func GetStocksReferenceConfig(cfg *Config, db *mongo.Database) map[string]*Stock {
+	GetLogger().Info("Getting stocks reference data")
 
 	ctx := context.TODO()
 
-	collectionStock := db.Collection("stock")
+	collectionStock := db.Collection(CollectionStock)
 
 	cursor, err := collectionStock.Find(ctx, bson.M{})
 	CheckError(err)
@@ -62,17 +59,42 @@ func GetStocksReference(db *mongo.Database) map[string]*Stock {
 		err = cursor.Decode(&stock)
 		CheckError(err)
 
-		urlToUse := stock.GetPriceUrl()
+		urlToUse := stock.GetPriceUrlConfig(cfg)
 		stock.Url = urlToUse
 
-		debugOverride := os.Getenv("DEBUG_STOCK")
+		debugOverride := cfg.DebugStock
 		if len(debugOverride) > 0 &&  debugOverride != stock.StockId {
 			continue
 		}
 
+		if len(stock.QuoteCurrency) == 0 && !stock.IsSourceHl() && len(cfg.TokenMarketStack) > 0 {
+			stock.PopulateQuoteCurrency(&DefaultHttp{})
+			if err = saveQuoteCurrency(ctx, collectionStock, &stock); err != nil {
+				GetLogger().Warning("Could not save quote currency", "stock", stock.StockId, "error", err)
+			}
+		}
+
 		stocks[stock.StockId] = &stock
 	}
 
-	Log(fmt.Sprint("Got ", len(stocks), " stocks"))
+	GetLogger().Info("Got stocks", "count", len(stocks))
 	return stocks
 }
+
+// stockUpdater is the part of the stock collection saveQuoteCurrency needs
+type stockUpdater interface {
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+}
+
+// saveQuoteCurrency stores the looked up quote currency so the ticker is only queried once per stock
+func saveQuoteCurrency(ctx context.Context, collectionStock stockUpdater, stock *Stock) error {
+	update := bson.M{"$set": bson.M{"quotecurrency": stock.QuoteCurrency}}
+	result, err := collectionStock.UpdateOne(ctx, bson.M{"_id": getDocumentId(stock.StockId)}, update)
+	if err != nil {
+		return fmt.Errorf("save quote currency for %v: %w", stock.StockId, err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("save quote currency for %v: %w", stock.StockId, ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeStockCollection matches only the _id it holds, compared the way Mongo compares types
+type fakeStockCollection struct {
+	id      interface{}
+	updated bson.M
+}
+
+func (collection *fakeStockCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if filter.(bson.M)["_id"] != collection.id {
+		return &mongo.UpdateResult{}, nil
+	}
+	collection.updated = update.(bson.M)
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func TestSaveQuoteCurrencyObjectId(t *testing.T) {
+	objectId := primitive.NewObjectID()
+	collection := &fakeStockCollection{id: objectId}
+	stock := &Stock{StockId: objectId.Hex(), QuoteCurrency: CURRENCY_GBX}
+
+	if err := saveQuoteCurrency(context.Background(), collection, stock); err != nil {
+		t.Fatalf("Save expected no error actual %v", err)
+	}
+	if set := collection.updated["$set"].(bson.M); set["quotecurrency"] != CURRENCY_GBX {
+		t.Errorf("Save expected quotecurrency %v actual %v", CURRENCY_GBX, set)
+	}
+}
+
+func TestSaveQuoteCurrencyUnmatched(t *testing.T) {
+	collection := &fakeStockCollection{id: "vusa"}
+	stock := &Stock{StockId: "iag", QuoteCurrency: CURRENCY_GBX}
+
+	if err := saveQuoteCurrency(context.Background(), collection, stock); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Save of a missing stock expected %v actual %v", ErrNotFound, err)
+	}
+}
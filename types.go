@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	. "github.com/shopspring/decimal"
-	"go.mongodb.org/mongo-driver/bson"
 	"io/ioutil"
 	"net/http"
 	"regexp"
@@ -35,12 +34,22 @@ const (
 	TransactionTypeInterest      = "interest"
 	TransactionTypeInputCard     = "card web"
 	TransactionTypeTransferOut	 = "fpd"
+	TransactionTypeInputDirectDebit = "dd"
+	TransactionTypeInputBankTransfer = "bacs"
+	TransactionTypeDividend      = "dividend"
+	TransactionTypeDistribution  = "distribution"
+	TransactionTypeCorporateAction = "corporate action" // cash paid by a corporate action, booked by ReplayHoldings
 
 	AccountIdIsa = 1
 	AccountIdShare = 2
 
 	WatchTypeThreshold = 1
 	WatchTypeCrashAnalysis = 2
+	WatchTypeExpression = 3
+
+	AlertSeverityInfo = 1
+	AlertSeverityWarning = 2
+	AlertSeverityCritical = 3
 
 	ExchangeLondon = "XLON"
 	ExchangeUsa = "XNAS"
@@ -53,11 +62,33 @@ type Stock struct {
 	HlUrlOverride string `json:"UrlOverride" bson:"UrlOverride"`
 	Symbol        string
 
-	Url       string  `bson:"-"`
+	Url       string  `json:"-" bson:"-"` // the price source with its access key, never serialized
 	PriceBuy  Money `bson:"-"`
 	PriceSell Money `bson:"-"`
 	StockIdLegacy int
 	Exchange string `bson:-`
+	QuoteCurrency string // currency the exchange quotes in, GBX for pence, empty to default from exchange
+
+	AssetClass       string
+	Sector           string
+	Region           string
+	ExposureCurrency string // currency of the underlying assets e.g. USD for an S&P 500 tracker quoted in GBX
+}
+
+func (stock *Stock) GetQuoteCurrency() string {
+	if len(stock.QuoteCurrency) > 0 {
+		return stock.QuoteCurrency
+	}
+
+	return GetDefaultQuoteCurrency(stock.Exchange)
+}
+
+// GetDefaultQuoteCurrency is the usual quote currency for an exchange, LSE equities are quoted in pence
+func GetDefaultQuoteCurrency(exchange string) string {
+	if strings.Contains(exchange, ExchangeUsa) {
+		return CURRENCY_USD
+	}
+	return CURRENCY_GBX
 }
 
 func (stock *Stock) GetDisplayName() string {
@@ -68,52 +99,6 @@ func (stock *Stock) GetDisplayName() string {
 	}
 }
 
-//https://stackoverflow.com/questions/30891301/handling-custom-bson-marshaling
-//also perhaps can add a default encoder for Decimal - look at default_value_encoders.go
-// GetBSON implements bson.Getter.
-//func (s Stock) GetBSON() (interface{}, error) {
-//	stringBuy := s.PriceBuy.String()
-//	stringSell := s.PriceSell.String()
-//	return struct {
-//		StockId int
-//		Description string
-//		PriceBuy        string
-//		PriceSell string
-//	}{
-//		StockId:        s.StockId,
-//		Description: s.Description,
-//		PriceBuy: stringBuy,
-//		PriceSell: stringSell,
-//	}, nil
-//}
-
-// SetBSON implements bson.Setter.
-//func (s *Stock) SetBSON(raw bson.Raw) error {
-//
-//	decoded := new(struct {
-//		StockId int
-//		Description string
-//		PriceBuy string
-//		PriceSell string
-//	})
-//
-//	//bsonErr := raw.Unmarshal(decoded)
-//	bsonErr := bson.Unmarshal(raw, decoded)
-//
-//	buyDec, _ := NewFromString(decoded.PriceBuy)
-//	sellDec, _ := NewFromString(decoded.PriceBuy)
-//
-//	if bsonErr == nil {
-//		s.StockId = decoded.StockId
-//		s.Description = decoded.Description
-//		s.PriceBuy = buyDec
-//		s.PriceSell = sellDec
-//		return nil
-//	} else {
-//		return bsonErr
-//	}
-//}
-
 type MessageSendEmail struct {
 	Html       string
 	PlainText  string
@@ -125,6 +110,7 @@ type Holding struct {
 	StockId      string
 	Lots         []Lot
 	Transactions []Transaction
+	Payments     []Transaction // cash paid for the holding by corporate actions e.g. the cash part of a merger
 }
 
 type Lot struct {
@@ -161,27 +147,6 @@ func NewFromStringChecked(s string) Decimal {
 	return retval
 }
 
-func (w DecimalExt) MarshalBSON() ([]byte, error) {
-	intermediate := make(map[string]interface{})
-	intermediate["value"] = w.String()
-
-	return bson.Marshal(intermediate)
-}
-
-func (w *DecimalExt) UnmarshalBSON(raw []byte) error {
-	var decoded map[string]string
-	bsonErr := bson.Unmarshal(raw, &decoded)
-	if bsonErr != nil {
-		return bsonErr
-	}
-
-	pounds, err := NewFromString(decoded["value"])
-	CheckError(err)
-
-	w.Decimal = pounds
-	return nil
-}
-
 func (stock Stock) ToString() string {
 	desc, _ := json.Marshal(stock)
 	return string(desc)
@@ -195,6 +160,15 @@ type Alert struct {
 	Instruction MonitorInstruction
 	Stock		*Stock
 	Message     string
+	Severity    int
+}
+
+// GetSeverity treats alerts created before severities existed as info
+func (alert Alert) GetSeverity() int {
+	if alert.Severity == 0 {
+		return AlertSeverityInfo
+	}
+	return alert.Severity
 }
 
 type MonitorInstruction struct {
@@ -242,6 +216,10 @@ func (lot Lot) GetValueTotalBought() Decimal {
 	return lot.PriceBought.Mul(lot.Units)
 }
 
+func (holding Holding) GetUnitsTotalDesc() string {
+	return GetFormatter().FormatUnits(holding.GetUnitsTotal())
+}
+
 func (holding Holding) GetPriceAverageBought() Decimal {
 	totalValue := holding.GetValueTotalBought()
 
@@ -272,79 +250,16 @@ type Watch struct {
 	AddedPriceBuy  Money
 	AddedPriceSell Money
 	AlertThreshold DecimalExt
+	Expression     string // condition for WatchTypeExpression, see ParseExpression
 	Notes          string
 
 	DtAdded   string
 	WatchType int
 	DtStop    string
 	StockIdLegacy int
+	WatchIdLegacy int
 }
 
-//type WatchBSON struct {
-//	WatchId        string `bson:"_id,omitempty"`
-//	StockId        string
-//	DtReference    string
-//	AddedPriceBuy  string
-//	AddedPriceSell string
-//	AlertThreshold string
-//	Notes          string
-//
-//	DtAdded   string
-//	WatchType int
-//	DtStop    string
-//	StockIdLegacy int
-//}
-
-//func (w Watch) MarshalBSON() ([]byte, error) {
-//	stringBuy := w.AddedPriceBuy.String()
-//	stringSell := w.AddedPriceSell.String()
-//	stringThreshold := w.AlertThreshold.String()
-//
-//	intermediate := WatchBSON {
-//		w.WatchId,
-//		w.StockId,
-//		w.DtReference,
-//		stringBuy,
-//		stringSell,
-//		stringThreshold,
-//		w.Notes,
-//
-//		w.DtAdded,
-//		w.WatchType,
-//		w.DtStop,
-//		w.StockIdLegacy,
-//	}
-//
-//	return bson.Marshal(intermediate)
-//}
-//
-//// SetBSON implements bson.Setter.
-//func (w *Watch) UnmarshalBSON(raw []byte) error {
-//
-//	var decoded WatchBSON
-//	bsonErr := bson.Unmarshal(raw, &decoded)
-//	if bsonErr != nil {
-//		return bsonErr
-//	}
-//
-//	buyDec, _ := NewFromString(decoded.AddedPriceBuy)
-//	sellDec, _ := NewFromString(decoded.AddedPriceSell)
-//	thresholdDec, _ := NewFromString(decoded.AlertThreshold)
-//
-//	w.WatchId = decoded.WatchId
-//	w.StockId =	decoded.StockId
-//	w.DtReference =	decoded.DtReference
-//	w.AddedPriceBuy = buyDec
-//	w.AddedPriceSell = sellDec
-//	w.AlertThreshold = thresholdDec
-//	w.Notes =decoded.Notes
-//	w.DtAdded =	decoded.DtAdded
-//	w.WatchType =	decoded.WatchType
-//	w.DtStop =	decoded.DtStop
-//	w.StockIdLegacy = decoded.StockIdLegacy
-//	return nil
-//}
-
 func (wd *WatchDetail) GetPriceLastClosePoundsDesc() string {
 	priceLastClose := wd.GetPriceLastClosePounds()
 	if priceLastClose.Value.IsNegative() {
@@ -378,8 +293,7 @@ type watchDetailIex struct {
 }
 
 func (m *Money) GetDesc() string {
-	rounded := m.Value.Round(3)
-	return fmt.Sprintf("%v %v", rounded.String(), m.Currency)
+	return GetFormatter().FormatMoney(*m)
 }
 
 func (wd *WatchDetail) GetPricePreviousCloseDesc() string {
@@ -411,58 +325,107 @@ func (wd *WatchDetail) GetChangePercentDesc() string {
 		return GetPercentDesc(percentChange)
 	}
 
-	Log(fmt.Sprintf("Could not get percent change from watchdetail %v", wd))
+	GetLogger().Warning("Could not get percent change from watchdetail", "stock", wd.Stock, "eods", len(wd.History.Eods))
 	return ""
 }
 
 func getPercentChange(was Decimal, is Decimal) Decimal {
-	Log("***was " + was.String() + "is " + is.String())
-
 	change := is.Sub(was)
-
-	Log("***Change " + change.String())
 	ratio := change.Div(was)
 
-	Log("***ratio " + ratio.String())
+	GetLogger().Debug("Percent change", "was", was, "is", is, "change", change, "ratio", ratio)
 
 	return ratio.Mul(NewFromInt(100))
 }
 
 func GetPercentDesc(percent Decimal) string {
-	return fmt.Sprintf("%v %%", percent.Round(3))
+	return GetFormatter().FormatPercent(percent)
 }
 
 const TimeFormatMySql = "2006-01-02 15:04:05"
 const TimeFormatPostGres = time.RFC3339Nano
 const TimeFormatUnknown = "2006-01-02T15:04:05Z"
 
-func (wd *WatchDetail) GetDtReferenceDesc() string {
-	parse, err := time.Parse(TimeFormatMySql, wd.Watch.DtReference)
-	if err != nil {
-		parse, err = time.Parse(TimeFormatUnknown, wd.Watch.DtReference)
+const TimeFormatDate = "2006-01-02"
+
+// ParseDt reads the date strings stored on watches and transactions, which depend on where they were written from
+func ParseDt(dt string) (time.Time, error) {
+	var err error
+	for _, format := range []string{TimeFormatMySql, TimeFormatUnknown, TimeFormatPostGres, TimeFormatDate} {
+		var parsed time.Time
+		parsed, err = time.Parse(format, dt)
+		if err == nil {
+			return parsed, nil
+		}
 	}
+	return time.Time{}, err
+}
 
+func (wd *WatchDetail) GetDtReferenceDesc() string {
+	parse, err := ParseDt(wd.Watch.DtReference)
 	CheckError(err)
 	return parse.Format(time.RFC822)
 }
 
 func (wd *WatchDetail) GetDeltaReferencePercentDesc() string {
+	return GetPercentDesc(wd.GetDeltaReferencePercent())
+}
 
-	Log("***Stock " + wd.Stock.Description)
-
+func (wd *WatchDetail) GetDeltaReferencePercent() Decimal {
 	priceStartUnconverted := wd.Watch.AddedPriceBuy
 	priceStartPounds := priceStartUnconverted.toPounds()
 
-	Log("***AddedPriceBuy " + wd.Watch.AddedPriceBuy.GetDesc() + " priceStartPounds " + priceStartPounds.GetDesc())
-
 	priceLastPounds := wd.GetPriceLastClosePounds()
 
-	Log("*** priceLastClose " + priceLastPounds.GetDesc())
+	GetLogger().Debug("Delta from reference",
+		"stock", wd.Stock.Description,
+		"addedPriceBuy", wd.Watch.AddedPriceBuy.GetDesc(),
+		"priceStartPounds", priceStartPounds.GetDesc(),
+		"priceLastClose", priceLastPounds.GetDesc())
 
 	checkCurrency(priceStartPounds, priceLastPounds)
 
-	percent := getPercentChange(priceStartPounds.Value.Decimal, priceLastPounds.Value.Decimal)
-	return GetPercentDesc(percent)
+	return getPercentChange(priceStartPounds.Value.Decimal, priceLastPounds.Value.Decimal)
+}
+
+// GetTransactionType matches the statement reference, or the description for income, against the TransactionType constants
+func (transaction Transaction) GetTransactionType() string {
+	reference := strings.ToLower(strings.TrimSpace(transaction.Reference))
+	description := strings.ToLower(transaction.Description)
+
+	for _, transactionType := range []string{TransactionTypeManagementFee, TransactionTypeInterest, TransactionTypeInputCard, TransactionTypeTransferOut, TransactionTypeInputDirectDebit, TransactionTypeInputBankTransfer, TransactionTypeDividend, TransactionTypeDistribution, TransactionTypeCorporateAction} {
+		if isReferenceType(reference, transactionType) {
+			return transactionType
+		}
+	}
+
+	if strings.Contains(description, TransactionTypeDistribution) {
+		return TransactionTypeDistribution
+	}
+	if strings.Contains(description, TransactionTypeDividend) || reference == "div" {
+		return TransactionTypeDividend
+	}
+	return ""
+}
+
+// isReferenceType is true when the reference starts with the whole type, e.g. "dd 123" and "dd123" are direct debits
+// but "ddx" isn't
+func isReferenceType(reference string, transactionType string) bool {
+	if !strings.HasPrefix(reference, transactionType) {
+		return false
+	}
+
+	rest := reference[len(transactionType):]
+	if len(rest) == 0 {
+		return true
+	}
+	next := rest[0]
+	return !(next >= 'a' && next <= 'z')
+}
+
+func (transaction Transaction) IsDividend() bool {
+	transactionType := transaction.GetTransactionType()
+	return transactionType == TransactionTypeDividend || transactionType == TransactionTypeDistribution
 }
 
 func (transaction Transaction) IsBuy() bool {
@@ -485,8 +448,7 @@ func (wd *WatchDetail) GetPriceLastClosePounds() Money {
 	pounds := lastEod.PriceClosePounds
 
 	if pounds.Currency != CURRENCY_GBP {
-		marshal, _ := json.Marshal(*wd)
-		Log(string(marshal))
+		GetLogger().Error("Currency incorrect on last close", "currency", pounds.Currency, "watchDetail", *wd)
 		CheckError(errors.New("Currency incorrect " + pounds.Currency))
 	}
 
@@ -503,15 +465,28 @@ func (wd *WatchDetail) GetPriceLastCloseDecimal() Decimal {
 }
 
 
+func (wd *WatchDetail) GetPriceLastClosePenceDesc() string {
+	priceLastClose := wd.GetPriceLastClosePounds()
+	if priceLastClose.Value.IsNegative() {
+		return "No price history"
+	}
+
+	return GetFormatter().FormatPence(priceLastClose)
+}
+
 func (wd *WatchDetail) GetPriceLastClosePence() Money {
 	return wd.GetPriceLastClosePounds().ToSubunits()
 }
 
 func (stock *Stock) GetPriceUrl() string {
+	return stock.GetPriceUrlConfig(GetConfig())
+}
+
+func (stock *Stock) GetPriceUrlConfig(cfg *Config) string {
 	if stock.IsSourceHl() {
 		return stock.getHlUrl()
 	} else {
-		return stock.getMarketStackUrl()
+		return stock.getMarketStackUrl(cfg.TokenMarketStack)
 	}
 }
 
@@ -554,15 +529,13 @@ func (stock *Stock) getHlUrl() string {
 	return urlToUse
 }
 
-func (stock *Stock) getMarketStackUrl() string {
+func (stock *Stock) getMarketStackUrl(token string) string {
 	today := time.Now()
 	weekAgo := today.Add(-time.Hour * 24 * 7)
 
 	todayStr := today.Format("2006-01-02")
 	weekAgoStr := weekAgo.Format("2006-01-02")
 
-	token := GetSecret(EnvSecretTokenMarketStack)
-
 	return fmt.Sprintf("http://api.marketstack.com/v1/eod?symbols=%v&access_key=%v&date_from=%v&date_to=%v",
 		stock.Symbol,
 		token,
@@ -611,7 +584,7 @@ func BuildWatchDetail(client *DefaultHttp, stock Stock) WatchDetail {
 }
 
 func buildWatchDetailHl(stock Stock) WatchDetail {
-	Log(fmt.Sprintf("Getting history from HL for %v from %v", stock.ToString(), stock.Url))
+	GetLogger().Info("Getting history from HL", "stock", stock.GetDisplayName(), "url", stock.Url)
 
 	stockPage, err := http.Get(stock.Url)
 	CheckError(err)
@@ -643,16 +616,12 @@ func buildWatchDetailHl(stock Stock) WatchDetail {
 	percentChange, err := NewFromString(percentChangeStr)
 	CheckError(err)
 
-	if len(priceSellStr) == 0 || len(priceSellStr) == 0 {
-		Log("Failed to get a price for stock " + stock.Description)
-		message := fmt.Sprint(stock.Description, " Url: ", stock.Url, " Buy ", priceBuyStr, " Sell ", priceSellStr)
-		Log(message)
+	if len(priceBuyStr) == 0 || len(priceSellStr) == 0 {
+		GetLogger().Warning("Failed to get a price for stock", "stock", stock.Description, "url", stock.Url, "buy", priceBuyStr, "sell", priceSellStr)
 	}
 
 	if len(percentChangeStr) == 0 {
-		Log("Failed to get a percent change for stock " + stock.Description)
-		message := fmt.Sprint(stock.Description, " Url: ", stock.Url, " String ", percentChangeStr)
-		Log(message)
+		GetLogger().Warning("Failed to get a percent change for stock", "stock", stock.Description, "url", stock.Url)
 	}
 
 	priceCloseUnits := parsePrice(priceSellStr)
@@ -673,8 +642,8 @@ func buildWatchDetailHl(stock Stock) WatchDetail {
 }
 
 func BuildWatchDetailMarketStack(client HttpSource, stock *Stock) WatchDetail {
-	log := fmt.Sprintf("BuildWatchDetailMarketStack price history for %v from URL: %v", stock.ToString(), stock.Url)
-	Log(log)
+	log := GetLogger().With("stock", stock.GetDisplayName(), "symbol", stock.Symbol)
+	log.Info("BuildWatchDetailMarketStack price history", "url", stock.Url)
 
 	response, err := client.HttpGet(stock.Url)
 	CheckError(err)
@@ -689,8 +658,7 @@ func BuildWatchDetailMarketStack(client HttpSource, stock *Stock) WatchDetail {
 	responseData, err := ioutil.ReadAll(response.Body)
 	CheckError(err)
 
-	responseString := string(responseData)
-	Log(responseString)
+	log.Debug("MarketStack EOD response", "body", string(responseData))
 
 	var responseDays ResponseMarketStack
 	err = json.Unmarshal(responseData, &responseDays)
@@ -728,8 +696,7 @@ func buildWatchDetailIex(stock Stock) WatchDetail {
 	responseData, err := ioutil.ReadAll(response.Body)
 	CheckError(err)
 
-	responseString := string(responseData)
-	Log(responseString)
+	GetLogger().Debug("IEX quote response", "symbol", stock.Symbol, "body", string(responseData))
 
 	var quote WatchDetail
 	err = json.Unmarshal(responseData, &quote)
@@ -751,10 +718,8 @@ func (stock *Stock) populateFromHl() {
 	priceSellStr, err := stockDoc.Find(".bid.price-divide").Html()
 	CheckError(err)
 
-	if len(priceSellStr) == 0 || len(priceSellStr) == 0 {
-		Log("Failed to get an HL price for stock " + stock.HlName)
-		message := fmt.Sprint(stock.HlName, " Url: ", fullUrl, " Buy ", priceBuyStr, " Sell ", priceSellStr)
-		Log(message)
+	if len(priceBuyStr) == 0 || len(priceSellStr) == 0 {
+		GetLogger().Warning("Failed to get an HL price for stock", "stock", stock.HlName, "url", fullUrl, "buy", priceBuyStr, "sell", priceSellStr)
 	}
 
 	stock.PriceBuy = parsePrice(priceBuyStr).toPounds()
@@ -798,30 +763,18 @@ func (stock *Stock) populateFromMarketStack() {
 	watchDetail := BuildWatchDetailMarketStack(&httpClient, stock)
 
 	// TODO: Ankit: use price buy & price sell
-	currency := CURRENCY_GBP
-	if stock.Exchange == ExchangeUsa {
-		currency = CURRENCY_USD
-	}
-
+	// eods are already converted to pounds using the stock's quote currency
 	priceLastClose := watchDetail.GetPriceLastClosePounds()
 
-	if currency != CURRENCY_GBP {
-		priceLastClose = priceLastClose.toPounds()
-	}
-
 	stock.PriceBuy = priceLastClose
 	stock.PriceSell = priceLastClose
 
 	if stock.PriceBuy.Value.String() == "0" {
-		Log("Marketstack failed to get buy price for " + stock.Description + " from " + stock.Url)
-		wdJson, _ := json.Marshal(watchDetail)
-		Log(string(wdJson))
+		GetLogger().Warning("Marketstack failed to get buy price", "stock", stock.Description, "url", stock.Url, "watchDetail", watchDetail)
 	}
 
 	if stock.PriceSell.Value.String() == "0" {
-		Log("Marketstack failed to get sell price for " + stock.Description + " from " + stock.Url)
-		wdJson, _ := json.Marshal(watchDetail)
-		Log(string(wdJson))
+		GetLogger().Warning("Marketstack failed to get sell price", "stock", stock.Description, "url", stock.Url, "watchDetail", watchDetail)
 	}
 }
 
@@ -834,6 +787,17 @@ type Account struct {
 	AccountName string
 }
 
+func GetAccountName(accountId int) string {
+	switch accountId {
+	case AccountIdIsa:
+		return "ISA"
+	case AccountIdShare:
+		return "Share"
+	default:
+		return "Unknown"
+	}
+}
+
 type HttpRequest interface {
 	GetApiKey() string
 }
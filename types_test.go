@@ -40,6 +40,8 @@ func getWatchDetailUk() WatchDetail {
 }
 
 func TestParseMarketStackResponseUsd(t *testing.T) {
+	defer replaceFormatter(NewLegacyFormatter())()
+
 	key := getConversionKey(CURRENCY_USD, CURRENCY_GBP)
 	currencyConverter[key], _ = NewFromString("0.5")
 
@@ -56,6 +58,8 @@ func TestParseMarketStackResponseUsd(t *testing.T) {
 }
 
 func TestParseMarketStackResponseGbp(t *testing.T) {
+	defer replaceFormatter(NewLegacyFormatter())()
+
 	wd := getWatchDetailUk();
 	testParseMarketStackResponse(t, wd, 232,
 		"96.44",
@@ -139,6 +143,8 @@ func testParseMarketStackResponse(t *testing.T,
 }
 
 func TestCalculatePercentageChangeFromReference(t *testing.T) {
+	defer replaceFormatter(NewLegacyFormatter())()
+
 
 	priceClosePounds := Money {
 		Currency: CURRENCY_GBP,
@@ -172,6 +178,8 @@ func TestCalculatePercentageChangeFromReference(t *testing.T) {
 }
 
 func TestGetDeltaReferencePercentDesc(t *testing.T) {
+	defer replaceFormatter(NewLegacyFormatter())()
+
 	key := getConversionKey(CURRENCY_USD, CURRENCY_GBP)
 	currencyConverter[key], _ = NewFromString("1")
 
@@ -237,3 +245,60 @@ func testParseRate(t *testing.T, fakeResponse []byte, from string, to string, ex
 	}
 }
 
+
+func TestPopulateUsablePriceQuoteCurrency(t *testing.T) {
+	key := getConversionKey(CURRENCY_USD, CURRENCY_GBP)
+	currencyConverter[key], _ = NewFromString("0.5")
+
+	testPopulateUsablePrice(t, Stock{Exchange: ExchangeLondon}, "1234.5", "12.345")
+	testPopulateUsablePrice(t, Stock{Exchange: ExchangeLondon, QuoteCurrency: CURRENCY_GBP}, "61.23", "61.23")
+	testPopulateUsablePrice(t, Stock{Exchange: ExchangeLondon, QuoteCurrency: CURRENCY_USD}, "70.5", "35.25")
+	testPopulateUsablePrice(t, Stock{Exchange: ExchangeUsa}, "434", "217")
+}
+
+func testPopulateUsablePrice(t *testing.T, stock Stock, closeStr string, expectedPoundsStr string) {
+	eod := EodMarketStack{
+		PriceClose: NewFromStringChecked(closeStr),
+	}
+	eod.PopulateUsablePrice(&stock)
+
+	expected := NewFromStringChecked(expectedPoundsStr)
+	if eod.PriceClosePounds.Currency != CURRENCY_GBP || !eod.PriceClosePounds.Value.Equal(expected) {
+		t.Errorf("Quote %v %v expected %v GBP actual %v", closeStr, stock.GetQuoteCurrency(), expected, eod.PriceClosePounds.GetDesc())
+	}
+}
+
+func TestTickerQuoteCurrency(t *testing.T) {
+	file, err := ioutil.ReadFile("examples/tickervusa.json")
+	CheckError(err)
+
+	var ticker ResponseTickerMarketStack
+	err = json.Unmarshal(file, &ticker)
+	CheckError(err)
+
+	if ticker.StockExchange.Mic != ExchangeLondon {
+		t.Errorf("Expected exchange %v actual %v", ExchangeLondon, ticker.StockExchange.Mic)
+	}
+
+	// VUSA is quoted in GBP on the LSE
+	if actual := ticker.GetQuoteCurrency(); actual != CURRENCY_GBP {
+		t.Errorf("Expected quote currency %v actual %v", CURRENCY_GBP, actual)
+	}
+
+	ticker.PriceCurrency = "GBp"
+	if actual := ticker.GetQuoteCurrency(); actual != CURRENCY_GBX {
+		t.Errorf("Expected quote currency %v actual %v", CURRENCY_GBX, actual)
+	}
+
+	// LSE reports GBP at exchange level, without a price currency the exchange default of pence applies
+	ticker.PriceCurrency = ""
+	if actual := ticker.GetQuoteCurrency(); actual != CURRENCY_GBX {
+		t.Errorf("Expected quote currency %v actual %v", CURRENCY_GBX, actual)
+	}
+
+	ticker.StockExchange.Mic = ExchangeUsa
+	ticker.StockExchange.Currency.Code = CURRENCY_USD
+	if actual := ticker.GetQuoteCurrency(); actual != CURRENCY_USD {
+		t.Errorf("Expected quote currency %v actual %v", CURRENCY_USD, actual)
+	}
+}
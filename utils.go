@@ -4,21 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"time"
 )
 
+// LogDebug and Log predate Logger, prefer GetLogger() with fields for anything new
 func LogDebug(message string) {
-	if os.Getenv("DEBUG") == "1" {
-		fmt.Println(message)
-	}
+	// make sure the debug level has been picked up from config
+	GetConfig()
+	GetLogger().Debug(message)
 }
 
 func Log(message string) {
-	fmt.Println(message)
+	GetLogger().Info(message)
 }
 
 func CheckError(err error) {
@@ -56,7 +56,7 @@ func PostJsonToUrl(url string, object interface{}) {
 
 	defer res.Body.Close()
 
-	fmt.Println("response Status:", res.Status)
-	// Print the body to the stdout
-	_, _ = io.Copy(os.Stdout, res.Body)
+	body, _ := ioutil.ReadAll(res.Body)
+	GetLogger().Info("Posted JSON", "url", url, "status", res.Status)
+	GetLogger().Debug("Post JSON response", "url", url, "body", string(body))
 }
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/shopspring/decimal"
+)
+
+// CashStockId is the StockId of the pseudo holding for an account's uninvested cash
+const CashStockId = "cash"
+
+type PositionValue struct {
+	StockId string
+	Name    string
+	Units   Decimal
+	Price   Money
+	Value   Money
+	Cost    Money
+	IsCash  bool
+}
+
+type AccountValuation struct {
+	AccountId int
+	Name      string
+	Positions []PositionValue
+	Value     Money
+}
+
+// PortfolioValuation values every holding at its stock's sell price, in GBP
+type PortfolioValuation struct {
+	Date     time.Time
+	Accounts []AccountValuation
+	Value    Money
+}
+
+func (position PositionValue) GetGain() (Money, error) {
+	return position.Value.SubStrict(position.Cost)
+}
+
+func (account AccountValuation) GetCash() (Money, error) {
+	cash := NewMoneyBag()
+	for _, position := range account.Positions {
+		if position.IsCash {
+			cash.Add(position.Value)
+		}
+	}
+	return cash.Total(CURRENCY_GBP)
+}
+
+func (account AccountValuation) GetInvested() (Money, error) {
+	cash, err := account.GetCash()
+	if err != nil {
+		return Money{}, err
+	}
+	return account.Value.SubStrict(cash)
+}
+
+func (valuation PortfolioValuation) GetAccount(accountId int) (AccountValuation, bool) {
+	for _, account := range valuation.Accounts {
+		if account.AccountId == accountId {
+			return account, true
+		}
+	}
+	return AccountValuation{}, false
+}
+
+// GetPositions combines the positions in the same stock across accounts, cash included as one position
+func (valuation PortfolioValuation) GetPositions() ([]PositionValue, error) {
+	var stockIds []string
+	combined := map[string]*PositionValue{}
+
+	for _, account := range valuation.Accounts {
+		for _, position := range account.Positions {
+			existing, ok := combined[position.StockId]
+			if !ok {
+				copied := position
+				combined[position.StockId] = &copied
+				stockIds = append(stockIds, position.StockId)
+				continue
+			}
+			value, err := existing.Value.AddStrict(position.Value)
+			if err != nil {
+				return nil, fmt.Errorf("stock %v: %w", position.StockId, err)
+			}
+			cost, err := existing.Cost.AddStrict(position.Cost)
+			if err != nil {
+				return nil, fmt.Errorf("stock %v: %w", position.StockId, err)
+			}
+			existing.Units = existing.Units.Add(position.Units)
+			existing.Value = value
+			existing.Cost = cost
+		}
+	}
+
+	positions := make([]PositionValue, 0, len(stockIds))
+	for _, stockId := range stockIds {
+		positions = append(positions, *combined[stockId])
+	}
+	return positions, nil
+}
+
+// ValuePortfolio splits each holding's lots by account and adds each account's cash balance when cashLedgers is set.
+// It's an error when a price or balance can't be converted to GBP
+func ValuePortfolio(date time.Time, holdings []Holding, stocks map[string]*Stock, cashLedgers map[int]*CashLedger) (PortfolioValuation, error) {
+	valuation := PortfolioValuation{Date: date}
+
+	positionsByAccount := map[int][]PositionValue{}
+	for _, holding := range holdings {
+		stock := stocks[holding.StockId]
+
+		lotsByAccount := map[int][]Lot{}
+		var accountIds []int
+		for _, lot := range holding.Lots {
+			accountId := lot.Transaction.AccountId
+			if _, ok := lotsByAccount[accountId]; !ok {
+				accountIds = append(accountIds, accountId)
+			}
+			lotsByAccount[accountId] = append(lotsByAccount[accountId], lot)
+		}
+
+		for _, accountId := range accountIds {
+			accountHolding := Holding{StockId: holding.StockId, Lots: lotsByAccount[accountId]}
+			position, err := getPositionValue(accountHolding, stock)
+			if err != nil {
+				return PortfolioValuation{}, err
+			}
+			positionsByAccount[accountId] = append(positionsByAccount[accountId], position)
+		}
+	}
+
+	for accountId, ledger := range cashLedgers {
+		positionsByAccount[accountId] = append(positionsByAccount[accountId], ledger.ToPosition())
+	}
+
+	var accountIds []int
+	for accountId := range positionsByAccount {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Ints(accountIds)
+
+	total := NewMoneyBag()
+	for _, accountId := range accountIds {
+		positions := positionsByAccount[accountId]
+
+		accountTotal := NewMoneyBag()
+		for _, position := range positions {
+			accountTotal.Add(position.Value)
+		}
+		total.AddBag(accountTotal)
+
+		value, err := accountTotal.Total(CURRENCY_GBP)
+		if err != nil {
+			return PortfolioValuation{}, fmt.Errorf("account %v: %w", accountId, err)
+		}
+		valuation.Accounts = append(valuation.Accounts, AccountValuation{
+			AccountId: accountId,
+			Name:      GetAccountName(accountId),
+			Positions: positions,
+			Value:     value,
+		})
+	}
+
+	value, err := total.Total(CURRENCY_GBP)
+	if err != nil {
+		return PortfolioValuation{}, err
+	}
+	valuation.Value = value
+	return valuation, nil
+}
+
+func getPositionValue(holding Holding, stock *Stock) (PositionValue, error) {
+	units := holding.GetUnitsTotal()
+	position := PositionValue{
+		StockId: holding.StockId,
+		Name:    holding.StockId,
+		Units:   units,
+		Price:   FromPounds("0"),
+		Value:   FromPounds("0"),
+		Cost:    Money{Currency: CURRENCY_GBP, Value: DecimalExt{holding.GetValueTotalBought()}},
+	}
+
+	if stock == nil || stock.PriceSell.Value.IsZero() {
+		GetLogger().Warning("No price to value holding", "stockId", holding.StockId)
+		return position, nil
+	}
+
+	price, err := stock.PriceSell.toPoundsStrict()
+	if err != nil {
+		return PositionValue{}, fmt.Errorf("stock %v: %w", holding.StockId, err)
+	}
+	position.Name = stock.GetDisplayName()
+	position.Price = price
+	position.Value = position.Price.Mul(units)
+	return position, nil
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/shopspring/decimal"
+)
+
+// crash analysis compares the last close with the highest close over this many trading days
+const CrashLookbackDays = 20
+
+// Evaluate checks the watch against its price history and returns the alerts it raises, if any
+func (wd *WatchDetail) Evaluate() []Alert {
+	if len(wd.History.Eods) == 0 {
+		return nil
+	}
+
+	var alert *Alert
+	switch wd.Watch.WatchType {
+	case WatchTypeThreshold:
+		alert = wd.evaluateThreshold()
+	case WatchTypeCrashAnalysis:
+		alert = wd.evaluateCrash()
+	case WatchTypeExpression:
+		alert = wd.evaluateExpression()
+	default:
+		GetLogger().Warning("Cannot evaluate watch type", "watchId", wd.Watch.WatchId, "watchType", wd.Watch.WatchType)
+	}
+
+	if alert == nil {
+		return nil
+	}
+	return []Alert{*alert}
+}
+
+// evaluateThreshold alerts when the price has moved AlertThreshold percent either way since the reference price
+func (wd *WatchDetail) evaluateThreshold() *Alert {
+	if wd.Watch.AddedPriceBuy.Value.IsZero() || wd.Watch.AlertThreshold.IsZero() {
+		return nil
+	}
+
+	delta := wd.GetDeltaReferencePercent()
+	threshold := wd.Watch.AlertThreshold.Abs()
+	if delta.Abs().LessThan(threshold) {
+		return nil
+	}
+
+	return wd.newAlert(fmt.Sprintf("%v moved %v since reference, threshold %v", wd.getName(), GetPercentDesc(delta), GetPercentDesc(threshold)), delta, threshold)
+}
+
+// evaluateCrash alerts when the last close is AlertThreshold percent below the high of the lookback
+func (wd *WatchDetail) evaluateCrash() *Alert {
+	high := wd.getRecentHigh(CrashLookbackDays)
+	if high.IsZero() || wd.Watch.AlertThreshold.IsZero() {
+		return nil
+	}
+
+	drop := getPercentChange(high, wd.GetPriceLastClosePounds().Value.Decimal)
+	threshold := wd.Watch.AlertThreshold.Abs()
+	if drop.GreaterThan(threshold.Neg()) {
+		return nil
+	}
+
+	return wd.newAlert(fmt.Sprintf("%v is %v from its %v day high", wd.getName(), GetPercentDesc(drop), CrashLookbackDays), drop, threshold)
+}
+
+// evaluateExpression alerts when the watch's Expression holds, days without enough history for it don't alert
+func (wd *WatchDetail) evaluateExpression() *Alert {
+	expression, err := wd.Watch.GetExpression()
+	if err != nil || expression == nil {
+		GetLogger().Warning("Cannot parse watch expression", "watchId", wd.Watch.WatchId, "expression", wd.Watch.Expression, "error", err)
+		return nil
+	}
+
+	matched, err := expression.Evaluate(wd)
+	if errors.Is(err, ErrNotEnoughHistory) {
+		GetLogger().Debug("Not enough history for watch expression", "watchId", wd.Watch.WatchId, "expression", expression.Source)
+		return nil
+	}
+	if err != nil {
+		GetLogger().Warning("Cannot evaluate watch expression", "watchId", wd.Watch.WatchId, "expression", expression.Source, "error", err)
+		return nil
+	}
+	if !matched {
+		return nil
+	}
+
+	// the expression has no size of move so the alert is always a warning
+	return wd.newAlert(fmt.Sprintf("%v matched %v", wd.getName(), expression.Source), NewFromInt(0), NewFromInt(1))
+}
+
+func (wd *WatchDetail) getRecentHigh(days int) Decimal {
+	high := NewFromInt(0)
+	for ix, eod := range wd.History.Eods {
+		if ix >= days {
+			break
+		}
+		if eod.PriceClosePounds.Value.GreaterThan(high) {
+			high = eod.PriceClosePounds.Value.Decimal
+		}
+	}
+	return high
+}
+
+func (wd *WatchDetail) getName() string {
+	if wd.Stock != nil {
+		return wd.Stock.GetDisplayName()
+	}
+	return wd.Watch.StockId
+}
+
+// newAlert is a warning, or critical once the move is twice the threshold
+func (wd *WatchDetail) newAlert(message string, move Decimal, threshold Decimal) *Alert {
+	severity := AlertSeverityWarning
+	if move.Abs().GreaterThanOrEqual(threshold.Mul(NewFromInt(2))) {
+		severity = AlertSeverityCritical
+	}
+
+	return &Alert{
+		Instruction: MonitorInstruction{
+			StockId:            wd.Watch.StockId,
+			PriceTypeToMonitor: PriceTypeSell,
+			MarkerPrice:        wd.GetPriceLastClosePounds().Value.Decimal,
+			Message:            message,
+		},
+		Stock:    wd.Stock,
+		Message:  message,
+		Severity: severity,
+	}
+}